@@ -0,0 +1,261 @@
+/*
+ * Seashell - SSH server with virtual hosts and username-based routing
+ *
+ * Copyright (C) 2024 Elara6331 <elara@elara.ws>
+ *
+ * This file is part of Seashell.
+ *
+ * Seashell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * Seashell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with Seashell.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	"go.elara.ws/seashell/internal/approval"
+	"go.elara.ws/seashell/internal/config"
+	"go.elara.ws/seashell/internal/fail2ban"
+	"go.elara.ws/seashell/internal/grants"
+	"go.elara.ws/seashell/internal/router"
+	"go.elara.ws/seashell/internal/sshctx"
+)
+
+// adminHandler returns the handler for the built-in admin route. Admins can
+// use it to grant users temporary access to routes, for example for
+// break-glass workflows, without changing their permanent permissions,
+// to approve sessions on routes that require approval, and to manage
+// fail2ban bans.
+func adminHandler(cfg config.Config, gs *grants.Store, q *approval.Queue, f2b *fail2ban.Fail2Ban) router.Handler {
+	return func(sess ssh.Session, arg string) error {
+		admin, _ := sshctx.GetUser(sess.Context())
+
+		args := sess.Command()
+		if len(args) == 0 {
+			args = []string{"help"}
+		}
+
+		switch args[0] {
+		case "grants":
+			return listGrants(sess, gs)
+		case "grant":
+			if len(args) < 4 {
+				return errors.New("usage: grant <user> <route> <duration> [reason]")
+			}
+			return addGrant(sess, cfg, gs, admin, args[1], args[2], args[3], strings.Join(args[4:], " "))
+		case "revoke":
+			if len(args) != 2 {
+				return errors.New("usage: revoke <id>")
+			}
+			return revokeGrant(sess, gs, admin, args[1])
+		case "approvals":
+			return listApprovals(sess, q)
+		case "approve", "deny":
+			if len(args) != 2 {
+				return fmt.Errorf("usage: %s <id>", args[0])
+			}
+			return decideApproval(sess, q, admin, args[1], args[0] == "approve")
+		case "bans", "ban", "unban", "lockouts", "unlock":
+			if f2b == nil {
+				return errors.New("fail2ban isn't enabled")
+			}
+
+			switch args[0] {
+			case "bans":
+				return listBans(sess, f2b)
+			case "ban":
+				if len(args) != 2 && len(args) != 3 {
+					return errors.New("usage: ban <addr> [duration]")
+				}
+				return banAddr(sess, f2b, admin, args[1], args[2:])
+			case "lockouts":
+				return listLockouts(sess, f2b)
+			case "unlock":
+				if len(args) != 2 {
+					return errors.New("usage: unlock <user>")
+				}
+				return unlockUser(sess, f2b, admin, args[1])
+			default:
+				if len(args) != 2 {
+					return errors.New("usage: unban <addr>")
+				}
+				return unbanAddr(sess, f2b, admin, args[1])
+			}
+		default:
+			fmt.Fprint(sess, "Commands:\r\n")
+			fmt.Fprint(sess, "  grants                                    List active access grants\r\n")
+			fmt.Fprint(sess, "  grant <user> <route> <duration> [reason]  Let a user use a route for a limited time\r\n")
+			fmt.Fprint(sess, "  revoke <id>                               Revoke an access grant\r\n")
+			fmt.Fprint(sess, "  approvals                                 List sessions waiting for approval\r\n")
+			fmt.Fprint(sess, "  approve <id>                              Approve a session\r\n")
+			fmt.Fprint(sess, "  deny <id>                                 Deny a session\r\n")
+			fmt.Fprint(sess, "  bans                                      List addresses banned by fail2ban\r\n")
+			fmt.Fprint(sess, "  ban <addr> [duration]                     Ban an address or CIDR range now\r\n")
+			fmt.Fprint(sess, "  unban <addr>                              Unban an address or CIDR range\r\n")
+			fmt.Fprint(sess, "  lockouts                                  List users locked out by fail2ban\r\n")
+			fmt.Fprint(sess, "  unlock <user>                             Unlock a user\r\n")
+			return router.ExitStatus(2)
+		}
+	}
+}
+
+// listGrants writes the active access grants to the session.
+func listGrants(sess ssh.Session, gs *grants.Store) error {
+	tw := tabwriter.NewWriter(sess, 0, 0, 2, ' ', 0)
+	fmt.Fprint(tw, "ID\tUSER\tROUTE\tEXPIRES\tCREATED BY\tREASON\r\n")
+	for _, g := range gs.Active() {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\r\n", g.ID, g.User, g.Route, g.Expires.Format(time.RFC3339), g.CreatedBy, g.Reason)
+	}
+	return tw.Flush()
+}
+
+// addGrant lets the user use the route for the given duration.
+func addGrant(sess ssh.Session, cfg config.Config, gs *grants.Store, admin config.User, user, route, durationStr, reason string) error {
+	if !slices.ContainsFunc(cfg.Routes, func(r config.Route) bool { return r.Name == route }) {
+		return fmt.Errorf("no route named %q", route)
+	}
+
+	duration, err := time.ParseDuration(durationStr)
+	if err != nil {
+		return err
+	} else if duration <= 0 {
+		return errors.New("the duration must be positive")
+	}
+
+	g, err := gs.Add(grants.Grant{
+		User:      user,
+		Route:     route,
+		Expires:   time.Now().Add(duration),
+		CreatedBy: admin.Name,
+		Reason:    reason,
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Info(
+		"Access granted",
+		slog.String("id", g.ID),
+		slog.String("user", g.User),
+		slog.String("route", g.Route),
+		slog.Time("expires", g.Expires),
+		slog.String("created_by", g.CreatedBy),
+		slog.String("reason", g.Reason),
+	)
+	fmt.Fprintf(sess, "Granted %s access to %s until %s (id %s)\r\n", g.User, g.Route, g.Expires.Format(time.RFC3339), g.ID)
+	return nil
+}
+
+// revokeGrant removes the access grant with the given ID.
+func revokeGrant(sess ssh.Session, gs *grants.Store, admin config.User, id string) error {
+	ok, err := gs.Remove(id)
+	if err != nil {
+		return err
+	} else if !ok {
+		return fmt.Errorf("no grant with id %q", id)
+	}
+
+	log.Info("Access grant revoked", slog.String("id", id), slog.String("revoked_by", admin.Name))
+	fmt.Fprintf(sess, "Revoked grant %s\r\n", id)
+	return nil
+}
+
+// listBans writes the addresses banned by fail2ban to the session.
+func listBans(sess ssh.Session, f2b *fail2ban.Fail2Ban) error {
+	bans, err := f2b.Bans()
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(sess, 0, 0, 2, ' ', 0)
+	fmt.Fprint(tw, "ADDR\tUNTIL\tOFFENSES\r\n")
+	for _, ban := range bans {
+		fmt.Fprintf(tw, "%s\t%s\t%d\r\n", ban.Addr, ban.Until.Format(time.RFC3339), ban.Offenses)
+	}
+	return tw.Flush()
+}
+
+// banAddr bans an address or CIDR range immediately. If no duration is
+// given, the ban lasts as long as fail2ban would have banned it for.
+func banAddr(sess ssh.Session, f2b *fail2ban.Fail2Ban, admin config.User, addr string, durationArg []string) error {
+	var duration time.Duration
+	if len(durationArg) > 0 {
+		var err error
+		duration, err = time.ParseDuration(durationArg[0])
+		if err != nil {
+			return err
+		} else if duration <= 0 {
+			return errors.New("the duration must be positive")
+		}
+	}
+
+	addr, until, err := f2b.Ban(addr, duration)
+	if err != nil {
+		return err
+	}
+
+	log.Info("Address banned by admin", slog.String("addr", addr), slog.Time("until", until), slog.String("by", admin.Name))
+	fmt.Fprintf(sess, "Banned %s until %s\r\n", addr, until.Format(time.RFC3339))
+	return nil
+}
+
+// unbanAddr removes the ban on an address or CIDR range.
+func unbanAddr(sess ssh.Session, f2b *fail2ban.Fail2Ban, admin config.User, addr string) error {
+	addr, ok, err := f2b.Unban(addr)
+	if err != nil {
+		return err
+	} else if !ok {
+		return fmt.Errorf("%s isn't banned", addr)
+	}
+
+	log.Info("Address unbanned by admin", slog.String("addr", addr), slog.String("by", admin.Name))
+	fmt.Fprintf(sess, "Unbanned %s\r\n", addr)
+	return nil
+}
+
+// listLockouts writes the users locked out by fail2ban to the session.
+func listLockouts(sess ssh.Session, f2b *fail2ban.Fail2Ban) error {
+	lockouts, err := f2b.Lockouts()
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(sess, 0, 0, 2, ' ', 0)
+	fmt.Fprint(tw, "USER\tUNTIL\tOFFENSES\r\n")
+	for _, lockout := range lockouts {
+		fmt.Fprintf(tw, "%s\t%s\t%d\r\n", lockout.User, lockout.Until.Format(time.RFC3339), lockout.Offenses)
+	}
+	return tw.Flush()
+}
+
+// unlockUser removes a user's fail2ban lockout.
+func unlockUser(sess ssh.Session, f2b *fail2ban.Fail2Ban, admin config.User, user string) error {
+	ok, err := f2b.Unlock(user)
+	if err != nil {
+		return err
+	} else if !ok {
+		return fmt.Errorf("%s isn't locked out", user)
+	}
+
+	log.Info("User unlocked by admin", slog.String("user", user), slog.String("by", admin.Name))
+	fmt.Fprintf(sess, "Unlocked %s\r\n", user)
+	return nil
+}
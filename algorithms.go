@@ -0,0 +1,136 @@
+/*
+ * Seashell - SSH server with virtual hosts and username-based routing
+ *
+ * Copyright (C) 2024 Elara6331 <elara@elara.ws>
+ *
+ * This file is part of Seashell.
+ *
+ * Seashell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * Seashell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with Seashell.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/gliderlabs/ssh"
+	"go.elara.ws/seashell/internal/config"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// Algorithms supported by the SSH library, including legacy ones
+// that aren't enabled by default.
+var (
+	supportedKexAlgos = []string{
+		"curve25519-sha256", "curve25519-sha256@libssh.org",
+		"ecdh-sha2-nistp256", "ecdh-sha2-nistp384", "ecdh-sha2-nistp521",
+		"diffie-hellman-group14-sha256", "diffie-hellman-group16-sha512",
+		"diffie-hellman-group14-sha1", "diffie-hellman-group1-sha1",
+	}
+	supportedCiphers = []string{
+		"aes128-ctr", "aes192-ctr", "aes256-ctr",
+		"aes128-gcm@openssh.com", "aes256-gcm@openssh.com",
+		"chacha20-poly1305@openssh.com",
+		"arcfour256", "arcfour128", "arcfour",
+		"aes128-cbc", "3des-cbc",
+	}
+	supportedMACs = []string{
+		"hmac-sha2-256-etm@openssh.com", "hmac-sha2-512-etm@openssh.com",
+		"hmac-sha2-256", "hmac-sha2-512", "hmac-sha1", "hmac-sha1-96",
+	}
+)
+
+// algorithmConfig returns the key exchange, cipher, and MAC algorithms
+// configured in the settings. Empty lists use the library's defaults.
+func algorithmConfig(settings *config.Settings) (gossh.Config, error) {
+	if err := checkAlgorithms("key exchange", settings.KexAlgorithms, supportedKexAlgos); err != nil {
+		return gossh.Config{}, err
+	}
+	if err := checkAlgorithms("cipher", settings.Ciphers, supportedCiphers); err != nil {
+		return gossh.Config{}, err
+	}
+	if err := checkAlgorithms("MAC", settings.MACs, supportedMACs); err != nil {
+		return gossh.Config{}, err
+	}
+
+	return gossh.Config{
+		KeyExchanges: settings.KexAlgorithms,
+		Ciphers:      settings.Ciphers,
+		MACs:         settings.MACs,
+	}, nil
+}
+
+// checkAlgorithms returns an error if any of the algorithms aren't supported.
+func checkAlgorithms(kind string, algos, supported []string) error {
+	for _, algo := range algos {
+		if !slices.Contains(supported, algo) {
+			return fmt.Errorf("unsupported %s algorithm: %q", kind, algo)
+		}
+	}
+	return nil
+}
+
+// restrictHostKeyAlgorithms limits the server's host keys to the given signature
+// algorithms. Host keys that can't be used with any of them are removed. If algos
+// is empty, the host keys are left unchanged.
+func restrictHostKeyAlgorithms(srv *ssh.Server, algos []string) error {
+	if len(algos) == 0 {
+		return nil
+	}
+
+	var signers []ssh.Signer
+	for _, signer := range srv.HostSigners {
+		algoSigner, ok := signer.(gossh.AlgorithmSigner)
+		if !ok {
+			continue
+		}
+
+		var allowed []string
+		for _, algo := range keyAlgorithms(signer.PublicKey().Type()) {
+			if slices.Contains(algos, algo) {
+				allowed = append(allowed, algo)
+			}
+		}
+		if len(allowed) == 0 {
+			continue
+		}
+
+		restricted, err := gossh.NewSignerWithAlgorithms(algoSigner, allowed)
+		if err != nil {
+			return err
+		}
+		signers = append(signers, restricted)
+	}
+
+	if len(signers) == 0 {
+		return errors.New("none of the host keys can be used with the configured host key algorithms")
+	}
+	srv.HostSigners = signers
+	return nil
+}
+
+// keyAlgorithms returns the signature algorithms
+// that can be used with a key of the given type.
+func keyAlgorithms(keyType string) []string {
+	switch keyType {
+	case gossh.KeyAlgoRSA:
+		return []string{gossh.KeyAlgoRSASHA256, gossh.KeyAlgoRSASHA512, gossh.KeyAlgoRSA}
+	case gossh.CertAlgoRSAv01:
+		return []string{gossh.CertAlgoRSASHA256v01, gossh.CertAlgoRSASHA512v01, gossh.CertAlgoRSAv01}
+	default:
+		return []string{keyType}
+	}
+}
@@ -0,0 +1,132 @@
+/*
+ * Seashell - SSH server with virtual hosts and username-based routing
+ *
+ * Copyright (C) 2024 Elara6331 <elara@elara.ws>
+ *
+ * This file is part of Seashell.
+ *
+ * Seashell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * Seashell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with Seashell.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	"go.elara.ws/seashell/internal/approval"
+	"go.elara.ws/seashell/internal/config"
+	"go.elara.ws/seashell/internal/router"
+	"go.elara.ws/seashell/internal/sshctx"
+)
+
+// defaultApprovalTimeout is how long sessions wait for approval by default.
+const defaultApprovalTimeout = 5 * time.Minute
+
+// approvalMiddleware returns a middleware that makes sessions wait until a
+// second user approves them using the admin route. Sessions that are denied,
+// or that aren't approved before the timeout, are rejected. If settings is
+// nil, sessions aren't changed.
+func approvalMiddleware(route string, settings *config.Approval, q *approval.Queue) (router.Middleware, error) {
+	if settings == nil {
+		return func(next router.Handler) router.Handler { return next }, nil
+	} else if q == nil {
+		return nil, errors.New("approval requires the admin route to be enabled")
+	}
+
+	timeout := defaultApprovalTimeout
+	if settings.Timeout != "" {
+		var err error
+		timeout, err = time.ParseDuration(settings.Timeout)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return func(next router.Handler) router.Handler {
+		return func(sess ssh.Session, arg string) error {
+			user, _ := sshctx.GetUser(sess.Context())
+			req, err := q.Submit(approval.Request{
+				User:  user.Name,
+				Route: route,
+				Arg:   arg,
+				Addr:  sess.RemoteAddr().String(),
+			}, *settings)
+			if err != nil {
+				return err
+			}
+
+			log.Info(
+				"Session waiting for approval",
+				slog.String("id", req.ID),
+				slog.String("user", user.Name),
+				slog.String("route", route),
+			)
+			fmt.Fprintf(sess.Stderr(), "[seashell] This route requires approval. Waiting for approval of request %s...\r\n", req.ID)
+
+			ctx, cancel := context.WithTimeout(sess.Context(), timeout)
+			defer cancel()
+
+			decision := q.Wait(ctx, req)
+			if !decision.Approved {
+				if decision.By != "" {
+					return fmt.Errorf("your session was denied by %s", decision.By)
+				}
+				return errors.New("your session wasn't approved in time")
+			}
+
+			fmt.Fprintf(sess.Stderr(), "[seashell] Approved by %s\r\n", decision.By)
+			return next(sess, arg)
+		}
+	}, nil
+}
+
+// listApprovals writes the sessions waiting for approval to the session.
+func listApprovals(sess ssh.Session, q *approval.Queue) error {
+	tw := tabwriter.NewWriter(sess, 0, 0, 2, ' ', 0)
+	fmt.Fprint(tw, "ID\tUSER\tROUTE\tARG\tADDR\tWAITING\r\n")
+	for _, req := range q.Pending() {
+		waiting := time.Since(req.Created).Round(time.Second)
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\r\n", req.ID, req.User, req.Route, req.Arg, req.Addr, waiting)
+	}
+	return tw.Flush()
+}
+
+// decideApproval approves or denies a session waiting for approval.
+func decideApproval(sess ssh.Session, q *approval.Queue, admin config.User, id string, approved bool) error {
+	req, err := q.Decide(id, admin, approved)
+	if err != nil {
+		return err
+	}
+
+	log.Info(
+		"Session approval decided",
+		slog.String("id", req.ID),
+		slog.String("user", req.User),
+		slog.String("route", req.Route),
+		slog.Bool("approved", approved),
+		slog.String("by", admin.Name),
+	)
+	if approved {
+		fmt.Fprintf(sess, "Approved %s's session on %s\r\n", req.User, req.Route)
+	} else {
+		fmt.Fprintf(sess, "Denied %s's session on %s\r\n", req.User, req.Route)
+	}
+	return nil
+}
@@ -22,55 +22,257 @@
 package main
 
 import (
+	"errors"
 	"log/slog"
 	"net"
+	"slices"
 	"strings"
+	"time"
 
-	"github.com/alexedwards/argon2id"
 	"github.com/gliderlabs/ssh"
+	"go.elara.ws/seashell/internal/authhook"
 	"go.elara.ws/seashell/internal/config"
 	"go.elara.ws/seashell/internal/fail2ban"
+	"go.elara.ws/seashell/internal/krbauth"
+	"go.elara.ws/seashell/internal/ldapauth"
 	"go.elara.ws/seashell/internal/sshctx"
+	"go.elara.ws/seashell/internal/userstore"
+	gossh "golang.org/x/crypto/ssh"
 )
 
+// authProviders contains the external sources that can be used to authenticate
+// users. Any of them may be nil if they aren't configured.
+type authProviders struct {
+	store      userstore.Store
+	ldap       *ldapauth.Client
+	webhook    *authhook.Client
+	kerberos   *krbauth.Acceptor
+	vaultCreds *vaultCredCache
+	// keyFiles and passwordFiles contain the credentials
+	// users from the config have changed themselves.
+	keyFiles      *keyFiles
+	passwordFiles *passwordFiles
+}
+
 // passwordHandler returns a handler that checks password authentication attempts against
-// fail2ban and the configured argon2id password hash.
-func passwordHandler(f2b *fail2ban.Fail2Ban, cfg config.Config) ssh.PasswordHandler {
+// fail2ban and the configured password hash. If the user isn't configured, the credentials
+// are checked against the LDAP directory and then the webhook, if they're configured.
+func passwordHandler(f2b *fail2ban.Fail2Ban, cfg config.Config, ap authProviders) ssh.PasswordHandler {
 	return func(ctx ssh.Context, password string) (ok bool) {
-		if !f2b.LoginAllowed(ctx.RemoteAddr()) {
-			log.Warn(
-				"Login attempt blocked by fail2ban policy",
-				slog.String("username", ctx.User()),
-				slog.String("addr", ctx.RemoteAddr().String()),
-			)
+		if !loginAllowed(ctx, f2b) {
+			return false
+		}
+
+		defer func() {
+			if !ok {
+				username, _, _ := parseUsername(ctx.User())
+				addFailedUserLogin(f2b, ctx.RemoteAddr(), username)
+			}
+		}()
+
+		user, ok := getUser(ctx, cfg, ap)
+		if !passwordAuthAllowed(cfg.Auth, user) {
+			log.Debug("Password authentication disabled for user", slog.String("username", ctx.User()))
 			return false
 		}
 
-		user, ok := getUser(ctx, cfg)
 		if !ok {
+			if ap.ldap != nil && ldapLogin(ctx, ap.ldap, password) {
+				return true
+			}
+			if ap.webhook != nil {
+				return webhookLogin(ctx, ap.webhook, authhook.Request{
+					Type:     authhook.TypePassword,
+					Password: password,
+				})
+			}
 			return false
 		}
 
-		ok, err := argon2id.ComparePasswordAndHash(password, user.Password)
+		ok, err := checkPassword(password, user.Password)
+		if err != nil {
+			log.Warn("Error checking password", slog.String("user", user.Name), slog.Any("error", err))
+		}
 		return err == nil && ok
 	}
 }
 
+// guestHandler returns a handler that lets guest users log in without any
+// credentials. Other users are rejected, so they have to use another method.
+func guestHandler(f2b *fail2ban.Fail2Ban, cfg config.Config, ap authProviders) func(ssh.Context, gossh.ConnMetadata) bool {
+	return func(ctx ssh.Context, _ gossh.ConnMetadata) bool {
+		if !loginAllowed(ctx, f2b) {
+			return false
+		}
+		user, ok := getUser(ctx, cfg, ap)
+		return ok && user.Guest
+	}
+}
+
+// authHandlers contains the handlers for each authentication method.
+type authHandlers struct {
+	guest    func(ssh.Context, gossh.ConnMetadata) bool
+	pubkey   ssh.PublicKeyHandler
+	password ssh.PasswordHandler
+	// gssapi checks whether a verified Kerberos principal
+	// can log in. It's nil if GSSAPI isn't configured.
+	gssapi func(ssh.Context, string) bool
+}
+
+// serverConfig returns a callback that configures the given algorithms, along
+// with the authentication methods the server's handlers can't provide: "none"
+// authentication for guest users, GSSAPI, and the authentication chain, if
+// there is one. The server's own password and public key handlers can't report
+// partial success, so they must be left unset when a chain is used. GSSAPI
+// isn't offered with a chain, since it would bypass it.
+func serverConfig(f2b *fail2ban.Fail2Ban, cfg config.Config, ap authProviders, algos gossh.Config, h authHandlers) ssh.ServerConfigCallback {
+	return func(ctx ssh.Context) *gossh.ServerConfig {
+		conf := &gossh.ServerConfig{
+			Config:       algos,
+			NoClientAuth: true,
+			NoClientAuthCallback: func(conn gossh.ConnMetadata) (*gossh.Permissions, error) {
+				setConnMetadata(ctx, conn)
+				if !h.guest(ctx, conn) {
+					return nil, errPermissionDenied
+				}
+				return ctx.Permissions().Permissions, nil
+			},
+		}
+
+		if len(cfg.Auth.Chain) > 0 {
+			callbacks := chainStep(ctx, cfg.Auth.Chain, 0, f2b, cfg, ap, h.pubkey, h.password)
+			conf.PasswordCallback = callbacks.PasswordCallback
+			conf.PublicKeyCallback = callbacks.PublicKeyCallback
+			conf.KeyboardInteractiveCallback = callbacks.KeyboardInteractiveCallback
+		} else if ap.kerberos != nil && h.gssapi != nil {
+			conf.GSSAPIWithMICConfig = &gossh.GSSAPIWithMICConfig{
+				Server: ap.kerberos.NewContext(func() net.Addr {
+					addr, _ := ctx.Value(ssh.ContextKeyRemoteAddr).(net.Addr)
+					return addr
+				}),
+				AllowLogin: func(conn gossh.ConnMetadata, principal string) (*gossh.Permissions, error) {
+					setConnMetadata(ctx, conn)
+					if !h.gssapi(ctx, principal) {
+						return nil, errPermissionDenied
+					}
+					return ctx.Permissions().Permissions, nil
+				},
+			}
+		}
+
+		return conf
+	}
+}
+
+// gssapiHandler returns a handler that checks whether a Kerberos principal,
+// which has already been verified, can log in. The principal must map to
+// the user the client is logging in as.
+func gssapiHandler(f2b *fail2ban.Fail2Ban, cfg config.Config, ap authProviders) func(ssh.Context, string) bool {
+	return func(ctx ssh.Context, principal string) bool {
+		if !loginAllowed(ctx, f2b) {
+			return false
+		}
+
+		mapped, ok := ap.kerberos.MapPrincipal(principal)
+		username, _, ok2 := parseUsername(ctx.User())
+		if !ok || !ok2 || mapped != username {
+			log.Warn(
+				"Kerberos principal can't log in as user",
+				slog.String("principal", principal),
+				slog.String("username", username),
+			)
+			return false
+		}
+
+		_, ok = getUser(ctx, cfg, ap)
+		return ok
+	}
+}
+
+// passwordAuthAllowed checks whether the user can log in using a password.
+// The user's own setting takes priority over the global default.
+func passwordAuthAllowed(auth config.Auth, user config.User) bool {
+	if user.PasswordAuth != nil {
+		return *user.PasswordAuth
+	}
+	return auth.PasswordAuth == nil || *auth.PasswordAuth
+}
+
+// ldapLogin checks the user's credentials against the LDAP directory,
+// and sets the seashell user in the context if they're valid.
+func ldapLogin(ctx ssh.Context, lc *ldapauth.Client, password string) bool {
+	username, _, ok := parseUsername(ctx.User())
+	if !ok {
+		return false
+	}
+
+	user, err := lc.Authenticate(username, password)
+	if errors.Is(err, ldapauth.ErrInvalidCredentials) {
+		return false
+	} else if err != nil {
+		log.Warn("Error authenticating with LDAP", slog.String("username", username), slog.Any("error", err))
+		return false
+	}
+
+	sshctx.SetUser(ctx, user)
+	return true
+}
+
+// webhookLogin sends the login attempt to the authentication webhook, and sets
+// the seashell user in the context if it's allowed. The username and address
+// in req are filled in from the context.
+func webhookLogin(ctx ssh.Context, hook *authhook.Client, req authhook.Request) bool {
+	username, _, ok := parseUsername(ctx.User())
+	if !ok {
+		return false
+	}
+	req.Username = username
+	req.Addr = ctx.RemoteAddr().String()
+
+	user, ok, err := hook.Check(ctx, req)
+	if err != nil {
+		log.Warn("Error calling authentication webhook", slog.String("username", username), slog.Any("error", err))
+		return false
+	} else if !ok {
+		return false
+	}
+
+	sshctx.SetUser(ctx, user)
+	return true
+}
+
 // pubkeyHandler returns a handler that checks public key authentication attempts against
-// fail2ban and the configures authorized public keys.
-func pubkeyHandler(f2b *fail2ban.Fail2Ban, cfg config.Config) ssh.PublicKeyHandler {
+// fail2ban, the revoked keys, and the configures authorized public keys. If the user isn't
+// configured, the webhook is asked instead, if there is one.
+func pubkeyHandler(f2b *fail2ban.Fail2Ban, cfg config.Config, ap authProviders, revoked *revocationList) ssh.PublicKeyHandler {
 	return func(ctx ssh.Context, key ssh.PublicKey) (ok bool) {
-		if !f2b.LoginAllowed(ctx.RemoteAddr()) {
+		if !loginAllowed(ctx, f2b) {
+			return false
+		}
+
+		if revoked.isRevoked(key) {
 			log.Warn(
-				"Login attempt blocked by fail2ban policy",
+				"Login attempt with revoked key",
 				slog.String("username", ctx.User()),
 				slog.String("addr", ctx.RemoteAddr().String()),
+				slog.String("fingerprint", gossh.FingerprintSHA256(key)),
 			)
 			return false
 		}
 
-		user, ok := getUser(ctx, cfg)
+		if _, _, ok := parseUsername(ctx.User()); !ok && cfg.Auth.PubkeyLookup {
+			return pubkeyLookup(ctx, cfg, ap, key)
+		}
+
+		user, ok := getUser(ctx, cfg, ap)
 		if !ok {
+			if ap.webhook != nil {
+				return webhookLogin(ctx, ap.webhook, authhook.Request{
+					Type:        authhook.TypePublicKey,
+					Pubkey:      strings.TrimSpace(string(gossh.MarshalAuthorizedKey(key))),
+					Fingerprint: gossh.FingerprintSHA256(key),
+				})
+			}
 			return false
 		}
 
@@ -81,7 +283,7 @@ func pubkeyHandler(f2b *fail2ban.Fail2Ban, cfg config.Config) ssh.PublicKeyHandl
 				continue
 			}
 
-			if ssh.KeysEqual(key, pubkey) {
+			if pubkeyMatches(key, pubkey) {
 				return true
 			}
 		}
@@ -90,35 +292,201 @@ func pubkeyHandler(f2b *fail2ban.Fail2Ban, cfg config.Config) ssh.PublicKeyHandl
 	}
 }
 
+// pubkeyLookup finds the user that the presented public key belongs to, so the
+// whole SSH username can be used as the routing argument. Users from the config,
+// including the keys they've added themselves, and users from the user database
+// are searched. If the key belongs to more than one user, it's rejected, since
+// the user would be ambiguous.
+func pubkeyLookup(ctx ssh.Context, cfg config.Config, ap authProviders, key ssh.PublicKey) bool {
+	var found *config.User
+	// check records the user if they have the key, and returns
+	// false if another user has already been found with it.
+	check := func(user config.User) bool {
+		if !slices.ContainsFunc(user.Pubkeys, func(pubkeyStr string) bool {
+			pubkey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(pubkeyStr))
+			return err == nil && pubkeyMatches(key, pubkey)
+		}) {
+			return true
+		}
+
+		if found != nil && found.Name != user.Name {
+			log.Warn(
+				"Public key belongs to more than one user",
+				slog.String("fingerprint", gossh.FingerprintSHA256(key)),
+				slog.String("users", found.Name+", "+user.Name),
+			)
+			return false
+		}
+		found = &user
+		return true
+	}
+
+	for _, user := range cfg.Auth.Users {
+		user = resolveVaultCreds(ctx, ap.vaultCreds, user)
+		user = addSavedCreds(ap, user)
+		if !check(user) {
+			return false
+		}
+	}
+
+	if pl, ok := ap.store.(userstore.PubkeyLookup); ok {
+		names, err := pl.UsersWithPubkey(ctx, authorizedKey(key))
+		if err != nil {
+			log.Warn("Error looking up public key in the user store", slog.Any("error", err))
+			return false
+		}
+
+		for _, name := range names {
+			// Users from the config take priority, like when logging in
+			if slices.ContainsFunc(cfg.Auth.Users, func(u config.User) bool { return u.Name == name }) {
+				continue
+			}
+
+			user, ok, err := ap.store.GetUser(ctx, name)
+			if err != nil {
+				log.Warn("Error getting user from the user store", slog.String("username", name), slog.Any("error", err))
+				return false
+			} else if !ok {
+				continue
+			}
+
+			user = resolveVaultCreds(ctx, ap.vaultCreds, user)
+			if !check(user) {
+				return false
+			}
+		}
+	}
+
+	if found == nil {
+		return false
+	}
+
+	sshctx.SetArg(ctx, ctx.User())
+	sshctx.SetUser(ctx, *found)
+	return true
+}
+
+// authorizedKey returns a public key in the authorized_keys format, without
+// a comment. Certificates are converted to the key they certify.
+func authorizedKey(key ssh.PublicKey) string {
+	if cert, ok := key.(*gossh.Certificate); ok {
+		key = cert.Key
+	}
+	return strings.TrimSpace(string(gossh.MarshalAuthorizedKey(key)))
+}
+
+// pubkeyMatches checks whether the key presented by a client matches a
+// configured key. Certificates on either side are compared using the key they
+// certify, so users can log in using a certificate for one of their keys, like
+// the ones often issued for FIDO2 security keys. Client certificates must be
+// user certificates and must be within their validity period.
+func pubkeyMatches(key, configured ssh.PublicKey) bool {
+	if cert, ok := key.(*gossh.Certificate); ok {
+		now := uint64(time.Now().Unix())
+		if cert.CertType != gossh.UserCert || now < cert.ValidAfter {
+			return false
+		}
+		if cert.ValidBefore != gossh.CertTimeInfinity && now >= cert.ValidBefore {
+			return false
+		}
+		key = cert.Key
+	}
+
+	if cert, ok := configured.(*gossh.Certificate); ok {
+		configured = cert.Key
+	}
+
+	return ssh.KeysEqual(key, configured)
+}
+
 // failedConnHandler returns a handler that reports failed login attempts
 // to the rate limiter.
 func failedConnHandler(f2b *fail2ban.Fail2Ban) ssh.ConnectionFailedCallback {
 	return func(conn net.Conn, err error) {
 		if strings.Contains(err.Error(), "permission denied") {
 			log.Warn("Failed login attempt", slog.Any("addr", conn.RemoteAddr()))
-			f2b.AddFailedLogin(conn.RemoteAddr())
+			addFailedLogin(f2b, conn.RemoteAddr())
 		}
 	}
 }
 
+// addFailedLogin reports a failed login attempt to the rate limiter,
+// logging any errors that occur while saving its state. Attempts from
+// ignored addresses are only logged.
+func addFailedLogin(f2b *fail2ban.Fail2Ban, addr net.Addr) {
+	if f2b.Ignored(addr) {
+		log.Debug("Failed login from address ignored by fail2ban", slog.Any("addr", addr))
+		return
+	}
+
+	if err := f2b.AddFailedLogin(addr); err != nil {
+		log.Warn("Error saving fail2ban state", slog.Any("error", err))
+	}
+}
+
+// addFailedUserLogin reports a failed password or TOTP login for a user to
+// the rate limiter, logging any errors that occur while saving its state.
+func addFailedUserLogin(f2b *fail2ban.Fail2Ban, addr net.Addr, username string) {
+	if err := f2b.AddFailedUserLogin(addr, username); err != nil {
+		log.Warn("Error saving fail2ban state", slog.Any("error", err))
+	}
+}
+
+// loginAllowed checks whether the rate limiter allows the client to log in,
+// which requires that neither its address nor the user is banned. Blocked
+// attempts are logged along with the reason they were blocked.
+func loginAllowed(ctx ssh.Context, f2b *fail2ban.Fail2Ban) bool {
+	username, _, _ := parseUsername(ctx.User())
+
+	reason := ""
+	if !f2b.LoginAllowed(ctx.RemoteAddr()) {
+		reason = "address banned"
+	} else if !f2b.UserAllowed(username) {
+		reason = "user locked out"
+	} else {
+		return true
+	}
+
+	log.Warn(
+		"Login attempt blocked by fail2ban policy",
+		slog.String("username", ctx.User()),
+		slog.String("addr", ctx.RemoteAddr().String()),
+		slog.String("reason", reason),
+	)
+	return false
+}
+
 // getUser uses information from the request to retrieve the seashell user
-// that is attempting to authenticate.
-func getUser(ctx ssh.Context, cfg config.Config) (config.User, bool) {
+// that is attempting to authenticate. Users in the config take priority
+// over users in the user store, if there is one. Any credentials the user
+// has in Vault are added to it.
+func getUser(ctx ssh.Context, cfg config.Config, ap authProviders) (config.User, bool) {
 	user, ok := sshctx.GetUser(ctx)
 	if ok {
 		return user, true
 	} else {
-		username, arg, ok := strings.Cut(ctx.User(), ":")
+		username, arg, ok := parseUsername(ctx.User())
 		if !ok {
-			username, arg, ok = strings.Cut(ctx.User(), "~")
-			if !ok {
-				return config.User{}, false
-			}
+			return config.User{}, false
 		}
 		sshctx.SetArg(ctx, arg)
 
 		for _, user := range cfg.Auth.Users {
 			if user.Name == username {
+				user = resolveVaultCreds(ctx, ap.vaultCreds, user)
+				user = addSavedCreds(ap, user)
+				sshctx.SetUser(ctx, user)
+				return user, true
+			}
+		}
+
+		if ap.store != nil {
+			user, ok, err := ap.store.GetUser(ctx, username)
+			if err != nil {
+				log.Warn("Error getting user from the user store", slog.String("username", username), slog.Any("error", err))
+				return config.User{}, false
+			} else if ok {
+				user = resolveVaultCreds(ctx, ap.vaultCreds, user)
 				sshctx.SetUser(ctx, user)
 				return user, true
 			}
@@ -126,3 +494,49 @@ func getUser(ctx ssh.Context, cfg config.Config) (config.User, bool) {
 	}
 	return config.User{}, false
 }
+
+// resolveVaultCreds adds the user's credentials from Vault to it. If they
+// can't be read, the error is logged and only the user's other credentials
+// can be used to log in.
+func resolveVaultCreds(ctx ssh.Context, vc *vaultCredCache, user config.User) config.User {
+	if vc == nil || (user.VaultPassword == "" && user.VaultPubkeys == "") {
+		return user
+	}
+
+	resolved, err := vc.resolve(ctx, user)
+	if err != nil {
+		log.Warn("Error reading user credentials from Vault", slog.String("user", user.Name), slog.Any("error", err))
+	}
+	return resolved
+}
+
+// addSavedCreds adds the public keys the user has added themselves to it,
+// and replaces its password hash if they've changed their password. If they
+// can't be read, the error is logged and only the credentials from the config
+// can be used to log in.
+func addSavedCreds(ap authProviders, user config.User) config.User {
+	keys, err := ap.keyFiles.read(user.Name)
+	if err != nil {
+		log.Warn("Error reading saved public keys", slog.String("user", user.Name), slog.Any("error", err))
+	}
+	user.Pubkeys = append(slices.Clip(user.Pubkeys), keys...)
+
+	hash, err := ap.passwordFiles.read(user.Name)
+	if err != nil {
+		log.Warn("Error reading saved password", slog.String("user", user.Name), slog.Any("error", err))
+	} else if hash != "" {
+		user.Password = hash
+	}
+
+	return user
+}
+
+// parseUsername splits an SSH username into the seashell username
+// and the routing argument, which are separated by ":" or "~".
+func parseUsername(sshUser string) (username, arg string, ok bool) {
+	username, arg, ok = strings.Cut(sshUser, ":")
+	if !ok {
+		username, arg, ok = strings.Cut(sshUser, "~")
+	}
+	return username, arg, ok
+}
@@ -0,0 +1,164 @@
+/*
+ * Seashell - SSH server with virtual hosts and username-based routing
+ *
+ * Copyright (C) 2024 Elara6331 <elara@elara.ws>
+ *
+ * This file is part of Seashell.
+ *
+ * Seashell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * Seashell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with Seashell.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os/exec"
+	"strings"
+	"text/template"
+	"time"
+
+	"go.elara.ws/seashell/internal/config"
+	"go.elara.ws/seashell/internal/fail2ban"
+)
+
+// banHookTimeout is how long ban and unban commands may run for.
+const banHookTimeout = 30 * time.Second
+
+// banHookData is the data available to the ban and unban command templates.
+type banHookData struct {
+	// Addr is the banned IP address, or CIDR range for subnets
+	// (empty for lock commands)
+	Addr string
+	// User is the name of the locked out user (only for lock commands)
+	User string
+	// Duration is how long the address is banned for, e.x. 10m0s
+	// (empty for unban commands)
+	Duration string
+	// Seconds is the ban duration in seconds
+	Seconds int
+}
+
+// banHooks returns fail2ban hooks that run the configured ban, unban, and
+// lock commands, add banned addresses to the configured nftables set, and
+// log any errors that occur while reading the fail2ban state.
+func banHooks(cfg config.Fail2Ban) (fail2ban.Hooks, error) {
+	banCmd, err := parseCommand("ban_command", cfg.BanCommand)
+	if err != nil {
+		return fail2ban.Hooks{}, err
+	}
+
+	unbanCmd, err := parseCommand("unban_command", cfg.UnbanCommand)
+	if err != nil {
+		return fail2ban.Hooks{}, err
+	}
+
+	lockCmd, err := parseCommand("lock_command", cfg.LockCommand)
+	if err != nil {
+		return fail2ban.Hooks{}, err
+	}
+
+	var set []string
+	if cfg.NFTablesSet != "" {
+		set = strings.Fields(cfg.NFTablesSet)
+		if len(set) != 3 {
+			return fail2ban.Hooks{}, errors.New("nftables_set must be in the form \"family table set\"")
+		}
+	}
+
+	return fail2ban.Hooks{
+		Ban: func(addr string, duration time.Duration) {
+			log.Warn(
+				"Address banned by fail2ban",
+				slog.String("addr", addr),
+				slog.Bool("subnet", strings.Contains(addr, "/")),
+				slog.Duration("duration", duration),
+			)
+			data := banHookData{Addr: addr, Duration: duration.String(), Seconds: int(duration.Seconds())}
+			if set != nil {
+				runBanHook("nft", append([]string{"add", "element"}, append(set, "{", addr, "}")...))
+			}
+			if banCmd != nil {
+				runCommandTemplate(banCmd, data)
+			}
+		},
+		Lock: func(user string, duration time.Duration) {
+			log.Warn("User locked out by fail2ban", slog.String("user", user), slog.Duration("duration", duration))
+			if lockCmd != nil {
+				runCommandTemplate(lockCmd, banHookData{User: user, Duration: duration.String(), Seconds: int(duration.Seconds())})
+			}
+		},
+		Error: func(err error) {
+			log.Warn("Error reading fail2ban state", slog.Any("error", err))
+		},
+		Unban: func(addr string) {
+			log.Info("Address unbanned by fail2ban", slog.String("addr", addr))
+			if set != nil {
+				runBanHook("nft", append([]string{"delete", "element"}, append(set, "{", addr, "}")...))
+			}
+			if unbanCmd != nil {
+				runCommandTemplate(unbanCmd, banHookData{Addr: addr})
+			}
+		},
+	}, nil
+}
+
+// parseCommand parses each argument of a command as a template.
+// It returns nil if the command is empty.
+func parseCommand(name string, args []string) ([]*template.Template, error) {
+	if len(args) == 0 {
+		return nil, nil
+	}
+
+	out := make([]*template.Template, len(args))
+	for i, arg := range args {
+		tmpl, err := template.New(name).Option("missingkey=error").Parse(arg)
+		if err != nil {
+			return nil, err
+		}
+		out[i] = tmpl
+	}
+	return out, nil
+}
+
+// runCommandTemplate expands the command's arguments using data and runs it.
+func runCommandTemplate(cmd []*template.Template, data banHookData) {
+	args := make([]string, len(cmd))
+	for i, tmpl := range cmd {
+		sb := &strings.Builder{}
+		if err := tmpl.Execute(sb, data); err != nil {
+			log.Warn("Error expanding fail2ban hook command", slog.Any("error", err))
+			return
+		}
+		args[i] = sb.String()
+	}
+	runBanHook(args[0], args[1:])
+}
+
+// runBanHook runs a ban or unban command, logging any errors.
+func runBanHook(name string, args []string) {
+	ctx, cancel := context.WithTimeout(context.Background(), banHookTimeout)
+	defer cancel()
+
+	out, err := exec.CommandContext(ctx, name, args...).CombinedOutput()
+	if err != nil {
+		log.Warn(
+			"Error running fail2ban hook",
+			slog.String("command", name),
+			slog.String("output", strings.TrimSpace(string(out))),
+			slog.Any("error", err),
+		)
+	}
+}
@@ -0,0 +1,112 @@
+/*
+ * Seashell - SSH server with virtual hosts and username-based routing
+ *
+ * Copyright (C) 2024 Elara6331 <elara@elara.ws>
+ *
+ * This file is part of Seashell.
+ *
+ * Seashell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * Seashell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with Seashell.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"log/slog"
+	"net"
+	"net/netip"
+
+	"github.com/gliderlabs/ssh"
+)
+
+// cidrFilter decides which clients may connect based on their IP address.
+type cidrFilter struct {
+	allow []netip.Prefix
+	deny  []netip.Prefix
+}
+
+// newCIDRFilter parses the allowed and denied CIDR ranges. It returns nil
+// if both lists are empty.
+func newCIDRFilter(allow, deny []string) (*cidrFilter, error) {
+	if len(allow) == 0 && len(deny) == 0 {
+		return nil, nil
+	}
+
+	var cf cidrFilter
+	var err error
+	cf.allow, err = parsePrefixes(allow)
+	if err != nil {
+		return nil, err
+	}
+	cf.deny, err = parsePrefixes(deny)
+	if err != nil {
+		return nil, err
+	}
+	return &cf, nil
+}
+
+// parsePrefixes parses a list of CIDR ranges.
+func parsePrefixes(cidrs []string) ([]netip.Prefix, error) {
+	out := make([]netip.Prefix, len(cidrs))
+	for i, cidr := range cidrs {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, err
+		}
+		out[i] = prefix.Masked()
+	}
+	return out, nil
+}
+
+// allowed checks whether a client with the given address may connect.
+// Denied ranges take priority, and if there are any allowed ranges,
+// the address must be in one of them.
+func (cf *cidrFilter) allowed(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return len(cf.allow) == 0
+	}
+
+	ip, ok := netip.AddrFromSlice(tcpAddr.IP)
+	if !ok {
+		return false
+	}
+	ip = ip.Unmap()
+
+	if prefixesContain(cf.deny, ip) {
+		return false
+	}
+	return len(cf.allow) == 0 || prefixesContain(cf.allow, ip)
+}
+
+// prefixesContain checks whether any of the prefixes contains ip.
+func prefixesContain(prefixes []netip.Prefix, ip netip.Addr) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// connFilter returns a callback that closes connections from clients that
+// the filter doesn't allow, before they get a chance to authenticate.
+func connFilter(cf *cidrFilter) ssh.ConnCallback {
+	return func(ctx ssh.Context, conn net.Conn) net.Conn {
+		if cf != nil && !cf.allowed(conn.RemoteAddr()) {
+			log.Warn("Connection blocked by CIDR filter", slog.String("addr", conn.RemoteAddr().String()))
+			return nil
+		}
+		return conn
+	}
+}
@@ -0,0 +1,167 @@
+/*
+ * Seashell - SSH server with virtual hosts and username-based routing
+ *
+ * Copyright (C) 2024 Elara6331 <elara@elara.ws>
+ *
+ * This file is part of Seashell.
+ *
+ * Seashell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * Seashell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with Seashell.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package approval
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"go.elara.ws/seashell/internal/config"
+)
+
+var (
+	// ErrNotFound is returned when there's no pending request with the given ID.
+	ErrNotFound = errors.New("no pending approval request with that id")
+	// ErrSelfApproval is returned when a user tries to approve their own session.
+	ErrSelfApproval = errors.New("users can't approve their own sessions")
+	// ErrNotApprover is returned when a user isn't allowed to approve a request.
+	ErrNotApprover = errors.New("you aren't allowed to approve sessions for this route")
+)
+
+// Request is a session waiting for approval.
+type Request struct {
+	ID      string
+	User    string
+	Route   string
+	Arg     string
+	Addr    string
+	Created time.Time
+
+	approval config.Approval
+	decided  chan Decision
+}
+
+// Decision is the result of an approval request.
+type Decision struct {
+	Approved bool
+	// By is the user that made the decision
+	By string
+}
+
+// CanApprove checks whether the user can make a decision on the request.
+// If the route doesn't list any approvers, anyone that can use the admin
+// route can approve it, except for the user that made the request.
+func (r *Request) CanApprove(user config.User) error {
+	if user.Name == r.User {
+		return ErrSelfApproval
+	}
+
+	if len(r.approval.Users) == 0 && len(r.approval.Groups) == 0 {
+		return nil
+	} else if slices.Contains(r.approval.Users, user.Name) {
+		return nil
+	}
+	for _, group := range user.Groups {
+		if slices.Contains(r.approval.Groups, group) {
+			return nil
+		}
+	}
+	return ErrNotApprover
+}
+
+// Queue contains the sessions waiting for approval.
+type Queue struct {
+	mu      sync.Mutex
+	pending map[string]*Request
+}
+
+// NewQueue creates a new, empty queue.
+func NewQueue() *Queue {
+	return &Queue{pending: map[string]*Request{}}
+}
+
+// Submit adds a new request to the queue. The caller should call Wait
+// to get the decision.
+func (q *Queue) Submit(req Request, approval config.Approval) (*Request, error) {
+	id := make([]byte, 4)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+
+	r := &req
+	r.ID = hex.EncodeToString(id)
+	r.Created = time.Now()
+	r.approval = approval
+	r.decided = make(chan Decision, 1)
+
+	q.mu.Lock()
+	q.pending[r.ID] = r
+	q.mu.Unlock()
+	return r, nil
+}
+
+// Wait waits until a decision has been made on the request, or until ctx is
+// canceled, and removes the request from the queue. If ctx is canceled, the
+// request is denied.
+func (q *Queue) Wait(ctx context.Context, r *Request) Decision {
+	defer func() {
+		q.mu.Lock()
+		delete(q.pending, r.ID)
+		q.mu.Unlock()
+	}()
+
+	select {
+	case d := <-r.decided:
+		return d
+	case <-ctx.Done():
+		return Decision{}
+	}
+}
+
+// Decide approves or denies the pending request with the given ID
+// on behalf of the given user.
+func (q *Queue) Decide(id string, user config.User, approved bool) (*Request, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	r, ok := q.pending[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	if err := r.CanApprove(user); err != nil {
+		return nil, err
+	}
+
+	delete(q.pending, id)
+	r.decided <- Decision{Approved: approved, By: user.Name}
+	return r, nil
+}
+
+// Pending returns the requests that are waiting for
+// a decision, with the oldest ones first.
+func (q *Queue) Pending() []*Request {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	out := make([]*Request, 0, len(q.pending))
+	for _, r := range q.pending {
+		out = append(out, r)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Created.Before(out[j].Created) })
+	return out
+}
@@ -0,0 +1,123 @@
+/*
+ * Seashell - SSH server with virtual hosts and username-based routing
+ *
+ * Copyright (C) 2024 Elara6331 <elara@elara.ws>
+ *
+ * This file is part of Seashell.
+ *
+ * Seashell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * Seashell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with Seashell.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package authhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"go.elara.ws/seashell/internal/config"
+)
+
+// Credential types sent to the webhook
+const (
+	TypePassword  = "password"
+	TypePublicKey = "publickey"
+)
+
+// Request represents the data sent to the webhook for each login attempt.
+type Request struct {
+	Username    string `json:"username"`
+	Addr        string `json:"addr"`
+	Type        string `json:"type"`
+	Password    string `json:"password,omitempty"`
+	Pubkey      string `json:"pubkey,omitempty"`
+	Fingerprint string `json:"fingerprint,omitempty"`
+}
+
+// response represents the webhook's decision.
+type response struct {
+	Allow  bool     `json:"allow"`
+	Groups []string `json:"groups"`
+}
+
+// Client sends login attempts to an authentication webhook.
+type Client struct {
+	URL     string
+	Headers map[string]string
+	HTTP    *http.Client
+}
+
+// New creates a new webhook client using the given settings.
+func New(cfg config.Webhook) (*Client, error) {
+	timeout := 10 * time.Second
+	if cfg.Timeout != "" {
+		var err error
+		timeout, err = time.ParseDuration(cfg.Timeout)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &Client{
+		URL:     cfg.URL,
+		Headers: cfg.Headers,
+		HTTP:    &http.Client{Timeout: timeout},
+	}, nil
+}
+
+// Check sends the login attempt to the webhook. If the webhook responds with
+// a 2xx status code and allows the login, the user is returned with the groups
+// that the webhook assigned to them. Any other response denies the login.
+func (c *Client) Check(ctx context.Context, r Request) (config.User, bool, error) {
+	body, err := json.Marshal(r)
+	if err != nil {
+		return config.User{}, false, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.URL, bytes.NewReader(body))
+	if err != nil {
+		return config.User{}, false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, val := range c.Headers {
+		req.Header.Set(key, val)
+	}
+
+	res, err := c.HTTP.Do(req)
+	if err != nil {
+		return config.User{}, false, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		if res.StatusCode == http.StatusUnauthorized || res.StatusCode == http.StatusForbidden {
+			return config.User{}, false, nil
+		}
+		return config.User{}, false, fmt.Errorf("authhook: unexpected status code: %s", res.Status)
+	}
+
+	var out response
+	if err := json.NewDecoder(res.Body).Decode(&out); err != nil {
+		return config.User{}, false, fmt.Errorf("authhook: decoding response: %w", err)
+	}
+
+	if !out.Allow {
+		return config.User{}, false, nil
+	}
+
+	return config.User{Name: r.Username, Groups: out.Groups}, true, nil
+}
@@ -22,7 +22,15 @@
 package backends
 
 import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+
 	"github.com/zclconf/go-cty/cty"
+	"github.com/zclconf/go-cty/cty/gocty"
 	"go.elara.ws/seashell/internal/config"
 	"go.elara.ws/seashell/internal/router"
 )
@@ -43,6 +51,47 @@ func Get(name string) Backend {
 	return backends[name]
 }
 
+// settingsTypes contains functions that return a pointer to the
+// settings struct of each backend, used to validate route settings.
+var settingsTypes = map[string]func() any{
+	"proxy":  func() any { return &proxySettings{} },
+	"nomad":  func() any { return &nomadSettings{} },
+	"docker": func() any { return &dockerSettings{} },
+	"serial": func() any { return &serialSettings{} },
+}
+
+func init() {
+	for name, newSettings := range settingsTypes {
+		config.RegisterBackend(name, func(route config.Route) error {
+			return validateSettings(route, newSettings())
+		})
+	}
+}
+
+// validateSettings checks that the route's settings can be decoded into
+// its backend's settings, so that unknown settings and values with the
+// wrong type are reported when the config is loaded rather than when
+// someone connects. It also warns about deprecated settings.
+func validateSettings(route config.Route, settings any) error {
+	if typ := route.Settings.Type(); typ.IsObjectType() && typ.HasAttribute("delimeter") {
+		if typ.HasAttribute("delimiter") {
+			return errors.New("delimiter and delimeter can't both be set")
+		}
+		slog.Warn("The delimeter setting is deprecated, use delimiter instead", slog.String("route", route.Name))
+	}
+
+	if err := gocty.FromCtyValue(route.Settings, settings); err != nil {
+		if pathErr, ok := err.(cty.PathError); ok && len(pathErr.Path) > 0 {
+			attr, ok := pathErr.Path[0].(cty.GetAttrStep)
+			if ok && !strings.Contains(err.Error(), strconv.Quote(attr.Name)) {
+				return fmt.Errorf("%s: %w", attr.Name, err)
+			}
+		}
+		return err
+	}
+	return nil
+}
+
 // ctyTupleToStrings converts a cty tuple type to a slice of strings
 func ctyTupleToStrings(t *cty.Value) []string {
 	if t == nil {
@@ -82,6 +131,72 @@ func ctyObjToStringMap(o *cty.Value) map[string]string {
 	return out
 }
 
+// ctyObjToStringSliceMap converts a cty object type to a map from strings
+// to slices of strings
+func ctyObjToStringSliceMap(o *cty.Value) map[string][]string {
+	if o == nil {
+		return map[string][]string{}
+	}
+
+	out := make(map[string][]string, o.LengthInt())
+	iter := o.ElementIterator()
+	for iter.Next() {
+		key, val := iter.Element()
+		if key.Type() != cty.String || !val.CanIterateElements() {
+			continue
+		}
+		out[key.AsString()] = ctyTupleToStrings(&val)
+	}
+	return out
+}
+
+// ctyObjToStringMapMap converts a cty object type to a map from strings
+// to maps from strings to strings
+func ctyObjToStringMapMap(o *cty.Value) map[string]map[string]string {
+	if o == nil {
+		return map[string]map[string]string{}
+	}
+
+	out := make(map[string]map[string]string, o.LengthInt())
+	iter := o.ElementIterator()
+	for iter.Next() {
+		key, val := iter.Element()
+		if key.Type() != cty.String || !val.CanIterateElements() {
+			continue
+		}
+		out[key.AsString()] = ctyObjToStringMap(&val)
+	}
+	return out
+}
+
+// lookupUserMap looks up the entry for a user in a map whose keys are user
+// names or group names with a "group:" prefix. User entries take priority
+// over group entries.
+func lookupUserMap(m map[string]string, user config.User) (string, bool) {
+	if val, ok := m[user.Name]; ok {
+		return val, true
+	}
+
+	for _, group := range user.Groups {
+		if val, ok := m["group:"+group]; ok {
+			return val, true
+		}
+	}
+
+	return "", false
+}
+
+// readSecretFile reads a secret, such as a password or token, from the
+// file at path, with any surrounding whitespace removed. Secret files are
+// read every time they're needed, so that rotated secrets are picked up.
+func readSecretFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
 // valueOr returns the value that v points to
 // or a default value if v is nil.
 func valueOr[T any](v *T, or T) T {
@@ -90,3 +205,12 @@ func valueOr[T any](v *T, or T) T {
 	}
 	return *v
 }
+
+// routeDelimiter returns the delimiter setting, falling back to the
+// deprecated "delimeter" spelling and then to the default of ".".
+func routeDelimiter(val, deprecated *string) string {
+	if val != nil {
+		return *val
+	}
+	return valueOr(deprecated, ".")
+}
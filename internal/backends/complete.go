@@ -0,0 +1,61 @@
+/*
+ * Seashell - SSH server with virtual hosts and username-based routing
+ *
+ * Copyright (C) 2024 Elara6331 <elara@elara.ws>
+ *
+ * This file is part of Seashell.
+ *
+ * Seashell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * Seashell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with Seashell.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package backends
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/gliderlabs/ssh"
+)
+
+// parseCompleteCommand checks whether cmd is a _complete command, which
+// lists the targets the user can access for shell completion scripts.
+// If it is, it returns the prefix to complete. The prefix defaults to
+// the route argument if it isn't given in the command.
+func parseCompleteCommand(cmd []string, arg string) (string, bool) {
+	if len(cmd) == 0 || cmd[0] != "_complete" {
+		return "", false
+	}
+
+	if len(cmd) > 1 {
+		return cmd[1], true
+	}
+	return arg, true
+}
+
+// writeCompletions writes the candidates that start with prefix
+// to the session in sorted order, one per line.
+func writeCompletions(sess ssh.Session, prefix string, candidates []string) error {
+	candidates = slices.DeleteFunc(candidates, func(c string) bool {
+		return !strings.HasPrefix(c, prefix)
+	})
+	slices.Sort(candidates)
+
+	for _, candidate := range slices.Compact(candidates) {
+		if _, err := fmt.Fprintln(sess, candidate); err != nil {
+			return err
+		}
+	}
+	return nil
+}
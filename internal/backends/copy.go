@@ -0,0 +1,111 @@
+/*
+ * Seashell - SSH server with virtual hosts and username-based routing
+ *
+ * Copyright (C) 2024 Elara6331 <elara@elara.ws>
+ *
+ * This file is part of Seashell.
+ *
+ * Seashell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * Seashell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with Seashell.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package backends
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+
+	"github.com/gliderlabs/ssh"
+)
+
+// copyCommand represents a parsed seashell cp command. One of Src and Dst
+// is always "-", which refers to the SSH session's stdin or stdout, and
+// the other one is the remote path.
+type copyCommand struct {
+	Src string
+	Dst string
+}
+
+// fileCopier is implemented by backends that support the seashell cp command
+// using their native file API.
+type fileCopier interface {
+	// CopyTo writes everything read from r to the remote path.
+	CopyTo(ctx context.Context, path string, r io.Reader) error
+	// CopyFrom writes the contents of the remote path to w.
+	CopyFrom(ctx context.Context, path string, w io.Writer) error
+}
+
+// parseCopyCommand checks whether cmd is a seashell cp command. If it is,
+// it parses it and returns true. Each side can be prefixed with "local:"
+// or "remote:", so `seashell cp local: remote:/tmp/file` uploads stdin to
+// /tmp/file, and `seashell cp remote:/tmp/file local:` downloads it to
+// stdout. Unprefixed paths are remote, and "-" is the same as "local:".
+//
+// Seashell can't access files on the client, so the local side is always
+// the session's stdin or stdout, which the client's shell redirects to or
+// from a file. Because of this, "local:" can't be followed by a path.
+func parseCopyCommand(cmd []string) (copyCommand, bool, error) {
+	if len(cmd) < 2 || cmd[0] != "seashell" || cmd[1] != "cp" {
+		return copyCommand{}, false, nil
+	}
+
+	if len(cmd) != 4 {
+		return copyCommand{}, true, errors.New("usage: seashell cp <src> <dst>")
+	}
+
+	src, err := parseCopyPath(cmd[2])
+	if err != nil {
+		return copyCommand{}, true, err
+	}
+	dst, err := parseCopyPath(cmd[3])
+	if err != nil {
+		return copyCommand{}, true, err
+	}
+
+	cc := copyCommand{Src: src, Dst: dst}
+	if (cc.Src == "-") == (cc.Dst == "-") {
+		return copyCommand{}, true, errors.New("exactly one side of seashell cp must be local (the session's stdin or stdout)")
+	}
+
+	return cc, true, nil
+}
+
+// parseCopyPath parses one side of a seashell cp command,
+// returning "-" for the local side and the path otherwise.
+func parseCopyPath(arg string) (string, error) {
+	if local, ok := strings.CutPrefix(arg, "local:"); ok {
+		if local != "" && local != "-" {
+			return "", errors.New("the local side of seashell cp is stdin or stdout, so it can't have a path (redirect it in your shell instead)")
+		}
+		return "-", nil
+	}
+
+	if remote, ok := strings.CutPrefix(arg, "remote:"); ok {
+		if remote == "" || remote == "-" {
+			return "", errors.New("the remote side of seashell cp needs a path")
+		}
+		return remote, nil
+	}
+
+	return arg, nil
+}
+
+// handleCopy runs a seashell cp command using the given copier.
+func handleCopy(sess ssh.Session, cc copyCommand, fc fileCopier) error {
+	if cc.Src == "-" {
+		return fc.CopyTo(sess.Context(), cc.Dst, sess)
+	}
+	return fc.CopyFrom(sess.Context(), cc.Src, sess)
+}
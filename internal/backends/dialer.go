@@ -0,0 +1,148 @@
+/*
+ * Seashell - SSH server with virtual hosts and username-based routing
+ *
+ * Copyright (C) 2024 Elara6331 <elara@elara.ws>
+ *
+ * This file is part of Seashell.
+ *
+ * Seashell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * Seashell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with Seashell.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package backends
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// dialTimeout is the maximum amount of time to wait for
+// a connection to an upstream server.
+const dialTimeout = 20 * time.Second
+
+// dialUpstream connects to addr over TCP. If proxyURL isn't empty, the
+// connection is made through the SOCKS5 (socks5://) or HTTP CONNECT
+// (http://) proxy it refers to.
+func dialUpstream(ctx context.Context, proxyURL, addr string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: dialTimeout}
+	if proxyURL == "" {
+		return dialer.DialContext(ctx, "tcp", addr)
+	}
+
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, err
+	}
+
+	var conn net.Conn
+	switch u.Scheme {
+	case "socks5", "socks5h":
+		pd, err := proxy.FromURL(u, dialer)
+		if err != nil {
+			return nil, err
+		}
+		conn, err = pd.(proxy.ContextDialer).DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+	case "http":
+		conn, err = dialHTTPConnect(ctx, dialer, u, addr)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported dial proxy scheme: %q", u.Scheme)
+	}
+
+	return proxiedConn{conn, proxiedAddr(addr)}, nil
+}
+
+// dialHTTPConnect connects to addr through an HTTP proxy using the CONNECT method.
+func dialHTTPConnect(ctx context.Context, dialer *net.Dialer, u *url.URL, addr string) (net.Conn, error) {
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "80")
+	}
+
+	conn, err := dialer.DialContext(ctx, "tcp", host)
+	if err != nil {
+		return nil, err
+	}
+
+	req := "CONNECT " + addr + " HTTP/1.1\r\nHost: " + addr + "\r\n"
+	if u.User != nil {
+		pwd, _ := u.User.Password()
+		creds := base64.StdEncoding.EncodeToString([]byte(u.User.Username() + ":" + pwd))
+		req += "Proxy-Authorization: Basic " + creds + "\r\n"
+	}
+	req += "\r\n"
+
+	conn.SetDeadline(time.Now().Add(dialTimeout))
+	if _, err = conn.Write([]byte(req)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	res, err := http.ReadResponse(br, nil)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy refused connection to %s: %s", addr, res.Status)
+	}
+	conn.SetDeadline(time.Time{})
+
+	return bufferedConn{conn, br}, nil
+}
+
+// bufferedConn is a connection whose reads go through
+// a buffered reader, so that no buffered data is lost.
+type bufferedConn struct {
+	net.Conn
+	br *bufio.Reader
+}
+
+func (bc bufferedConn) Read(b []byte) (int, error) {
+	return bc.br.Read(b)
+}
+
+// proxiedConn is a connection made through a proxy. It reports the address
+// of the upstream server as its remote address rather than the proxy's,
+// so that host keys are associated with the right host.
+type proxiedConn struct {
+	net.Conn
+	addr proxiedAddr
+}
+
+func (pc proxiedConn) RemoteAddr() net.Addr {
+	return pc.addr
+}
+
+// proxiedAddr is the address of a server reached through a proxy.
+type proxiedAddr string
+
+func (pa proxiedAddr) Network() string { return "tcp" }
+func (pa proxiedAddr) String() string  { return string(pa) }
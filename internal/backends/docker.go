@@ -22,11 +22,22 @@
 package backends
 
 import (
+	"archive/tar"
+	"cmp"
 	"context"
 	"errors"
+	"fmt"
 	"io"
+	"io/fs"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"time"
 
 	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/pkg/stdcopy"
 	"github.com/gliderlabs/ssh"
 	"github.com/moby/moby/client"
 	"github.com/zclconf/go-cty/cty"
@@ -38,10 +49,45 @@ import (
 
 // dockerSettings represents settings for the docker backend.
 type dockerSettings struct {
-	Command    *cty.Value `cty:"command"`
-	Privileged *bool      `cty:"privileged"`
-	User       *string    `cty:"user"`
-	UserMap    *cty.Value `cty:"user_map"`
+	Command        *cty.Value `cty:"command"`
+	Privileged     *bool      `cty:"privileged"`
+	User           *string    `cty:"user"`
+	UserMap        *cty.Value `cty:"user_map"`
+	RateLimit      *int       `cty:"rate_limit"`
+	Hosts          *cty.Value `cty:"hosts"`
+	Delimiter      *string    `cty:"delimiter"`
+	OldDelimiter   *string    `cty:"delimeter"`
+	Selectors      *cty.Value `cty:"selectors"`
+	StartIfStopped *bool      `cty:"start_if_stopped"`
+	WaitHealthy    *bool      `cty:"wait_healthy"`
+	StartTimeout   *string    `cty:"start_timeout"`
+	Workdir        *string    `cty:"workdir"`
+	Env            *cty.Value `cty:"env"`
+	Host           *string    `cty:"host"`
+	APIVersion     *string    `cty:"api_version"`
+	TLSCACert      *string    `cty:"tls_ca_cert"`
+	TLSCert        *string    `cty:"tls_cert"`
+	TLSKey         *string    `cty:"tls_key"`
+	Context        *string    `cty:"context"`
+	Image          *string    `cty:"image"`
+	Mounts         *cty.Value `cty:"mounts"`
+	Network        *string    `cty:"network"`
+	MemoryLimit    *string    `cty:"memory_limit"`
+	CPULimit       *float64   `cty:"cpu_limit"`
+	PidsLimit      *int64     `cty:"pids_limit"`
+	ExecTimeout    *string    `cty:"exec_timeout"`
+}
+
+// endpoint returns the route-level docker connection settings.
+func (opts dockerSettings) endpoint() dockerEndpoint {
+	return dockerEndpoint{
+		Host:       opts.Host,
+		APIVersion: opts.APIVersion,
+		TLSCACert:  opts.TLSCACert,
+		TLSCert:    opts.TLSCert,
+		TLSKey:     opts.TLSKey,
+		Context:    opts.Context,
+	}
 }
 
 // Docker is the docker backend. It returns a handler that connects
@@ -49,41 +95,153 @@ type dockerSettings struct {
 func Docker(route config.Route) router.Handler {
 	return func(sess ssh.Session, arg string) error {
 		user, _ := sshctx.GetUser(sess.Context())
-		if !route.Permissions.IsAllowed(user, arg) {
-			return router.ErrUnauthorized
-		}
 
 		var opts dockerSettings
 		err := gocty.FromCtyValue(route.Settings, &opts)
 		if err != nil {
 			return err
 		}
+		sess = limitSession(sess, opts.RateLimit)
 
-		pty, resizeCh, ok := sess.Pty()
-		if !ok {
-			return errors.New("this route only accepts pty sessions (try adding the -t flag)")
+		if prefix, ok := parseCompleteCommand(sess.Command(), arg); ok {
+			return dockerComplete(sess, route, opts, prefix)
+		}
+
+		var hostItem []string
+		ep := opts.endpoint()
+		if opts.Hosts != nil {
+			var hostName string
+			var ok bool
+			hostName, arg, ok = strings.Cut(arg, routeDelimiter(opts.Delimiter, opts.OldDelimiter))
+			if !ok {
+				return errors.New("this route requires a docker host, e.x. host.container")
+			}
+
+			ep, err = dockerGetEndpoint(opts.Hosts, hostName, ep)
+			if err != nil {
+				return err
+			}
+
+			hostItem = []string{"host:" + hostName}
+		}
+
+		err = expandSettings(newTemplateData(sess, arg), map[string]*string{"user": opts.User})
+		if err != nil {
+			return err
 		}
-		
+
 		if opts.User == nil {
 			userMap := ctyObjToStringMap(opts.UserMap)
 			user, _ := sshctx.GetUser(sess.Context())
 
 			if muser, ok := userMap[user.Name]; ok {
 				opts.User = &muser
-			} else {
+			} else if opts.Image == nil {
+				// Ephemeral containers use the image's default user
 				opts.User = &user.Name
 			}
 		}
 
-		c, err := client.NewClientWithOpts(
-			client.WithHostFromEnv(),
-			client.WithVersionFromEnv(),
-			client.WithTLSClientConfigFromEnv(),
-		)
+		// Only users that have been explicitly granted the privileged
+		// item can use privileged exec or containers if they're enabled
+		privileged := valueOr(opts.Privileged, false) && route.Permissions.IsGranted(user, "privileged")
+		opts.Privileged = &privileged
+
+		if err := router.InjectDialFailure(route.Chaos); err != nil {
+			return err
+		}
+
+		c, err := newDockerClient(ep)
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+
+		if opts.Image != nil {
+			img, err := expandTemplate("image", *opts.Image, newTemplateData(sess, arg))
+			if err != nil {
+				return err
+			}
+
+			if !route.Permissions.IsAllowed(user, append(hostItem, "image:"+img)...) {
+				return router.ErrUnauthorized
+			}
+
+			return dockerRunEphemeral(sess, c, opts, img)
+		}
+
+		timeout, err := time.ParseDuration(valueOr(opts.ExecTimeout, "30s"))
 		if err != nil {
 			return err
 		}
 
+		findCtx, cancel := context.WithTimeout(sess.Context(), timeout)
+		candidates, err := dockerFindContainers(findCtx, c, opts, arg)
+		cancel()
+		if err != nil {
+			return dockerTimeoutError(findCtx, timeout, err)
+		}
+
+		if _, ok := ctyObjToStringMapMap(opts.Selectors)[arg]; ok || !isDockerPattern(arg) {
+			// Selectors and exact names are checked as-is
+			if !route.Permissions.IsAllowed(user, append(hostItem, arg)...) {
+				return router.ErrUnauthorized
+			}
+		} else {
+			// Only consider the containers matching the pattern
+			// that the user is allowed to access
+			candidates = slices.DeleteFunc(candidates, func(name string) bool {
+				return !route.Permissions.IsAllowed(user, append(hostItem, name)...)
+			})
+		}
+
+		switch {
+		case len(candidates) == 0 && arg == "":
+			return errors.New("there are no containers you're allowed to access")
+		case len(candidates) == 0:
+			return fmt.Errorf("no running containers match %q", arg)
+		case len(candidates) == 1:
+			arg = candidates[0]
+		default:
+			if _, _, ok := sess.Pty(); !ok {
+				return fmt.Errorf("%q matches multiple containers: %s", arg, strings.Join(candidates, ", "))
+			}
+
+			i, err := pickItem(sess, "Select a container", candidates)
+			if err != nil {
+				return err
+			}
+			arg = candidates[i]
+		}
+
+		if valueOr(opts.StartIfStopped, false) {
+			err = dockerEnsureStarted(sess, c, opts, arg)
+			if err != nil {
+				return err
+			}
+		}
+
+		if sess.Subsystem() == "sftp" {
+			return serveSFTP(sess, dockerFS{dockerCopier{c, arg}})
+		}
+
+		if cc, ok, err := parseCopyCommand(sess.Command()); ok {
+			if err != nil {
+				return err
+			}
+			return handleCopy(sess, cc, dockerCopier{c, arg})
+		}
+
+		pty, resizeCh, isPty := sess.Pty()
+
+		env, workdir, err := dockerExecEnv(sess, opts, arg)
+		if err != nil {
+			return err
+		}
+		if isPty {
+			env = append(env, "TERM="+pty.Term)
+		}
+
 		cmd := sess.Command()
 		if len(cmd) == 0 {
 			cmd = ctyTupleToStrings(opts.Command)
@@ -92,38 +250,354 @@ func Docker(route config.Route) router.Handler {
 			}
 		}
 
-		idr, err := c.ContainerExecCreate(sess.Context(), arg, container.ExecOptions{
+		// Setting up the exec instance shouldn't take long, so it's aborted
+		// if the docker engine doesn't respond in time.
+		setupCtx, cancel := context.WithTimeout(sess.Context(), timeout)
+		defer cancel()
+
+		idr, err := c.ContainerExecCreate(setupCtx, arg, container.ExecOptions{
 			User:         *opts.User,
-			Privileged:   opts.Privileged != nil && *opts.Privileged,
-			Tty:          true,
+			Privileged:   *opts.Privileged,
+			Tty:          isPty,
 			AttachStdin:  true,
 			AttachStderr: true,
 			AttachStdout: true,
-			Env:          append(sess.Environ(), "TERM="+pty.Term),
+			Env:          env,
+			WorkingDir:   workdir,
 			Cmd:          cmd,
 		})
 		if err != nil {
-			return err
+			return dockerTimeoutError(setupCtx, timeout, err)
 		}
 
-		go dockerHandleResize(resizeCh, sess.Context(), c, idr.ID)
+		if isPty {
+			go dockerHandleResize(resizeCh, sess.Context(), c, idr.ID)
+		}
 
-		hr, err := c.ContainerExecAttach(sess.Context(), idr.ID, container.ExecAttachOptions{Tty: true})
+		hr, err := c.ContainerExecAttach(setupCtx, idr.ID, container.ExecAttachOptions{Tty: isPty})
 		if err != nil {
-			return err
+			return dockerTimeoutError(setupCtx, timeout, err)
 		}
 		defer hr.Close()
 
-		err = c.ContainerExecStart(sess.Context(), idr.ID, container.ExecStartOptions{Tty: true})
+		err = c.ContainerExecStart(setupCtx, idr.ID, container.ExecStartOptions{Tty: isPty})
+		if err != nil {
+			return dockerTimeoutError(setupCtx, timeout, err)
+		}
+		cancel()
+
+		// Stop copying as soon as the client disconnects,
+		// rather than waiting for the exec to produce output.
+		go func() {
+			<-sess.Context().Done()
+			hr.Close()
+		}()
+
+		if isPty {
+			go io.Copy(hr.Conn, sess)
+			io.Copy(sess, hr.Reader)
+		} else {
+			// Without a tty, the command only sees the end of its input
+			// if the write side is closed, and the output is multiplexed.
+			go func() {
+				io.Copy(hr.Conn, sess)
+				hr.CloseWrite()
+			}()
+			stdcopy.StdCopy(sess, sess.Stderr(), hr.Reader)
+		}
+
+		if sess.Context().Err() != nil {
+			return dockerCleanupExec(c, idr.ID)
+		}
+
+		code, err := dockerExecExitCode(sess.Context(), c, idr.ID)
 		if err != nil {
 			return err
 		}
+		return router.ExitStatus(code)
+	}
+}
+
+// dockerComplete writes the containers and selectors that the user can
+// access and that start with prefix. If the route has several hosts, the
+// host names are completed first.
+func dockerComplete(sess ssh.Session, route config.Route, opts dockerSettings, prefix string) error {
+	user, _ := sshctx.GetUser(sess.Context())
 
-		go io.Copy(hr.Conn, sess)
-		io.Copy(sess, hr.Reader)
+	ep := opts.endpoint()
 
+	var hostPrefix string
+	var hostItem []string
+	if opts.Hosts != nil {
+		delimiter := routeDelimiter(opts.Delimiter, opts.OldDelimiter)
+		hostName, _, ok := strings.Cut(prefix, delimiter)
+		if !ok {
+			var hosts []string
+			iter := opts.Hosts.ElementIterator()
+			for iter.Next() {
+				key, _ := iter.Element()
+				if route.Permissions.IsAllowed(user, "host:"+key.AsString()) {
+					hosts = append(hosts, key.AsString()+delimiter)
+				}
+			}
+			return writeCompletions(sess, prefix, hosts)
+		}
+
+		var err error
+		ep, err = dockerGetEndpoint(opts.Hosts, hostName, ep)
+		if err != nil {
+			return err
+		}
+
+		hostPrefix = hostName + delimiter
+		hostItem = []string{"host:" + hostName}
+	}
+
+	c, err := newDockerClient(ep)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	names, err := dockerFindContainers(sess.Context(), c, opts, "")
+	if err != nil {
+		return err
+	}
+
+	for name := range ctyObjToStringMapMap(opts.Selectors) {
+		names = append(names, name)
+	}
+
+	var candidates []string
+	for _, name := range names {
+		if route.Permissions.IsAllowed(user, append(hostItem, name)...) {
+			candidates = append(candidates, hostPrefix+name)
+		}
+	}
+
+	return writeCompletions(sess, prefix, candidates)
+}
+
+// dockerFindContainers finds the names of the containers that arg refers to.
+// arg can be the name of a label selector defined in the settings, a glob
+// pattern matching container names, or an exact container name or ID.
+// If arg is empty, all containers are returned.
+// Only running containers are considered for selectors and patterns,
+// unless start_if_stopped is enabled.
+func dockerFindContainers(ctx context.Context, c *client.Client, opts dockerSettings, arg string) ([]string, error) {
+	selector, isSelector := ctyObjToStringMapMap(opts.Selectors)[arg]
+	isPattern := isDockerPattern(arg)
+	if !isSelector && !isPattern {
+		return []string{arg}, nil
+	}
+
+	listOpts := container.ListOptions{
+		Filters: filters.NewArgs(),
+		// Stopped containers can only be used if they'll be started
+		All: valueOr(opts.StartIfStopped, false),
+	}
+	for key, val := range selector {
+		listOpts.Filters.Add("label", key+"="+val)
+	}
+
+	containers, err := c.ContainerList(ctx, listOpts)
+	if err != nil {
+		return nil, err
+	}
+
+	var out []string
+	for _, ctr := range containers {
+		if len(ctr.Names) == 0 {
+			continue
+		}
+		// Docker container names start with a slash
+		name := strings.TrimPrefix(ctr.Names[0], "/")
+
+		if !isSelector && arg != "" {
+			if matched, _ := path.Match(arg, name); !matched {
+				continue
+			}
+		}
+
+		out = append(out, name)
+	}
+
+	return out, nil
+}
+
+// isDockerPattern checks whether arg is a glob pattern. An empty
+// arg is treated as a pattern that matches every container.
+func isDockerPattern(arg string) bool {
+	return arg == "" || strings.ContainsAny(arg, "*?[")
+}
+
+// dockerEnsureStarted starts the container if it isn't running. If
+// wait_healthy is enabled and the container has a health check,
+// it waits until the container is healthy.
+func dockerEnsureStarted(sess ssh.Session, c *client.Client, opts dockerSettings, containerID string) error {
+	timeout, err := time.ParseDuration(valueOr(opts.StartTimeout, "1m"))
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(sess.Context(), timeout)
+	defer cancel()
+
+	info, err := c.ContainerInspect(ctx, containerID)
+	if err != nil {
+		return err
+	}
+
+	if !info.State.Running {
+		fmt.Fprintf(sess.Stderr(), "Starting container %s...\r\n", strings.TrimPrefix(info.Name, "/"))
+		err = c.ContainerStart(ctx, containerID, container.StartOptions{})
+		if err != nil {
+			return err
+		}
+	}
+
+	if !valueOr(opts.WaitHealthy, false) {
 		return nil
 	}
+
+	for {
+		info, err = c.ContainerInspect(ctx, containerID)
+		if err != nil {
+			return err
+		}
+
+		if info.State.Health == nil || info.State.Health.Status == "healthy" {
+			return nil
+		} else if !info.State.Running {
+			return fmt.Errorf("container %s stopped while waiting for it to become healthy", containerID)
+		}
+
+		select {
+		case <-time.After(time.Second):
+		case <-ctx.Done():
+			return fmt.Errorf("container %s didn't become healthy in time: %w", containerID, ctx.Err())
+		}
+	}
+}
+
+// dockerExecEnv returns the environment and working directory for an exec
+// instance, expanding any templates in the env and workdir settings.
+// Variables from the env setting override the ones sent by the client.
+func dockerExecEnv(sess ssh.Session, opts dockerSettings, containerName string) ([]string, string, error) {
+	data := newTemplateData(sess, containerName)
+
+	workdir, err := expandTemplate("workdir", valueOr(opts.Workdir, ""), data)
+	if err != nil {
+		return nil, "", err
+	}
+
+	envMap := ctyObjToStringMap(opts.Env)
+	keys := make([]string, 0, len(envMap))
+	for key := range envMap {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	env := sess.Environ()
+	for _, key := range keys {
+		val, err := expandTemplate("env."+key, envMap[key], data)
+		if err != nil {
+			return nil, "", err
+		}
+		env = append(env, key+"="+val)
+	}
+
+	return env, workdir, nil
+}
+
+// dockerGetEndpoint gets the settings for the named docker host
+// from the hosts setting. Any settings the host doesn't set are taken
+// from defaults, which contains the route-level connection settings.
+func dockerGetEndpoint(hosts *cty.Value, name string, defaults dockerEndpoint) (ep dockerEndpoint, err error) {
+	if !hosts.Type().IsObjectType() && !hosts.Type().IsMapType() {
+		return ep, errors.New("docker hosts setting must be an object")
+	}
+
+	iter := hosts.ElementIterator()
+	for iter.Next() {
+		key, val := iter.Element()
+		if key.AsString() != name {
+			continue
+		}
+		err = gocty.FromCtyValue(val, &ep)
+		if err != nil {
+			return ep, err
+		}
+
+		ep.Host = cmp.Or(ep.Host, defaults.Host)
+		ep.APIVersion = cmp.Or(ep.APIVersion, defaults.APIVersion)
+		ep.TLSCACert = cmp.Or(ep.TLSCACert, defaults.TLSCACert)
+		ep.TLSCert = cmp.Or(ep.TLSCert, defaults.TLSCert)
+		ep.TLSKey = cmp.Or(ep.TLSKey, defaults.TLSKey)
+		ep.Context = cmp.Or(ep.Context, defaults.Context)
+		return ep, nil
+	}
+
+	return ep, fmt.Errorf("unknown docker host: %q", name)
+}
+
+// dockerExecExitCode gets the exit code of a finished exec instance.
+// The output stream may close slightly before Docker marks the exec as
+// finished, so it waits a short time for that to happen.
+func dockerExecExitCode(ctx context.Context, c *client.Client, execID string) (int, error) {
+	for i := 0; i < 20; i++ {
+		info, err := c.ContainerExecInspect(ctx, execID)
+		if err != nil {
+			return 0, err
+		}
+
+		if !info.Running {
+			return info.ExitCode, nil
+		}
+
+		select {
+		case <-time.After(50 * time.Millisecond):
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+	}
+	return 0, errors.New("timed out waiting for exec to finish")
+}
+
+// dockerTimeoutError returns a clearer error if err
+// was caused by the context's deadline being exceeded.
+func dockerTimeoutError(ctx context.Context, timeout time.Duration, err error) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("docker engine didn't respond within %s", timeout)
+	}
+	return err
+}
+
+// dockerCleanupExec checks that an exec instance doesn't outlive its
+// session. The Docker API has no way to stop an exec instance, and the PID
+// it reports belongs to the engine's PID namespace, so it can't be signaled
+// from here. Instead, this relies on the hijacked connection having been
+// closed, which makes the engine hang up exec instances with a tty. If the
+// process is still running after that, it's reported as orphaned.
+func dockerCleanupExec(c *client.Client, execID string) error {
+	// The session context has been canceled at this point
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	for {
+		info, err := c.ContainerExecInspect(ctx, execID)
+		if err != nil {
+			return err
+		} else if !info.Running {
+			return nil
+		}
+
+		select {
+		case <-time.After(100 * time.Millisecond):
+		case <-ctx.Done():
+			return fmt.Errorf("exec instance %s is orphaned: it's still running after the client disconnected", execID)
+		}
+	}
 }
 
 // dockerHandleResize resizes the Docker pseudo-tty whenever it receives
@@ -136,3 +610,196 @@ func dockerHandleResize(resizeCh <-chan ssh.Window, ctx context.Context, c *clie
 		})
 	}
 }
+
+// dockerCopier implements seashell cp for Docker containers.
+type dockerCopier struct {
+	c           *client.Client
+	containerID string
+}
+
+// CopyTo uploads a file to the container. The Docker API only accepts
+// tar archives with a known size, so the data is buffered in a temporary
+// file before being sent.
+func (dc dockerCopier) CopyTo(ctx context.Context, dst string, r io.Reader) error {
+	tmp, err := os.CreateTemp("", "seashell-cp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	size, err := io.Copy(tmp, r)
+	if err != nil {
+		return err
+	}
+
+	if _, err = tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		tw := tar.NewWriter(pw)
+		err := tw.WriteHeader(&tar.Header{
+			Name:    path.Base(dst),
+			Mode:    0o644,
+			Size:    size,
+			ModTime: time.Now(),
+		})
+		if err == nil {
+			_, err = io.Copy(tw, tmp)
+		}
+		if err == nil {
+			err = tw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+
+	return dc.c.CopyToContainer(ctx, dc.containerID, path.Dir(dst), pr, container.CopyToContainerOptions{})
+}
+
+// CopyFrom downloads a file from the container. If the path is a directory,
+// the tar archive returned by Docker is written as-is.
+func (dc dockerCopier) CopyFrom(ctx context.Context, src string, w io.Writer) error {
+	rc, stat, err := dc.c.CopyFromContainer(ctx, dc.containerID, src)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	if stat.Mode.IsDir() {
+		_, err = io.Copy(w, rc)
+		return err
+	}
+
+	tr := tar.NewReader(rc)
+	if _, err = tr.Next(); err != nil {
+		return err
+	}
+	_, err = io.Copy(w, tr)
+	return err
+}
+
+// dockerFS implements the SFTP subsystem for Docker containers.
+type dockerFS struct {
+	dockerCopier
+}
+
+// Stat returns information about a file in the container.
+func (dfs dockerFS) Stat(ctx context.Context, name string) (fs.FileInfo, error) {
+	stat, err := dfs.c.ContainerStatPath(ctx, dfs.containerID, name)
+	if err != nil {
+		return nil, dockerFSError("stat", name, err)
+	}
+	return dockerFileInfo{stat}, nil
+}
+
+// ReadDir lists a directory in the container. The Docker API only
+// provides tar archives of entire directories, so the whole archive
+// has to be read to find the direct children of the directory.
+func (dfs dockerFS) ReadDir(ctx context.Context, name string) ([]fs.FileInfo, error) {
+	rc, _, err := dfs.c.CopyFromContainer(ctx, dfs.containerID, name)
+	if err != nil {
+		return nil, dockerFSError("readdir", name, err)
+	}
+	defer rc.Close()
+
+	tr := tar.NewReader(rc)
+
+	// The first entry is the directory itself
+	hdr, err := tr.Next()
+	if err != nil {
+		return nil, err
+	}
+	if hdr.Typeflag != tar.TypeDir {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errors.New("not a directory")}
+	}
+	prefix := strings.TrimSuffix(hdr.Name, "/") + "/"
+
+	var out []fs.FileInfo
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return out, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		rel := strings.TrimSuffix(strings.TrimPrefix(hdr.Name, prefix), "/")
+		if rel == "" || strings.Contains(rel, "/") {
+			continue
+		}
+		out = append(out, hdr.FileInfo())
+	}
+}
+
+// Open opens a file in the container for reading.
+func (dfs dockerFS) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	rc, stat, err := dfs.c.CopyFromContainer(ctx, dfs.containerID, name)
+	if err != nil {
+		return nil, dockerFSError("open", name, err)
+	}
+
+	if stat.Mode.IsDir() {
+		rc.Close()
+		return nil, &fs.PathError{Op: "open", Path: name, Err: errors.New("is a directory")}
+	}
+
+	tr := tar.NewReader(rc)
+	if _, err = tr.Next(); err != nil {
+		rc.Close()
+		return nil, err
+	}
+
+	return struct {
+		io.Reader
+		io.Closer
+	}{tr, rc}, nil
+}
+
+// WriteFile writes a file to the container.
+func (dfs dockerFS) WriteFile(ctx context.Context, name string, r io.Reader) error {
+	return dfs.CopyTo(ctx, name, r)
+}
+
+// Mkdir creates a directory in the container.
+func (dfs dockerFS) Mkdir(ctx context.Context, name string) error {
+	pr, pw := io.Pipe()
+	go func() {
+		tw := tar.NewWriter(pw)
+		err := tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeDir,
+			Name:     path.Base(name) + "/",
+			Mode:     0o755,
+			ModTime:  time.Now(),
+		})
+		if err == nil {
+			err = tw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+
+	err := dfs.c.CopyToContainer(ctx, dfs.containerID, path.Dir(name), pr, container.CopyToContainerOptions{})
+	return dockerFSError("mkdir", name, err)
+}
+
+// dockerFSError converts Docker "not found" errors into errors that
+// the SFTP server recognizes.
+func dockerFSError(op, name string, err error) error {
+	if client.IsErrNotFound(err) {
+		return &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	return err
+}
+
+// dockerFileInfo implements fs.FileInfo for Docker path stats.
+type dockerFileInfo struct {
+	stat container.PathStat
+}
+
+func (fi dockerFileInfo) Name() string       { return fi.stat.Name }
+func (fi dockerFileInfo) Size() int64        { return fi.stat.Size }
+func (fi dockerFileInfo) Mode() fs.FileMode  { return fi.stat.Mode }
+func (fi dockerFileInfo) ModTime() time.Time { return fi.stat.Mtime }
+func (fi dockerFileInfo) IsDir() bool        { return fi.stat.Mode.IsDir() }
+func (fi dockerFileInfo) Sys() any           { return nil }
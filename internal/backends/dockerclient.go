@@ -0,0 +1,196 @@
+/*
+ * Seashell - SSH server with virtual hosts and username-based routing
+ *
+ * Copyright (C) 2024 Elara6331 <elara@elara.ws>
+ *
+ * This file is part of Seashell.
+ *
+ * Seashell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * Seashell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with Seashell.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package backends
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"time"
+
+	"github.com/docker/go-connections/tlsconfig"
+	"github.com/moby/moby/client"
+)
+
+// dockerEndpoint represents the settings used to connect to a Docker engine.
+type dockerEndpoint struct {
+	Host       *string `cty:"host"`
+	APIVersion *string `cty:"api_version"`
+	TLSCACert  *string `cty:"tls_ca_cert"`
+	TLSCert    *string `cty:"tls_cert"`
+	TLSKey     *string `cty:"tls_key"`
+	Context    *string `cty:"context"`
+}
+
+// newDockerClient creates a Docker client for the given endpoint. If the
+// endpoint has no host, the DOCKER_HOST and related environment variables
+// are used instead. ssh:// hosts are reached by running
+// `docker system dial-stdio` on the remote machine, like the Docker CLI does.
+//
+// If the endpoint refers to a Docker CLI context, the context's settings are
+// used for anything the endpoint doesn't set explicitly.
+func newDockerClient(ep dockerEndpoint) (*client.Client, error) {
+	var skipVerify bool
+	if ep.Context != nil {
+		ctxEp, skip, err := loadDockerContext(*ep.Context)
+		if err != nil {
+			return nil, err
+		}
+
+		ep.Host = cmp.Or(ep.Host, ctxEp.Host)
+		ep.TLSCACert = cmp.Or(ep.TLSCACert, ctxEp.TLSCACert)
+		ep.TLSCert = cmp.Or(ep.TLSCert, ctxEp.TLSCert)
+		ep.TLSKey = cmp.Or(ep.TLSKey, ctxEp.TLSKey)
+		skipVerify = skip
+	}
+
+	opts := []client.Opt{
+		client.WithHostFromEnv(),
+		client.WithVersionFromEnv(),
+		client.WithTLSClientConfigFromEnv(),
+	}
+
+	if ep.Host != nil {
+		u, err := url.Parse(*ep.Host)
+		if err != nil {
+			return nil, err
+		}
+
+		if u.Scheme == "ssh" {
+			opts = append(opts,
+				client.WithHost("http://docker.example.com"),
+				client.WithDialContext(dockerSSHDialer(u)),
+			)
+		} else {
+			opts = append(opts, client.WithHost(*ep.Host))
+		}
+	}
+
+	if skipVerify {
+		// The client doesn't have an option to skip verification, so
+		// the HTTP client is replaced before the host is configured.
+		tlsConfig, err := tlsconfig.Client(tlsconfig.Options{
+			CAFile:             valueOr(ep.TLSCACert, ""),
+			CertFile:           valueOr(ep.TLSCert, ""),
+			KeyFile:            valueOr(ep.TLSKey, ""),
+			ExclusiveRootPools: true,
+			InsecureSkipVerify: true,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		httpClient := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+		opts = append([]client.Opt{client.WithHTTPClient(httpClient)}, opts...)
+	} else if ep.TLSCACert != nil || ep.TLSCert != nil || ep.TLSKey != nil {
+		opts = append(opts, client.WithTLSClientConfig(
+			valueOr(ep.TLSCACert, ""),
+			valueOr(ep.TLSCert, ""),
+			valueOr(ep.TLSKey, ""),
+		))
+	}
+
+	if ep.APIVersion != nil {
+		opts = append(opts, client.WithVersion(*ep.APIVersion))
+	} else {
+		opts = append(opts, client.WithAPIVersionNegotiation())
+	}
+
+	return client.NewClientWithOpts(opts...)
+}
+
+// dockerSSHDialer returns a dial function that connects to the Docker engine
+// on a remote machine over SSH, using the system's ssh client.
+func dockerSSHDialer(u *url.URL) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, _, _ string) (net.Conn, error) {
+		var args []string
+		if u.User != nil {
+			args = append(args, "-l", u.User.Username())
+		}
+		if u.Port() != "" {
+			args = append(args, "-p", u.Port())
+		}
+		args = append(args, "--", u.Hostname(), "docker", "system", "dial-stdio")
+
+		// The connection outlives the dial context, so it's not
+		// used to start the command.
+		cmd := exec.Command("ssh", args...)
+
+		stdin, err := cmd.StdinPipe()
+		if err != nil {
+			return nil, err
+		}
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			return nil, err
+		}
+
+		if err := cmd.Start(); err != nil {
+			return nil, err
+		}
+
+		return &commandConn{cmd: cmd, stdin: stdin, stdout: stdout}, nil
+	}
+}
+
+// commandConn is a [net.Conn] that reads from a command's stdout
+// and writes to its stdin.
+type commandConn struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout io.ReadCloser
+}
+
+func (cc *commandConn) Read(b []byte) (int, error)  { return cc.stdout.Read(b) }
+func (cc *commandConn) Write(b []byte) (int, error) { return cc.stdin.Write(b) }
+
+func (cc *commandConn) Close() error {
+	err := cc.stdin.Close()
+	if cc.cmd.Process != nil {
+		cc.cmd.Process.Kill()
+	}
+	cc.cmd.Wait()
+	return err
+}
+
+func (cc *commandConn) LocalAddr() net.Addr  { return dummyAddr("local") }
+func (cc *commandConn) RemoteAddr() net.Addr { return dummyAddr("remote") }
+
+func (cc *commandConn) SetDeadline(t time.Time) error      { return errNoDeadline }
+func (cc *commandConn) SetReadDeadline(t time.Time) error  { return errNoDeadline }
+func (cc *commandConn) SetWriteDeadline(t time.Time) error { return errNoDeadline }
+
+// errNoDeadline is returned when trying to set a deadline on
+// a connection that doesn't support them.
+var errNoDeadline = errors.New("deadlines are not supported on command connections")
+
+// dummyAddr is a placeholder address for connections
+// that don't have real network addresses.
+type dummyAddr string
+
+func (da dummyAddr) Network() string { return "command" }
+func (da dummyAddr) String() string  { return string(da) }
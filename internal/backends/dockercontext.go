@@ -0,0 +1,108 @@
+/*
+ * Seashell - SSH server with virtual hosts and username-based routing
+ *
+ * Copyright (C) 2024 Elara6331 <elara@elara.ws>
+ *
+ * This file is part of Seashell.
+ *
+ * Seashell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * Seashell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with Seashell.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package backends
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// dockerContextMeta represents the metadata file of a Docker CLI context.
+type dockerContextMeta struct {
+	Name      string
+	Endpoints map[string]struct {
+		Host          string
+		SkipTLSVerify bool
+	}
+}
+
+// dockerConfigDir returns the Docker CLI's configuration directory.
+func dockerConfigDir() (string, error) {
+	if dir := os.Getenv("DOCKER_CONFIG"); dir != "" {
+		return dir, nil
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".docker"), nil
+}
+
+// loadDockerContext loads the connection settings of the named Docker CLI
+// context from the context store, in the same way the Docker CLI does. The
+// "default" context uses the environment, so it returns an empty endpoint.
+func loadDockerContext(name string) (ep dockerEndpoint, skipVerify bool, err error) {
+	if name == "default" {
+		return ep, false, nil
+	}
+
+	configDir, err := dockerConfigDir()
+	if err != nil {
+		return ep, false, err
+	}
+
+	// The Docker CLI stores contexts in directories named
+	// after the SHA-256 hash of the context name.
+	hash := sha256.Sum256([]byte(name))
+	id := hex.EncodeToString(hash[:])
+
+	data, err := os.ReadFile(filepath.Join(configDir, "contexts", "meta", id, "meta.json"))
+	if errors.Is(err, os.ErrNotExist) {
+		return ep, false, fmt.Errorf("docker context %q not found", name)
+	} else if err != nil {
+		return ep, false, err
+	}
+
+	var meta dockerContextMeta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return ep, false, fmt.Errorf("docker context %q: %w", name, err)
+	}
+
+	dockerEp, ok := meta.Endpoints["docker"]
+	if !ok {
+		return ep, false, fmt.Errorf("docker context %q has no docker endpoint", name)
+	}
+	ep.Host = &dockerEp.Host
+
+	tlsDir := filepath.Join(configDir, "contexts", "tls", id, "docker")
+	ep.TLSCACert = dockerContextFile(tlsDir, "ca.pem")
+	ep.TLSCert = dockerContextFile(tlsDir, "cert.pem")
+	ep.TLSKey = dockerContextFile(tlsDir, "key.pem")
+
+	return ep, dockerEp.SkipTLSVerify, nil
+}
+
+// dockerContextFile returns the path to a file in a context's TLS
+// directory, or nil if the file doesn't exist.
+func dockerContextFile(dir, name string) *string {
+	path := filepath.Join(dir, name)
+	if _, err := os.Stat(path); err != nil {
+		return nil
+	}
+	return &path
+}
@@ -0,0 +1,184 @@
+/*
+ * Seashell - SSH server with virtual hosts and username-based routing
+ *
+ * Copyright (C) 2024 Elara6331 <elara@elara.ws>
+ *
+ * This file is part of Seashell.
+ *
+ * Seashell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * Seashell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with Seashell.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package backends
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/docker/go-units"
+	"github.com/gliderlabs/ssh"
+	"github.com/moby/moby/client"
+	"go.elara.ws/seashell/internal/router"
+	"go.elara.ws/seashell/internal/sshctx"
+)
+
+// dockerRunEphemeral creates a new container from the given image, attaches the
+// SSH session to it, and removes it once the session ends. The image is pulled
+// if it doesn't exist locally.
+func dockerRunEphemeral(sess ssh.Session, c *client.Client, opts dockerSettings, img string) error {
+	user, _ := sshctx.GetUser(sess.Context())
+	pty, resizeCh, isPty := sess.Pty()
+
+	cmd := sess.Command()
+	if len(cmd) == 0 {
+		cmd = ctyTupleToStrings(opts.Command)
+	}
+
+	env, workdir, err := dockerExecEnv(sess, opts, img)
+	if err != nil {
+		return err
+	}
+	if isPty {
+		env = append(env, "TERM="+pty.Term)
+	}
+
+	data := newTemplateData(sess, img)
+	mounts := ctyTupleToStrings(opts.Mounts)
+	for i, mount := range mounts {
+		mounts[i], err = expandTemplate("mounts", mount, data)
+		if err != nil {
+			return err
+		}
+	}
+
+	var resources container.Resources
+	if opts.MemoryLimit != nil {
+		resources.Memory, err = units.RAMInBytes(*opts.MemoryLimit)
+		if err != nil {
+			return err
+		}
+	}
+	if opts.CPULimit != nil {
+		resources.NanoCPUs = int64(*opts.CPULimit * 1e9)
+	}
+	resources.PidsLimit = opts.PidsLimit
+
+	cfg := &container.Config{
+		Image:        img,
+		Cmd:          cmd,
+		Env:          env,
+		WorkingDir:   workdir,
+		User:         valueOr(opts.User, ""),
+		Tty:          isPty,
+		OpenStdin:    true,
+		StdinOnce:    true,
+		AttachStdin:  true,
+		AttachStdout: true,
+		AttachStderr: true,
+		Labels:       map[string]string{"ws.elara.seashell.user": user.Name},
+	}
+
+	hostCfg := &container.HostConfig{
+		Binds:       mounts,
+		Privileged:  valueOr(opts.Privileged, false),
+		NetworkMode: container.NetworkMode(valueOr(opts.Network, "")),
+		Resources:   resources,
+	}
+
+	resp, err := c.ContainerCreate(sess.Context(), cfg, hostCfg, nil, nil, "")
+	if client.IsErrNotFound(err) {
+		err = dockerPullImage(sess, c, img)
+		if err != nil {
+			return err
+		}
+		resp, err = c.ContainerCreate(sess.Context(), cfg, hostCfg, nil, nil, "")
+	}
+	if err != nil {
+		return err
+	}
+	// The session context is canceled once the client disconnects,
+	// so a new context is used to remove the container.
+	defer c.ContainerRemove(context.Background(), resp.ID, container.RemoveOptions{Force: true})
+
+	hr, err := c.ContainerAttach(sess.Context(), resp.ID, container.AttachOptions{
+		Stream: true,
+		Stdin:  true,
+		Stdout: true,
+		Stderr: true,
+	})
+	if err != nil {
+		return err
+	}
+	defer hr.Close()
+
+	// The wait has to be set up before the container is started,
+	// otherwise it could exit before the wait begins.
+	waitCh, errCh := c.ContainerWait(sess.Context(), resp.ID, container.WaitConditionNextExit)
+
+	err = c.ContainerStart(sess.Context(), resp.ID, container.StartOptions{})
+	if err != nil {
+		return err
+	}
+
+	if isPty {
+		go func() {
+			for newSize := range resizeCh {
+				c.ContainerResize(sess.Context(), resp.ID, container.ResizeOptions{
+					Height: uint(newSize.Height),
+					Width:  uint(newSize.Width),
+				})
+			}
+		}()
+	}
+
+	go func() {
+		io.Copy(hr.Conn, sess)
+		hr.CloseWrite()
+	}()
+
+	if isPty {
+		io.Copy(sess, hr.Reader)
+	} else {
+		stdcopy.StdCopy(sess, sess.Stderr(), hr.Reader)
+	}
+
+	select {
+	case status := <-waitCh:
+		if status.Error != nil {
+			return fmt.Errorf("container exited with error: %s", status.Error.Message)
+		}
+		return router.ExitStatus(int(status.StatusCode))
+	case err := <-errCh:
+		return err
+	}
+}
+
+// dockerPullImage pulls an image, letting the user know
+// that it's happening since it may take a while.
+func dockerPullImage(sess ssh.Session, c *client.Client, img string) error {
+	fmt.Fprintf(sess.Stderr(), "Pulling image %s...\r\n", img)
+
+	rc, err := c.ImagePull(sess.Context(), img, image.PullOptions{})
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	// The pull only finishes once the progress stream has been read
+	_, err = io.Copy(io.Discard, rc)
+	return err
+}
@@ -22,10 +22,19 @@
 package backends
 
 import (
+	"cmp"
+	"context"
 	"errors"
 	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"path"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/gliderlabs/ssh"
 	"github.com/hashicorp/nomad/api"
@@ -38,17 +47,38 @@ import (
 
 // nomadSettings represents settings for the nomad backend.
 type nomadSettings struct {
-	Server    string     `cty:"server"`
-	Delimiter *string    `cty:"delimeter"`
-	Region    *string    `cty:"region"`
-	Namespace *string    `cty:"namespace"`
-	AuthToken *string    `cty:"auth_token"`
-	Command   *cty.Value `cty:"command"`
+	Server            string     `cty:"server"`
+	Delimiter         *string    `cty:"delimiter"`
+	OldDelimiter      *string    `cty:"delimeter"`
+	Region            *string    `cty:"region"`
+	Regions           *cty.Value `cty:"regions"`
+	Namespace         *string    `cty:"namespace"`
+	Namespaces        *cty.Value `cty:"namespaces"`
+	AuthToken         *string    `cty:"auth_token"`
+	AuthTokenFile     *string    `cty:"auth_token_file"`
+	VaultAuthToken    *string    `cty:"vault_auth_token"`
+	TokenMap          *cty.Value `cty:"token_map"`
+	VaultTokenMap     *cty.Value `cty:"vault_token_map"`
+	LoginMethod       *string    `cty:"login_method"`
+	LoginJWT          *string    `cty:"login_jwt"`
+	LoginJWTFile      *string    `cty:"login_jwt_file"`
+	AllocFilter       *cty.Value `cty:"alloc_filter"`
+	ReconnectAttempts *int       `cty:"reconnect_attempts"`
+	ReconnectDelay    *string    `cty:"reconnect_delay"`
+	Command           *cty.Value `cty:"command"`
+	RateLimit         *int       `cty:"rate_limit"`
+	CACert            *string    `cty:"ca_cert"`
+	ClientCert        *string    `cty:"client_cert"`
+	ClientKey         *string    `cty:"client_key"`
+	TLSServerName     *string    `cty:"tls_server_name"`
+	TLSSkipVerify     *bool      `cty:"tls_skip_verify"`
 }
 
 // Nomad is the nomad backend. It returns a handler that connects
 // to a Nomad task and executes commands via an SSH session.
 func Nomad(route config.Route) router.Handler {
+	logins := &nomadLoginCache{}
+	clients := &nomadClientCache{}
 	return func(sess ssh.Session, arg string) error {
 		user, _ := sshctx.GetUser(sess.Context())
 
@@ -57,31 +87,79 @@ func Nomad(route config.Route) router.Handler {
 		if err != nil {
 			return err
 		}
+		sess = limitSession(sess, opts.RateLimit)
 
-		_, resizeCh, ok := sess.Pty()
-		if !ok {
-			return errors.New("this route only accepts pty sessions (try adding the -t flag)")
+		token, err := nomadToken(sess.Context(), opts, user, logins)
+		if err != nil {
+			return err
 		}
+		opts.AuthToken = &token
 
-		c, err := api.NewClient(&api.Config{
-			Address:   opts.Server,
-			Region:    valueOr(opts.Region, ""),
-			Namespace: valueOr(opts.Namespace, ""),
-		})
+		delimiter := routeDelimiter(opts.Delimiter, opts.OldDelimiter)
+
+		if prefix, ok := parseCompleteCommand(sess.Command(), arg); ok {
+			return nomadComplete(sess, route, opts, clients, delimiter, prefix)
+		}
+
+		var scope []string
+		for _, seg := range nomadSegments(opts) {
+			var val string
+			val, arg, err = nomadCutSegment(route, user, arg, delimiter, seg.kind, seg.allowed)
+			if err != nil {
+				return err
+			}
+			seg.set(&opts, val)
+			scope = append(scope, seg.kind+":"+val)
+		}
+
+		if err := router.InjectDialFailure(route.Chaos); err != nil {
+			return err
+		}
+
+		c, err := clients.get(opts, user.Name)
 		if err != nil {
 			return err
 		}
 
-		delimeter := valueOr(opts.Delimiter, ".")
-		args := strings.Split(arg, delimeter)
+		args := strings.Split(arg, delimiter)
 
-		allocList, _, err := c.Jobs().Allocations(args[0], false, nil)
+		// Check the job first so that users can't list
+		// allocations of jobs they don't have access to
+		if !route.Permissions.IsAllowed(user, append(scope, "job:"+args[0])...) {
+			return router.ErrUnauthorized
+		}
+
+		filter, err := parseNomadAllocFilter(ctyObjToStringMap(opts.AllocFilter))
+		if err != nil {
+			return err
+		}
+
+		alloc, group, taskName, err := nomadResolveTask(sess, c, args, filter)
 		if err != nil {
 			return err
 		}
 
-		if len(allocList) == 0 {
-			return fmt.Errorf("job %q has no allocations", args[0])
+		if !route.Permissions.IsAllowed(
+			user,
+			append(
+				scope,
+				"job:"+args[0],
+				"task:"+taskName,
+				"group:"+valueOr(group.Name, "unknown"),
+			)...,
+		) {
+			return router.ErrUnauthorized
+		}
+
+		if sess.Subsystem() == "sftp" {
+			return serveSFTP(sess, nomadFS{c, alloc})
+		}
+
+		if cc, ok, err := parseCopyCommand(sess.Command()); ok {
+			if err != nil {
+				return err
+			}
+			return handleCopy(sess, cc, nomadCopier{c, alloc, taskName})
 		}
 
 		cmd := sess.Command()
@@ -92,135 +170,635 @@ func Nomad(route config.Route) router.Handler {
 			}
 		}
 
-		switch len(args) {
-		case 1:
-			alloc, _, err := c.Allocations().Info(allocList[0].ID, nil)
-			if err != nil {
-				return err
-			}
-			task := alloc.Job.TaskGroups[0].Tasks[0]
+		code, err := nomadExec(sess, c, alloc, taskName, cmd, opts)
+		if err != nil {
+			return err
+		}
+		return router.ExitStatus(code)
+	}
+}
 
-			if !route.Permissions.IsAllowed(
-				user,
-				"job:"+args[0],
-				"task:"+task.Name,
-				"group:"+valueOr(alloc.Job.TaskGroups[0].Name, "unknown"),
-			) {
-				return router.ErrUnauthorized
-			}
+// nomadComplete writes the jobs, or the groups and tasks of a job, that the
+// user can access and that start with prefix. Jobs are completed until the
+// prefix contains a delimiter, and then the job's groups and tasks are
+// completed in the job.group.task form. If the route allows choosing the
+// region or namespace, those are completed first.
+func nomadComplete(sess ssh.Session, route config.Route, opts nomadSettings, clients *nomadClientCache, delimiter, prefix string) error {
+	user, _ := sshctx.GetUser(sess.Context())
+	q := (&api.QueryOptions{}).WithContext(sess.Context())
 
-			sizeCh := make(chan api.TerminalSize)
-			go nomadHandleResize(resizeCh, sizeCh)
-			_, err = c.Allocations().Exec(sess.Context(), alloc, task.Name, true, cmd, sess, sess, sess.Stderr(), sizeCh, nil)
-			return err
-		case 2:
-			alloc, _, err := c.Allocations().Info(allocList[0].ID, nil)
+	var scope []string
+	var outPrefix string
+	for _, seg := range nomadSegments(opts) {
+		val, rest, ok := strings.Cut(prefix, delimiter)
+		if !ok {
+			c, err := clients.get(opts, user.Name)
 			if err != nil {
 				return err
 			}
-			group := alloc.Job.TaskGroups[0]
-			for _, task := range group.Tasks {
-				if task.Name != args[1] {
-					continue
-				}
-
-				if !route.Permissions.IsAllowed(
-					user,
-					"job:"+args[0],
-					"task:"+task.Name,
-					"group:"+valueOr(group.Name, "unknown"),
-				) {
-					return router.ErrUnauthorized
-				}
 
-				sizeCh := make(chan api.TerminalSize)
-				go nomadHandleResize(resizeCh, sizeCh)
-				_, err = c.Allocations().Exec(sess.Context(), alloc, task.Name, true, cmd, sess, sess, sess.Stderr(), sizeCh, nil)
-				return err
-			}
-			return errors.New("task not found")
-		case 3:
-			alloc, _, err := c.Allocations().Info(allocList[0].ID, nil)
+			names, err := seg.list(c, q)
 			if err != nil {
 				return err
 			}
 
-			group := alloc.Job.LookupTaskGroup(args[1])
-			if group == nil {
-				return errors.New("task group not found")
+			var candidates []string
+			for _, name := range names {
+				if nomadSegmentAllowed(seg.allowed, name) && route.Permissions.IsAllowed(user, append(scope, seg.kind+":"+name)...) {
+					candidates = append(candidates, outPrefix+name+delimiter)
+				}
 			}
+			return writeCompletions(sess, outPrefix+prefix, candidates)
+		}
 
-			taskName := args[2]
-			if taskName == "" {
-				taskName = group.Tasks[0].Name
-			}
+		_, _, err := nomadCutSegment(route, user, prefix, delimiter, seg.kind, seg.allowed)
+		if err != nil {
+			return err
+		}
 
-			if !route.Permissions.IsAllowed(
-				user,
-				"job:"+args[0],
-				"task:"+taskName,
-				"group:"+valueOr(group.Name, "unknown"),
-			) {
-				return router.ErrUnauthorized
-			}
+		seg.set(&opts, val)
+		scope = append(scope, seg.kind+":"+val)
+		outPrefix += val + delimiter
+		prefix = rest
+	}
 
-			sizeCh := make(chan api.TerminalSize)
-			go nomadHandleResize(resizeCh, sizeCh)
-			_, err = c.Allocations().Exec(sess.Context(), alloc, taskName, true, cmd, sess, sess, sess.Stderr(), sizeCh, nil)
+	c, err := clients.get(opts, user.Name)
+	if err != nil {
+		return err
+	}
+
+	var candidates []string
+	jobName, _, ok := strings.Cut(prefix, delimiter)
+	if !ok {
+		jobs, _, err := c.Jobs().PrefixList(prefix)
+		if err != nil {
 			return err
-		case 4:
-			allocID := args[1]
-			if index, err := strconv.Atoi(args[1]); err == nil && index < len(allocList) {
-				allocID = allocList[index].ID
+		}
+
+		for _, job := range jobs {
+			if route.Permissions.IsAllowed(user, append(scope, "job:"+job.ID)...) {
+				candidates = append(candidates, outPrefix+job.ID)
 			}
+		}
+		return writeCompletions(sess, outPrefix+prefix, candidates)
+	}
 
-			alloc, _, err := c.Allocations().Info(allocID, nil)
-			if err != nil {
-				return err
+	if !route.Permissions.IsAllowed(user, append(scope, "job:"+jobName)...) {
+		return router.ErrUnauthorized
+	}
+
+	job, _, err := c.Jobs().Info(jobName, q)
+	if err != nil {
+		return err
+	}
+
+	for _, group := range job.TaskGroups {
+		groupName := valueOr(group.Name, "")
+		for _, task := range group.Tasks {
+			if route.Permissions.IsAllowed(user, append(scope, "group:"+groupName, "task:"+task.Name)...) {
+				candidates = append(candidates, outPrefix+strings.Join([]string{jobName, groupName, task.Name}, delimiter))
 			}
+		}
+	}
+
+	return writeCompletions(sess, outPrefix+prefix, candidates)
+}
+
+// nomadSegment represents a leading segment of the route argument that
+// selects where the job is, such as the region or namespace.
+type nomadSegment struct {
+	kind    string
+	allowed []string
+	set     func(*nomadSettings, string)
+	list    func(*api.Client, *api.QueryOptions) ([]string, error)
+}
+
+// nomadSegments returns the leading segments enabled in the settings, in
+// the order they appear in the argument, e.x. region.namespace.job.
+func nomadSegments(opts nomadSettings) []nomadSegment {
+	var out []nomadSegment
 
-			var group *api.TaskGroup
-			if args[2] == "" {
-				group = alloc.Job.TaskGroups[0]
-			} else {
-				group = alloc.Job.LookupTaskGroup(args[2])
-				if group == nil {
-					return errors.New("task group not found")
+	if opts.Regions != nil {
+		out = append(out, nomadSegment{
+			kind:    "region",
+			allowed: ctyTupleToStrings(opts.Regions),
+			set:     func(opts *nomadSettings, val string) { opts.Region = &val },
+			list: func(c *api.Client, _ *api.QueryOptions) ([]string, error) {
+				return c.Regions().List()
+			},
+		})
+	}
+
+	if opts.Namespaces != nil {
+		out = append(out, nomadSegment{
+			kind:    "namespace",
+			allowed: ctyTupleToStrings(opts.Namespaces),
+			set:     func(opts *nomadSettings, val string) { opts.Namespace = &val },
+			list: func(c *api.Client, q *api.QueryOptions) ([]string, error) {
+				namespaces, _, err := c.Namespaces().List(q)
+				if err != nil {
+					return nil, err
 				}
-			}
 
-			taskName := args[3]
-			if taskName == "" {
-				taskName = group.Tasks[0].Name
-			}
+				names := make([]string, len(namespaces))
+				for i, ns := range namespaces {
+					names[i] = ns.Name
+				}
+				return names, nil
+			},
+		})
+	}
 
-			if !route.Permissions.IsAllowed(
-				user,
-				"job:"+args[0],
-				"task:"+taskName,
-				"group:"+valueOr(group.Name, "unknown"),
-			) {
-				return router.ErrUnauthorized
-			}
+	return out
+}
 
-			sizeCh := make(chan api.TerminalSize)
-			go nomadHandleResize(resizeCh, sizeCh)
-			_, err = c.Allocations().Exec(sess.Context(), alloc, taskName, true, cmd, sess, sess, sess.Stderr(), sizeCh, nil)
-			return err
+// nomadCutSegment cuts a leading segment, such as a namespace, from arg.
+// The segment must match one of the allowed patterns, and the user must
+// have permission for the kind:value item.
+func nomadCutSegment(route config.Route, user config.User, arg, delimiter, kind string, allowed []string) (string, string, error) {
+	val, rest, ok := strings.Cut(arg, delimiter)
+	if !ok {
+		return "", "", fmt.Errorf("this route requires a %s, e.x. %s%sjob", kind, kind, delimiter)
+	}
+
+	if !nomadSegmentAllowed(allowed, val) {
+		return "", "", fmt.Errorf("%s %q isn't available on this route", kind, val)
+	}
+
+	if !route.Permissions.IsAllowed(user, kind+":"+val) {
+		return "", "", router.ErrUnauthorized
+	}
+
+	return val, rest, nil
+}
+
+// nomadSegmentAllowed checks whether val matches any of the allowed patterns.
+func nomadSegmentAllowed(allowed []string, val string) bool {
+	return slices.ContainsFunc(allowed, func(pattern string) bool {
+		matched, _ := path.Match(pattern, val)
+		return matched
+	})
+}
+
+// nomadClientCache keeps one Nomad API client for each combination of
+// region, namespace, and user, so that connections to the Nomad servers
+// can be reused across sessions. Each client uses the token the user had
+// when it was created, and it's replaced once their token changes, for
+// example when a JWT is renewed, so that old tokens don't pile up.
+type nomadClientCache struct {
+	mu      sync.Mutex
+	clients map[nomadClientKey]nomadCachedClient
+}
+
+// nomadClientKey identifies a client in a nomadClientCache.
+type nomadClientKey struct {
+	region    string
+	namespace string
+	user      string
+}
+
+// nomadCachedClient is a client in a nomadClientCache,
+// along with the token it was created with.
+type nomadCachedClient struct {
+	token  string
+	client *api.Client
+}
+
+// get returns the client for the given settings and user,
+// creating it if needed.
+func (cc *nomadClientCache) get(opts nomadSettings, user string) (*api.Client, error) {
+	key := nomadClientKey{
+		region:    valueOr(opts.Region, ""),
+		namespace: valueOr(opts.Namespace, ""),
+		user:      user,
+	}
+	token := valueOr(opts.AuthToken, "")
+
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	cached, ok := cc.clients[key]
+	if ok && cached.token == token {
+		return cached.client, nil
+	} else if ok {
+		// Sessions that are still using the old client keep working,
+		// this only closes its idle connections.
+		cached.client.Close()
+	}
+
+	c, err := newNomadClient(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if cc.clients == nil {
+		cc.clients = map[nomadClientKey]nomadCachedClient{}
+	}
+	cc.clients[key] = nomadCachedClient{token: token, client: c}
+	return c, nil
+}
+
+// newNomadClient creates a Nomad API client using the given settings.
+func newNomadClient(opts nomadSettings) (*api.Client, error) {
+	cfg := &api.Config{
+		Address:   opts.Server,
+		Region:    valueOr(opts.Region, ""),
+		Namespace: valueOr(opts.Namespace, ""),
+		SecretID:  valueOr(opts.AuthToken, ""),
+	}
+
+	if opts.CACert != nil || opts.ClientCert != nil || opts.ClientKey != nil || opts.TLSServerName != nil || opts.TLSSkipVerify != nil {
+		cfg.TLSConfig = &api.TLSConfig{
+			CACert:        valueOr(opts.CACert, ""),
+			ClientCert:    valueOr(opts.ClientCert, ""),
+			ClientKey:     valueOr(opts.ClientKey, ""),
+			TLSServerName: valueOr(opts.TLSServerName, ""),
+			Insecure:      valueOr(opts.TLSSkipVerify, false),
+		}
+	}
+
+	return api.NewClient(cfg)
+}
+
+// nomadResolveTask finds the allocation, task group, and task name
+// that the client-provided arguments refer to. If the arguments don't
+// specify an allocation and there are several that could match, the
+// user is asked to choose one.
+//
+// Instead of an allocation index or ID, the allocation argument can
+// contain filters, e.x. node=web1,status=running, which are combined
+// with the filters from the route settings.
+func nomadResolveTask(sess ssh.Session, c *api.Client, args []string, filter nomadAllocFilter) (*api.Allocation, *api.TaskGroup, string, error) {
+	var allocID, groupName, taskName string
+	switch len(args) {
+	case 1:
+	case 2:
+		taskName = args[1]
+	case 3:
+		groupName, taskName = args[1], args[2]
+	case 4:
+		allocID, groupName, taskName = args[1], args[2], args[3]
+	default:
+		return nil, nil, "", errors.New("too many arguments")
+	}
+
+	if strings.Contains(allocID, "=") {
+		argFilter, err := parseNomadAllocFilter(parseNomadFilterArg(allocID))
+		if err != nil {
+			return nil, nil, "", err
+		}
+		filter = filter.merge(argFilter)
+		allocID = ""
+	}
+
+	allocList, _, err := c.Jobs().Allocations(args[0], false, nil)
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	if len(allocList) == 0 {
+		return nil, nil, "", fmt.Errorf("job %q has no allocations", args[0])
+	}
+
+	allocList, err = filter.apply(c, allocList)
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	if allocID != "" {
+		allocID, err = nomadFindAlloc(args[0], allocID, allocList)
+		if err != nil {
+			return nil, nil, "", err
+		}
+	} else {
+		if groupName != "" {
+			allocList = slices.DeleteFunc(allocList, func(stub *api.AllocationListStub) bool {
+				return stub.TaskGroup != groupName
+			})
+		}
+
+		allocID, err = nomadPickAlloc(sess, args[0], allocList)
+		if err != nil {
+			return nil, nil, "", err
+		}
+	}
+
+	alloc, _, err := c.Allocations().Info(allocID, nil)
+	if err != nil {
+		return nil, nil, "", err
+	} else if alloc.JobID != args[0] {
+		// Permissions are checked against the job,
+		// so the allocation must belong to it.
+		return nil, nil, "", fmt.Errorf("allocation %q doesn't belong to job %q", allocID, args[0])
+	}
+
+	if groupName == "" {
+		groupName = alloc.TaskGroup
+	}
+
+	group := alloc.Job.LookupTaskGroup(groupName)
+	if group == nil {
+		return nil, nil, "", errors.New("task group not found")
+	}
+
+	if taskName == "" {
+		return alloc, group, group.Tasks[0].Name, nil
+	}
+
+	for _, task := range group.Tasks {
+		if task.Name == taskName {
+			return alloc, group, taskName, nil
+		}
+	}
+	return nil, nil, "", errors.New("task not found")
+}
+
+// nomadFindAlloc returns the ID of the allocation in allocList that arg
+// refers to, either by its index in the list or by its full or short ID.
+// Allocations that aren't in the list, like ones from other jobs or ones
+// excluded by the filters, can't be selected.
+func nomadFindAlloc(job, arg string, allocList []*api.AllocationListStub) (string, error) {
+	if index, err := strconv.Atoi(arg); err == nil {
+		if index < 0 || index >= len(allocList) {
+			return "", fmt.Errorf("job %q has no allocation with index %d", job, index)
+		}
+		return allocList[index].ID, nil
+	}
+
+	var found string
+	for _, stub := range allocList {
+		if !strings.HasPrefix(stub.ID, arg) {
+			continue
+		} else if found != "" {
+			return "", fmt.Errorf("%q matches multiple allocations of job %q", arg, job)
+		}
+		found = stub.ID
+	}
+
+	if found == "" {
+		return "", fmt.Errorf("no allocation of job %q matches %q", job, arg)
+	}
+	return found, nil
+}
+
+// nomadPickAlloc returns the ID of the only allocation in allocList, or
+// asks the user to choose one if there are several.
+func nomadPickAlloc(sess ssh.Session, job string, allocList []*api.AllocationListStub) (string, error) {
+	switch len(allocList) {
+	case 0:
+		return "", fmt.Errorf("job %q has no matching allocations", job)
+	case 1:
+		return allocList[0].ID, nil
+	}
+
+	items := make([]string, len(allocList))
+	for i, stub := range allocList {
+		items[i] = fmt.Sprintf("%s  %-20s  %-8s  %s", stub.ID[:8], stub.NodeName, stub.ClientStatus, stub.TaskGroup)
+	}
+
+	if _, _, ok := sess.Pty(); !ok {
+		return "", fmt.Errorf("job %q has multiple allocations, specify one by index or ID:\r\n  %s", job, strings.Join(items, "\r\n  "))
+	}
+
+	i, err := pickItem(sess, fmt.Sprintf("Job %q has multiple allocations", job), items)
+	if err != nil {
+		return "", err
+	}
+	return allocList[i].ID, nil
+}
+
+// nomadAllocFilter selects allocations by node name, datacenter, and
+// client status. Each field is a glob pattern, and empty fields match
+// any allocation.
+type nomadAllocFilter struct {
+	Node       string
+	Datacenter string
+	Status     string
+}
+
+// parseNomadAllocFilter creates an allocation filter from a map of
+// filter names to patterns.
+func parseNomadAllocFilter(m map[string]string) (f nomadAllocFilter, err error) {
+	for key, val := range m {
+		switch key {
+		case "node":
+			f.Node = val
+		case "datacenter", "dc":
+			f.Datacenter = val
+		case "status":
+			f.Status = val
+		default:
+			return f, fmt.Errorf("unknown allocation filter: %q", key)
 		}
+	}
+	return f, nil
+}
+
+// parseNomadFilterArg parses allocation filters written
+// in an argument, e.x. node=web1,status=running.
+func parseNomadFilterArg(arg string) map[string]string {
+	out := map[string]string{}
+	for _, item := range strings.Split(arg, ",") {
+		key, val, _ := strings.Cut(item, "=")
+		out[key] = val
+	}
+	return out
+}
+
+// merge returns a copy of f with any fields set in o replaced.
+func (f nomadAllocFilter) merge(o nomadAllocFilter) nomadAllocFilter {
+	f.Node = cmp.Or(o.Node, f.Node)
+	f.Datacenter = cmp.Or(o.Datacenter, f.Datacenter)
+	f.Status = cmp.Or(o.Status, f.Status)
+	return f
+}
+
+// apply removes the allocations that don't match the filter. Allocation
+// list stubs don't include the datacenter, so the node list is fetched
+// if there's a datacenter filter.
+func (f nomadAllocFilter) apply(c *api.Client, allocList []*api.AllocationListStub) ([]*api.AllocationListStub, error) {
+	if f == (nomadAllocFilter{}) {
+		return allocList, nil
+	}
+
+	datacenters := map[string]string{}
+	if f.Datacenter != "" {
+		nodes, _, err := c.Nodes().List(nil)
+		if err != nil {
+			return nil, err
+		}
+		for _, node := range nodes {
+			datacenters[node.ID] = node.Datacenter
+		}
+	}
+
+	return slices.DeleteFunc(allocList, func(stub *api.AllocationListStub) bool {
+		return !nomadFilterMatch(f.Node, stub.NodeName) ||
+			!nomadFilterMatch(f.Datacenter, datacenters[stub.NodeID]) ||
+			!nomadFilterMatch(f.Status, stub.ClientStatus)
+	}), nil
+}
+
+// nomadFilterMatch checks whether val matches the given filter pattern.
+func nomadFilterMatch(pattern, val string) bool {
+	if pattern == "" {
+		return true
+	}
+	matched, _ := path.Match(pattern, val)
+	return matched
+}
+
+// nomadCopier implements seashell cp for Nomad tasks. Paths are relative to
+// the allocation directory, just like with `nomad alloc fs`.
+type nomadCopier struct {
+	c        *api.Client
+	alloc    *api.Allocation
+	taskName string
+}
+
+// CopyTo uploads a file to the task. Nomad's filesystem API is read-only,
+// so this executes cat in the task to write the file instead.
+func (nc nomadCopier) CopyTo(ctx context.Context, path string, r io.Reader) error {
+	cmd := []string{"/bin/sh", "-c", `cat > "$1"`, "sh", path}
+	code, err := nc.c.Allocations().Exec(ctx, nc.alloc, nc.taskName, false, cmd, r, io.Discard, io.Discard, nil, nil)
+	if err != nil {
+		return err
+	}
+	if code != 0 {
+		return fmt.Errorf("writing %q failed with exit code %d", path, code)
+	}
+	return nil
+}
+
+// CopyFrom downloads a file from the allocation filesystem.
+func (nc nomadCopier) CopyFrom(ctx context.Context, path string, w io.Writer) error {
+	rc, err := nc.c.AllocFS().Cat(nc.alloc, path, (&api.QueryOptions{}).WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	_, err = io.Copy(w, rc)
+	return err
+}
+
+// nomadFS implements a read-only SFTP subsystem for Nomad allocations.
+// Paths are relative to the allocation directory, just like with
+// `nomad alloc fs`.
+type nomadFS struct {
+	c     *api.Client
+	alloc *api.Allocation
+}
 
-		return nil
+// Stat returns information about a file in the allocation directory.
+func (nfs nomadFS) Stat(ctx context.Context, name string) (fs.FileInfo, error) {
+	info, _, err := nfs.c.AllocFS().Stat(nfs.alloc, name, (&api.QueryOptions{}).WithContext(ctx))
+	if err != nil {
+		return nil, nomadFSError("stat", name, err)
 	}
+	return nomadFileInfo{info}, nil
 }
 
-// nomadHandleResize resizes the Nomad pseudo-tty whenever it receives
-// a client resize event over SSH.
-func nomadHandleResize(resizeCh <-chan ssh.Window, sizeCh chan<- api.TerminalSize) {
-	defer close(sizeCh)
-	for newSize := range resizeCh {
-		sizeCh <- api.TerminalSize{
-			Height: newSize.Height,
-			Width:  newSize.Width,
+// ReadDir lists a directory in the allocation directory.
+func (nfs nomadFS) ReadDir(ctx context.Context, name string) ([]fs.FileInfo, error) {
+	files, _, err := nfs.c.AllocFS().List(nfs.alloc, name, (&api.QueryOptions{}).WithContext(ctx))
+	if err != nil {
+		return nil, nomadFSError("readdir", name, err)
+	}
+
+	out := make([]fs.FileInfo, len(files))
+	for i, info := range files {
+		out[i] = nomadFileInfo{info}
+	}
+	return out, nil
+}
+
+// Open opens a file in the allocation directory for reading.
+func (nfs nomadFS) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	rc, err := nfs.c.AllocFS().Cat(nfs.alloc, name, (&api.QueryOptions{}).WithContext(ctx))
+	return rc, nomadFSError("open", name, err)
+}
+
+// OpenReaderAt opens a file in the allocation directory for random access
+// reads, which lets clients download parts of large log files without
+// seashell having to read the whole file.
+func (nfs nomadFS) OpenReaderAt(ctx context.Context, name string) (io.ReaderAt, error) {
+	info, err := nfs.Stat(ctx, name)
+	if err != nil {
+		return nil, err
+	} else if info.IsDir() {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: errors.New("is a directory")}
+	}
+	return nomadReaderAt{nfs, ctx, name}, nil
+}
+
+// nomadReaderAt reads parts of a file using the ReadAt
+// endpoint of the Nomad allocation filesystem API.
+type nomadReaderAt struct {
+	nfs  nomadFS
+	ctx  context.Context
+	name string
+}
+
+// ReadAt reads len(p) bytes from the file starting at off.
+func (nr nomadReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	rc, err := nr.nfs.c.AllocFS().ReadAt(nr.nfs.alloc, nr.name, off, int64(len(p)), (&api.QueryOptions{}).WithContext(nr.ctx))
+	if err != nil {
+		return 0, err
+	}
+	defer rc.Close()
+
+	n, err := io.ReadFull(rc, p)
+	if errors.Is(err, io.ErrUnexpectedEOF) || (n == 0 && errors.Is(err, io.EOF)) {
+		return n, io.EOF
+	}
+	return n, err
+}
+
+// nomadFSError converts Nomad "not found" errors into
+// errors that the SFTP server recognizes.
+func nomadFSError(op, name string, err error) error {
+	var respErr api.UnexpectedResponseError
+	if errors.As(err, &respErr) && respErr.StatusCode() == http.StatusNotFound {
+		return &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	if err != nil && strings.Contains(err.Error(), "no such file or directory") {
+		return &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	return err
+}
+
+// nomadFileInfo implements fs.FileInfo for Nomad allocation files.
+type nomadFileInfo struct {
+	info *api.AllocFileInfo
+}
+
+func (fi nomadFileInfo) Name() string       { return fi.info.Name }
+func (fi nomadFileInfo) Size() int64        { return fi.info.Size }
+func (fi nomadFileInfo) ModTime() time.Time { return fi.info.ModTime }
+func (fi nomadFileInfo) IsDir() bool        { return fi.info.IsDir }
+func (fi nomadFileInfo) Sys() any           { return nil }
+
+// Mode parses the permission bits from the file mode string
+// returned by Nomad, e.x. -rw-r--r--.
+func (fi nomadFileInfo) Mode() fs.FileMode {
+	var mode fs.FileMode
+	if fi.info.IsDir {
+		mode |= fs.ModeDir
+	}
+
+	perms := fi.info.FileMode
+	if len(perms) < 9 {
+		if fi.info.IsDir {
+			return mode | 0o755
+		}
+		return mode | 0o644
+	}
+
+	perms = perms[len(perms)-9:]
+	for i, c := range perms {
+		if c != '-' {
+			mode |= 1 << (8 - i)
 		}
 	}
+	return mode
 }
@@ -0,0 +1,124 @@
+/*
+ * Seashell - SSH server with virtual hosts and username-based routing
+ *
+ * Copyright (C) 2024 Elara6331 <elara@elara.ws>
+ *
+ * This file is part of Seashell.
+ *
+ * Seashell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * Seashell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with Seashell.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package backends
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/nomad/api"
+	"go.elara.ws/seashell/internal/config"
+	"go.elara.ws/seashell/internal/vault"
+)
+
+// nomadToken returns the Nomad ACL token for the given user. Tokens can be
+// mapped to users or groups with the token_map and vault_token_map settings,
+// so that actions in Nomad are attributed to the person performing them.
+// If there's no entry for the user, the route's token is used, which is
+// either obtained by logging in with login_method or set statically.
+func nomadToken(ctx context.Context, opts nomadSettings, user config.User, logins *nomadLoginCache) (string, error) {
+	if ref, ok := lookupUserMap(ctyObjToStringMap(opts.VaultTokenMap), user); ok {
+		return vault.Default().ReadField(ctx, ref)
+	}
+
+	if token, ok := lookupUserMap(ctyObjToStringMap(opts.TokenMap), user); ok {
+		return token, nil
+	}
+
+	if opts.LoginMethod != nil {
+		return logins.token(ctx, opts)
+	}
+
+	if opts.VaultAuthToken != nil {
+		return vault.Default().ReadField(ctx, *opts.VaultAuthToken)
+	}
+
+	if opts.AuthTokenFile != nil {
+		return readSecretFile(*opts.AuthTokenFile)
+	}
+
+	return valueOr(opts.AuthToken, ""), nil
+}
+
+// nomadLoginCache caches the token obtained by logging in to Nomad with
+// a JWT auth method, so that seashell doesn't log in for every session.
+// The token is renewed by logging in again shortly before it expires.
+type nomadLoginCache struct {
+	mu       sync.Mutex
+	secretID string
+	expiry   time.Time
+}
+
+// token returns the cached token, logging in again if there's
+// no token yet or the current one is about to expire.
+func (lc *nomadLoginCache) token(ctx context.Context, opts nomadSettings) (string, error) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	if lc.secretID != "" && (lc.expiry.IsZero() || time.Until(lc.expiry) > time.Minute) {
+		return lc.secretID, nil
+	}
+
+	jwt, err := nomadLoginJWT(opts)
+	if err != nil {
+		return "", err
+	}
+
+	opts.AuthToken = nil
+	c, err := newNomadClient(opts)
+	if err != nil {
+		return "", err
+	}
+
+	token, _, err := c.ACLAuth().Login(&api.ACLLoginRequest{
+		AuthMethodName: *opts.LoginMethod,
+		LoginToken:     jwt,
+	}, (&api.WriteOptions{}).WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+
+	lc.secretID = token.SecretID
+	lc.expiry = time.Time{}
+	if token.ExpirationTime != nil {
+		lc.expiry = *token.ExpirationTime
+	}
+
+	return lc.secretID, nil
+}
+
+// nomadLoginJWT returns the JWT used to log in to Nomad. If it's read
+// from a file, the file is read again on every login, so that tokens
+// rotated by something else, such as a workload identity, are picked up.
+func nomadLoginJWT(opts nomadSettings) (string, error) {
+	if opts.LoginJWT != nil {
+		return *opts.LoginJWT, nil
+	}
+
+	if opts.LoginJWTFile != nil {
+		return readSecretFile(*opts.LoginJWTFile)
+	}
+
+	return "", errors.New("login_method requires login_jwt or login_jwt_file")
+}
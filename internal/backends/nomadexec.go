@@ -0,0 +1,266 @@
+/*
+ * Seashell - SSH server with virtual hosts and username-based routing
+ *
+ * Copyright (C) 2024 Elara6331 <elara@elara.ws>
+ *
+ * This file is part of Seashell.
+ *
+ * Seashell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * Seashell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with Seashell.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package backends
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/hashicorp/nomad/api"
+)
+
+// nomadExec executes cmd in the given task. Sessions without a pty are run
+// without a tty, so that data can be piped in and out of the task.
+//
+// If the connection to Nomad drops during an interactive shell, the shell is
+// started again, up to reconnect_attempts times, so that a short network
+// interruption doesn't end the whole SSH session. Sessions that run a
+// command the client sent are never retried, even with a pty, since running
+// it again could repeat its side effects or duplicate or lose data.
+//
+// Nomad's exec API can't send signals, so signals from the client are
+// forwarded as the corresponding control characters in tty sessions, which
+// makes the remote terminal deliver them. Other signals, and all signals in
+// non-tty sessions, end the exec instead.
+func nomadExec(sess ssh.Session, c *api.Client, alloc *api.Allocation, taskName string, cmd []string, opts nomadSettings) (int, error) {
+	ctx, cancel := context.WithCancel(sess.Context())
+	defer cancel()
+
+	var lastSize atomic.Pointer[api.TerminalSize]
+	var sizeCh chan api.TerminalSize
+	_, resizeCh, isPty := sess.Pty()
+	if isPty {
+		sizeCh = make(chan api.TerminalSize)
+		go nomadHandleResize(resizeCh, sizeCh, &lastSize)
+	}
+
+	attempts := 0
+	if isPty && len(sess.Command()) == 0 {
+		attempts = valueOr(opts.ReconnectAttempts, 3)
+	}
+
+	delay, err := time.ParseDuration(valueOr(opts.ReconnectDelay, "2s"))
+	if err != nil {
+		return 0, err
+	}
+
+	pump := newStdinPump(sess)
+
+	var stopSignal atomic.Pointer[ssh.Signal]
+	go nomadHandleSignals(ctx, sess, isPty, pump, func(sig ssh.Signal) {
+		stopSignal.Store(&sig)
+		cancel()
+	})
+
+	for attempt := 0; ; attempt++ {
+		// A new exec starts with the default terminal size,
+		// so the last known size is sent again.
+		if size := lastSize.Load(); attempt > 0 && size != nil {
+			go func() {
+				select {
+				case sizeCh <- *size:
+				case <-ctx.Done():
+				}
+			}()
+		}
+
+		code, err := c.Allocations().Exec(ctx, alloc, taskName, isPty, cmd, pump.reader(), sess, sess.Stderr(), sizeCh, nil)
+		pump.detach()
+
+		if sig := stopSignal.Load(); sig != nil {
+			// Report the exit status the way shells do for
+			// processes that were killed by a signal
+			return 128 + nomadSignalNumbers[*sig], nil
+		}
+
+		if err == nil || ctx.Err() != nil || attempt >= attempts {
+			return code, err
+		}
+
+		fmt.Fprintf(sess.Stderr(), "\r\nLost connection to Nomad (%s), reconnecting (attempt %d/%d)...\r\n", err, attempt+1, attempts)
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+	}
+}
+
+// nomadSignalChars maps signals to the control characters that
+// make a terminal send them to its foreground process group.
+var nomadSignalChars = map[ssh.Signal]byte{
+	ssh.SIGINT:  0x03, // Ctrl+C
+	ssh.SIGQUIT: 0x1C, // Ctrl+\
+}
+
+// nomadSignalNumbers maps signals to their numbers on Linux, which
+// are used to calculate the exit status of a stopped exec.
+var nomadSignalNumbers = map[ssh.Signal]int{
+	ssh.SIGHUP:  1,
+	ssh.SIGINT:  2,
+	ssh.SIGQUIT: 3,
+	ssh.SIGKILL: 9,
+	ssh.SIGTERM: 15,
+}
+
+// nomadHandleSignals handles signal and break requests from the client until
+// ctx is canceled. In tty sessions, signals that have a control character are
+// written to the exec's stdin, and break requests are treated as Ctrl+C. Any
+// other signal that normally ends a process causes stop to be called.
+func nomadHandleSignals(ctx context.Context, sess ssh.Session, isPty bool, pump *stdinPump, stop func(ssh.Signal)) {
+	sigCh := make(chan ssh.Signal, 1)
+	sess.Signals(sigCh)
+	defer sess.Signals(nil)
+
+	breakCh := make(chan bool, 1)
+	sess.Break(breakCh)
+	defer sess.Break(nil)
+
+	for {
+		var sig ssh.Signal
+		select {
+		case sig = <-sigCh:
+		case <-breakCh:
+			sig = ssh.SIGINT
+		case <-ctx.Done():
+			return
+		}
+
+		if char, ok := nomadSignalChars[sig]; ok && isPty {
+			pump.inject([]byte{char})
+		} else if _, ok := nomadSignalNumbers[sig]; ok {
+			stop(sig)
+		}
+	}
+}
+
+// nomadHandleResize resizes the Nomad pseudo-tty whenever it receives
+// a client resize event over SSH, and stores the last size it received.
+func nomadHandleResize(resizeCh <-chan ssh.Window, sizeCh chan<- api.TerminalSize, lastSize *atomic.Pointer[api.TerminalSize]) {
+	defer close(sizeCh)
+	for newSize := range resizeCh {
+		size := api.TerminalSize{
+			Height: newSize.Height,
+			Width:  newSize.Width,
+		}
+		lastSize.Store(&size)
+		sizeCh <- size
+	}
+}
+
+// stdinPump reads from a session's stdin in the background, so that its
+// input can be handed to several consecutive readers. Without it, a reader
+// from a failed exec could keep consuming input meant for the next one.
+// It also allows extra input, such as control characters, to be injected.
+type stdinPump struct {
+	data     chan []byte
+	injected chan []byte
+	mu       sync.Mutex
+	cur      *pumpReader
+}
+
+// newStdinPump starts reading from the session's stdin in the background.
+func newStdinPump(sess ssh.Session) *stdinPump {
+	p := &stdinPump{data: make(chan []byte), injected: make(chan []byte, 8)}
+	go func() {
+		defer close(p.data)
+		for {
+			buf := make([]byte, 1024)
+			n, err := sess.Read(buf)
+			if n > 0 {
+				select {
+				case p.data <- buf[:n]:
+				case <-sess.Context().Done():
+					return
+				}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return p
+}
+
+// reader returns a new reader that receives the pump's input
+// until detach is called.
+func (p *stdinPump) reader() io.Reader {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.cur = &pumpReader{data: p.data, inject: p.injected, done: make(chan struct{})}
+	return p.cur
+}
+
+// detach stops the current reader from receiving any more input.
+func (p *stdinPump) detach() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.cur != nil {
+		close(p.cur.done)
+		p.cur = nil
+	}
+}
+
+// inject sends data to the current reader as if it had been read
+// from stdin. The data is dropped if the pump is backed up.
+func (p *stdinPump) inject(data []byte) {
+	select {
+	case p.injected <- data:
+	default:
+	}
+}
+
+// pumpReader is a reader attached to a stdinPump.
+type pumpReader struct {
+	data    <-chan []byte
+	inject  <-chan []byte
+	done    chan struct{}
+	pending []byte
+}
+
+// Read reads input from the pump, returning io.EOF once
+// the reader is detached or the input ends.
+func (pr *pumpReader) Read(b []byte) (int, error) {
+	if len(pr.pending) == 0 {
+		select {
+		case data, ok := <-pr.data:
+			if !ok {
+				return 0, io.EOF
+			}
+			pr.pending = data
+		case data := <-pr.inject:
+			pr.pending = data
+		case <-pr.done:
+			return 0, io.EOF
+		}
+	}
+
+	n := copy(b, pr.pending)
+	pr.pending = pr.pending[n:]
+	return n, nil
+}
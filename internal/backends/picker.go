@@ -0,0 +1,62 @@
+/*
+ * Seashell - SSH server with virtual hosts and username-based routing
+ *
+ * Copyright (C) 2024 Elara6331 <elara@elara.ws>
+ *
+ * This file is part of Seashell.
+ *
+ * Seashell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * Seashell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with Seashell.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package backends
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/gliderlabs/ssh"
+)
+
+// pickItem shows the user a numbered list of items and asks them to
+// choose one, returning the index of the chosen item. It keeps asking
+// until the user enters a valid number or cancels the prompt. The
+// session must have a pty.
+func pickItem(sess ssh.Session, title string, items []string) (int, error) {
+	if _, _, ok := sess.Pty(); !ok {
+		return 0, errors.New("an interactive choice is required, but this session has no pty (try adding the -t flag)")
+	}
+
+	fmt.Fprintf(sess.Stderr(), "%s:\r\n", title)
+	for i, item := range items {
+		fmt.Fprintf(sess.Stderr(), "  %d) %s\r\n", i+1, item)
+	}
+
+	for {
+		fmt.Fprintf(sess.Stderr(), "Choose one [1-%d]: ", len(items))
+		answer, err := readLine(sess)
+		if err != nil {
+			return 0, err
+		}
+
+		n, err := strconv.Atoi(strings.TrimSpace(answer))
+		if err != nil || n < 1 || n > len(items) {
+			fmt.Fprintf(sess.Stderr(), "Invalid choice: %q\r\n", answer)
+			continue
+		}
+
+		return n - 1, nil
+	}
+}
@@ -22,14 +22,18 @@
 package backends
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
+	mathrand "math/rand"
 	"net"
-	"os"
 	"path"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/gliderlabs/ssh"
 	"github.com/melbahja/goph"
@@ -43,16 +47,39 @@ import (
 
 // proxySettings represents settings for the proxy backend.
 type proxySettings struct {
-	Host        *string    `cty:"host"`
-	Hosts       *cty.Value `cty:"hosts"`
-	User        *string    `cty:"user"`
-	PrivkeyPath *string    `cty:"privkey"`
-	UserMap     *cty.Value `cty:"user_map"`
+	Host                  *string    `cty:"host"`
+	Hosts                 *cty.Value `cty:"hosts"`
+	User                  *string    `cty:"user"`
+	PrivkeyPath           *string    `cty:"privkey"`
+	PrivkeyMap            *cty.Value `cty:"privkey_map"`
+	PrivkeyPassphraseFile *string    `cty:"privkey_passphrase_file"`
+	CertPath              *string    `cty:"cert"`
+	CAKeyPath             *string    `cty:"ca_key"`
+	CertValidity          *string    `cty:"cert_validity"`
+	VaultPrivkey          *string    `cty:"vault_privkey"`
+	VaultPassword         *string    `cty:"vault_password"`
+	PasswordFile          *string    `cty:"password_file"`
+	VaultSSHRole          *string    `cty:"vault_ssh_role"`
+	UserMap               *cty.Value `cty:"user_map"`
+	Pools                 *cty.Value `cty:"pools"`
+	Aliases               *cty.Value `cty:"aliases"`
+	Balance               *string    `cty:"balance"`
+	Attempts              *int       `cty:"attempts"`
+	RetryBackoff          *string    `cty:"retry_backoff"`
+	RateLimit             *int       `cty:"rate_limit"`
+	EnvAllow              *cty.Value `cty:"env_allow"`
+	Keepalive             *string    `cty:"keepalive_interval"`
+	KeepaliveMax          *int       `cty:"keepalive_max"`
+	DialProxy             *string    `cty:"dial_proxy"`
+	ConfirmHostKeys       *bool      `cty:"confirm_host_keys"`
+	KnownHosts            *string    `cty:"known_hosts"`
+	KnownHostsReadOnly    *bool      `cty:"known_hosts_readonly"`
 }
 
 // Proxy is the proxy backend. It returns a handler that establishes a proxy
 // session to a remote server based on the provided configuration.
 func Proxy(route config.Route) router.Handler {
+	lb := newProxyBalancer()
 	return func(sess ssh.Session, arg string) error {
 		user, _ := sshctx.GetUser(sess.Context())
 
@@ -61,10 +88,14 @@ func Proxy(route config.Route) router.Handler {
 		if err != nil {
 			return err
 		}
+		sess = limitSession(sess, opts.RateLimit)
 
-		pty, resizeCh, ok := sess.Pty()
-		if !ok {
-			return errors.New("this route only accepts pty sessions (try adding the -t flag)")
+		err = expandSettings(newTemplateData(sess, arg), map[string]*string{
+			"host": opts.Host,
+			"user": opts.User,
+		})
+		if err != nil {
+			return err
 		}
 
 		if opts.User == nil {
@@ -78,91 +109,42 @@ func Proxy(route config.Route) router.Handler {
 			}
 		}
 
-		matched := false
-		addr := arg
-		var portstr, pattern string
-		if opts.Host == nil {
-			hosts := ctyTupleToStrings(opts.Hosts)
-			if len(hosts) == 0 {
-				return errors.New("no host configuration provided")
-			}
-
-			for _, hostPattern := range hosts {
-				pattern, portstr, ok = strings.Cut(hostPattern, ":")
-				if !ok {
-					// addr is already set by the above statement, so just set the default port
-					portstr = "22"
-				}
-
-				matched, err = path.Match(pattern, arg)
-				if err != nil {
-					return err
-				}
-
-				if matched {
-					addr = arg
-					break
-				}
-			}
-		} else {
-			addr, portstr, ok = strings.Cut(*opts.Host, ":")
-			if !ok {
-				// addr is already set by the above statement, so just set the default port
-				portstr = "22"
-			}
+		name, targets, err := proxyResolveTargets(sess.Context(), opts, arg, lb)
+		if err != nil {
+			return err
 		}
 
-		if !route.Permissions.IsAllowed(user, addr) {
+		if !route.Permissions.IsAllowed(user, name) {
 			return router.ErrUnauthorized
 		}
 
-		if !matched {
+		if len(targets) == 0 {
 			return errors.New("provided argument doesn't match any host patterns in configuration")
 		}
 
-		port, err := strconv.ParseUint(portstr, 10, 16)
+		// Invalid copy commands are rejected before dialing, so that
+		// they don't authenticate to the upstream server first.
+		cc, isCopy, err := parseCopyCommand(sess.Command())
 		if err != nil {
 			return err
 		}
 
-		auth := goph.Auth{
-			gossh.PasswordCallback(requestPassword(opts, sess, addr)),
+		c, target, err := proxyConnect(opts, sess, targets, lb, route.Chaos)
+		if err != nil {
+			return err
 		}
+		defer c.Close()
+		defer lb.release(target)
 
-		if opts.PrivkeyPath != nil {
-			data, err := os.ReadFile(*opts.PrivkeyPath)
-			if err != nil {
-				return err
-			}
-
-			pk, err := gossh.ParsePrivateKey(data)
-			if err != nil {
-				return err
-			}
-
-			auth = append(goph.Auth{gossh.PublicKeys(pk)}, auth...)
-		}
-
-		c, err := goph.NewConn(&goph.Config{
-			Auth: auth,
-			User: *opts.User,
-			Addr: addr,
-			Port: uint(port),
-			Callback: func(host string, remote net.Addr, key gossh.PublicKey) error {
-				found, err := goph.CheckKnownHost(host, remote, key, "")
-				if !found {
-					if err = goph.AddKnownHost(host, remote, key, ""); err != nil {
-						return err
-					}
-				} else if err != nil {
-					return err
-				}
-				return nil
-			},
-		})
+		interval, err := time.ParseDuration(valueOr(opts.Keepalive, "30s"))
 		if err != nil {
 			return err
 		}
+		dead := proxyKeepalive(sess.Context(), c, interval, valueOr(opts.KeepaliveMax, 3))
+
+		if isCopy {
+			return handleCopy(sess, cc, sftpCopier{c})
+		}
 
 		baseCmd := sess.Command()
 
@@ -181,11 +163,19 @@ func Proxy(route config.Route) router.Handler {
 			return err
 		}
 
-		err = cmd.RequestPty(pty.Term, pty.Window.Height, pty.Window.Width, nil)
-		if err != nil {
-			return err
+		proxyForwardEnv(cmd, sess.Environ(), ctyTupleToStrings(opts.EnvAllow))
+
+		// Sessions without a pty, like ones running commands from scripts,
+		// get separate stdout and stderr streams, and the upstream stdin is
+		// closed once the client's stdin ends.
+		pty, resizeCh, isPty := sess.Pty()
+		if isPty {
+			err = cmd.RequestPty(pty.Term, pty.Window.Height, pty.Window.Width, nil)
+			if err != nil {
+				return err
+			}
+			go sshHandleResize(resizeCh, cmd)
 		}
-		go sshHandleResize(resizeCh, cmd)
 
 		stdout, err := cmd.StdoutPipe()
 		if err != nil {
@@ -197,8 +187,34 @@ func Proxy(route config.Route) router.Handler {
 		}
 		defer stdin.Close()
 
-		go io.Copy(sess, stdout)
-		go io.Copy(stdin, sess)
+		var stderr io.Reader
+		if !isPty {
+			stderr, err = cmd.StderrPipe()
+			if err != nil {
+				return err
+			}
+		}
+
+		outDone := make(chan struct{})
+		go func() {
+			io.Copy(sess, stdout)
+			close(outDone)
+		}()
+
+		errDone := make(chan struct{})
+		go func() {
+			if stderr != nil {
+				io.Copy(sess.Stderr(), stderr)
+			}
+			close(errDone)
+		}()
+
+		go func() {
+			io.Copy(stdin, sess)
+			if !isPty {
+				stdin.Close()
+			}
+		}()
 
 		if len(baseCmd) == 0 {
 			err = cmd.Shell()
@@ -209,10 +225,457 @@ func Proxy(route config.Route) router.Handler {
 			return err
 		}
 
-		return cmd.Wait()
+		// If the command fails, Wait returns a *gossh.ExitError, which
+		// the router uses to send its exit status to the client.
+		err = cmd.Wait()
+		<-outDone
+		<-errDone
+
+		select {
+		case <-dead:
+			return errProxyUpstreamDead
+		default:
+			return err
+		}
+	}
+}
+
+// errProxyUpstreamDead is returned when the upstream server stops
+// responding to keepalive requests.
+var errProxyUpstreamDead = errors.New("upstream server stopped responding to keepalives, closing session")
+
+// proxyKeepalive sends a keepalive request to the upstream server at every
+// interval. If max requests in a row go unanswered, it closes the connection
+// and closes the returned channel. If interval is zero, keepalives are disabled.
+func proxyKeepalive(ctx context.Context, c *goph.Client, interval time.Duration, max int) <-chan struct{} {
+	dead := make(chan struct{})
+	if interval <= 0 {
+		return dead
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		missed := 0
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			replyCh := make(chan error, 1)
+			go func() {
+				_, _, err := c.SendRequest("keepalive@openssh.com", true, nil)
+				replyCh <- err
+			}()
+
+			select {
+			case err := <-replyCh:
+				if err == nil {
+					missed = 0
+					continue
+				}
+			case <-time.After(interval):
+			case <-ctx.Done():
+				return
+			}
+
+			missed++
+			if missed >= max {
+				close(dead)
+				c.Close()
+				return
+			}
+		}
+	}()
+
+	return dead
+}
+
+// proxyTarget represents an upstream SSH server.
+type proxyTarget struct {
+	Addr string
+	Port uint
+}
+
+// String returns the target's address in host:port form.
+func (pt proxyTarget) String() string {
+	return net.JoinHostPort(pt.Addr, strconv.FormatUint(uint64(pt.Port), 10))
+}
+
+// parseProxyTarget parses a host string with an optional port.
+func parseProxyTarget(host string) (proxyTarget, error) {
+	addr, portstr, ok := strings.Cut(host, ":")
+	if !ok {
+		portstr = "22"
+	}
+
+	port, err := strconv.ParseUint(portstr, 10, 16)
+	if err != nil {
+		return proxyTarget{}, err
+	}
+
+	return proxyTarget{Addr: addr, Port: uint(port)}, nil
+}
+
+// proxyResolveTargets finds the upstream servers that arg refers to. It returns
+// the name that permissions should be checked against and the candidate targets
+// in the order they should be tried. If arg doesn't match anything in the
+// configuration, the returned slice is empty.
+func proxyResolveTargets(ctx context.Context, opts proxySettings, arg string, lb *proxyBalancer) (string, []proxyTarget, error) {
+	if opts.Host != nil {
+		if name, ok := strings.CutPrefix(*opts.Host, "srv://"); ok {
+			targets, err := proxyLookupSRV(ctx, name)
+			return name, targets, err
+		}
+
+		target, err := parseProxyTarget(*opts.Host)
+		if err != nil {
+			return "", nil, err
+		}
+		return target.Addr, []proxyTarget{target}, nil
+	}
+
+	aliases := ctyObjToStringMap(opts.Aliases)
+	pools := ctyObjToStringSliceMap(opts.Pools)
+	hosts := ctyTupleToStrings(opts.Hosts)
+	if len(hosts) == 0 && len(pools) == 0 && len(aliases) == 0 {
+		return "", nil, errors.New("no host configuration provided")
+	}
+
+	// Permissions for aliases are checked against the alias
+	// rather than the real address.
+	if host, ok := aliases[arg]; ok {
+		if name, ok := strings.CutPrefix(host, "srv://"); ok {
+			targets, err := proxyLookupSRV(ctx, name)
+			return arg, targets, err
+		}
+
+		target, err := parseProxyTarget(host)
+		if err != nil {
+			return "", nil, err
+		}
+		return arg, []proxyTarget{target}, nil
+	}
+
+	if pool, ok := pools[arg]; ok {
+		targets := make([]proxyTarget, 0, len(pool))
+		for _, host := range pool {
+			if name, ok := strings.CutPrefix(host, "srv://"); ok {
+				srvTargets, err := proxyLookupSRV(ctx, name)
+				if err != nil {
+					return "", nil, err
+				}
+				targets = append(targets, srvTargets...)
+				continue
+			}
+
+			target, err := parseProxyTarget(host)
+			if err != nil {
+				return "", nil, err
+			}
+			targets = append(targets, target)
+		}
+
+		if len(targets) == 0 {
+			return arg, nil, nil
+		}
+
+		targets, err := lb.order(valueOr(opts.Balance, "round-robin"), arg, targets)
+		return arg, targets, err
+	}
+
+	for _, hostPattern := range hosts {
+		target, err := parseProxyTarget(hostPattern)
+		if err != nil {
+			return "", nil, err
+		}
+
+		matched, err := path.Match(target.Addr, arg)
+		if err != nil {
+			return "", nil, err
+		}
+
+		if matched {
+			target.Addr = arg
+			return arg, []proxyTarget{target}, nil
+		}
+	}
+
+	return arg, nil, nil
+}
+
+// proxyLookupSRV resolves a DNS SRV record (e.x. _ssh._tcp.example.com) to
+// a list of targets, ordered by priority and randomized by weight.
+func proxyLookupSRV(ctx context.Context, name string) ([]proxyTarget, error) {
+	_, records, err := net.DefaultResolver.LookupSRV(ctx, "", "", name)
+	if err != nil {
+		return nil, err
+	}
+
+	targets := make([]proxyTarget, len(records))
+	for i, record := range records {
+		targets[i] = proxyTarget{
+			Addr: strings.TrimSuffix(record.Target, "."),
+			Port: uint(record.Port),
+		}
+	}
+	return targets, nil
+}
+
+// proxyBalancer chooses the order in which the hosts in a pool are tried
+// and keeps track of the active connections to each of them.
+type proxyBalancer struct {
+	mtx   sync.Mutex
+	next  map[string]int
+	conns map[proxyTarget]int
+}
+
+// newProxyBalancer creates a new [proxyBalancer].
+func newProxyBalancer() *proxyBalancer {
+	return &proxyBalancer{
+		next:  map[string]int{},
+		conns: map[proxyTarget]int{},
+	}
+}
+
+// order returns the targets of the given pool reordered according to
+// the load balancing policy.
+func (lb *proxyBalancer) order(policy, pool string, targets []proxyTarget) ([]proxyTarget, error) {
+	lb.mtx.Lock()
+	defer lb.mtx.Unlock()
+
+	out := make([]proxyTarget, 0, len(targets))
+	switch policy {
+	case "round-robin":
+		start := lb.next[pool] % len(targets)
+		lb.next[pool]++
+		out = append(out, targets[start:]...)
+		out = append(out, targets[:start]...)
+	case "random":
+		for _, i := range mathrand.Perm(len(targets)) {
+			out = append(out, targets[i])
+		}
+	case "least-connections":
+		out = append(out, targets...)
+		slices.SortStableFunc(out, func(a, b proxyTarget) int {
+			return lb.conns[a] - lb.conns[b]
+		})
+	default:
+		return nil, fmt.Errorf("unknown load balancing policy: %q", policy)
+	}
+
+	return out, nil
+}
+
+// acquire records a new active connection to the target.
+func (lb *proxyBalancer) acquire(target proxyTarget) {
+	lb.mtx.Lock()
+	defer lb.mtx.Unlock()
+	lb.conns[target]++
+}
+
+// release records that a connection to the target has been closed.
+func (lb *proxyBalancer) release(target proxyTarget) {
+	lb.mtx.Lock()
+	defer lb.mtx.Unlock()
+	lb.conns[target]--
+	if lb.conns[target] <= 0 {
+		delete(lb.conns, target)
+	}
+}
+
+// proxyConnect connects to one of the given targets. If connecting or
+// authenticating fails, it tries the next target, waiting longer after each
+// failed attempt, until the configured amount of attempts is exhausted.
+//
+// Each target is acquired from lb as soon as it's chosen, so that other
+// sessions see attempts that are still in progress when ordering their
+// targets. It's released if connecting to it fails, and otherwise the
+// caller has to release the returned target once it's done with it.
+func proxyConnect(opts proxySettings, sess ssh.Session, targets []proxyTarget, lb *proxyBalancer, chaos *config.Chaos) (*goph.Client, proxyTarget, error) {
+	attempts := valueOr(opts.Attempts, len(targets))
+	if attempts < 1 {
+		attempts = 1
+	}
+
+	backoff, err := time.ParseDuration(valueOr(opts.RetryBackoff, "1s"))
+	if err != nil {
+		return nil, proxyTarget{}, err
+	}
+
+	for i := 0; ; i++ {
+		target := targets[i%len(targets)]
+
+		lb.acquire(target)
+		c, err := proxyDial(opts, sess, target, chaos)
+		if err == nil {
+			return c, target, nil
+		}
+		lb.release(target)
+
+		if i+1 >= attempts {
+			return nil, proxyTarget{}, err
+		}
+
+		fmt.Fprintf(sess.Stderr(), "Connection to %s failed (%s), retrying...\r\n", target, err)
+
+		select {
+		case <-time.After(backoff):
+		case <-sess.Context().Done():
+			return nil, proxyTarget{}, sess.Context().Err()
+		}
+		backoff *= 2
+	}
+}
+
+// proxyDial connects and authenticates to the given target. If chaos
+// settings are given, the connection may fail on purpose.
+func proxyDial(opts proxySettings, sess ssh.Session, target proxyTarget, chaos *config.Chaos) (*goph.Client, error) {
+	auth, err := proxyAuth(opts, sess, target.Addr)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &goph.Config{
+		Auth:     auth,
+		User:     *opts.User,
+		Addr:     target.Addr,
+		Port:     target.Port,
+		Timeout:  dialTimeout,
+		Callback: proxyHostKeyCallback(opts, sess),
+	}
+
+	if err := router.InjectDialFailure(chaos); err != nil {
+		return nil, err
+	}
+
+	conn, err := dialUpstream(sess.Context(), valueOr(opts.DialProxy, ""), target.String())
+	if err != nil {
+		return nil, err
+	}
+
+	sshConn, chans, reqs, err := gossh.NewClientConn(conn, target.String(), &gossh.ClientConfig{
+		User:            cfg.User,
+		Auth:            cfg.Auth,
+		Timeout:         cfg.Timeout,
+		HostKeyCallback: cfg.Callback,
+	})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &goph.Client{
+		Client: gossh.NewClient(sshConn, chans, reqs),
+		Config: cfg,
+	}, nil
+}
+
+// errHostKeyRejected is returned when the user refuses to trust
+// an upstream server's host key.
+var errHostKeyRejected = errors.New("host key verification failed")
+
+// proxyHostKeyCallback returns a callback that verifies upstream host keys
+// against the route's known hosts file, or the default one if the route
+// doesn't set one. Unknown keys are trusted on first use and added to
+// the file, unless it's read-only. If confirm_host_keys is enabled, the user
+// is shown the fingerprint of an unknown key and asked to confirm it first.
+func proxyHostKeyCallback(opts proxySettings, sess ssh.Session) gossh.HostKeyCallback {
+	knownHosts := valueOr(opts.KnownHosts, "")
+	return func(host string, remote net.Addr, key gossh.PublicKey) error {
+		found, err := goph.CheckKnownHost(host, remote, key, knownHosts)
+		if found {
+			return err
+		}
+
+		if valueOr(opts.KnownHostsReadOnly, false) {
+			return fmt.Errorf("%w: no known host key for %s", errHostKeyRejected, host)
+		}
+
+		if valueOr(opts.ConfirmHostKeys, false) {
+			fmt.Fprintf(
+				sess.Stderr(),
+				"The authenticity of host '%s' can't be established.\r\n%s key fingerprint is %s.\r\nAre you sure you want to continue connecting (yes/no)? ",
+				host, key.Type(), gossh.FingerprintSHA256(key),
+			)
+
+			answer, err := readLine(sess)
+			if err != nil {
+				return err
+			}
+
+			if strings.ToLower(strings.TrimSpace(answer)) != "yes" {
+				return errHostKeyRejected
+			}
+		}
+
+		return goph.AddKnownHost(host, remote, key, knownHosts)
+	}
+}
+
+// proxyForwardEnv sends the client's environment variables that match any of
+// the allowed patterns (e.x. LC_*) to the upstream session. Upstream servers
+// may refuse variables they don't accept, so errors are ignored.
+func proxyForwardEnv(cmd *goph.Cmd, environ, allow []string) {
+	for _, kv := range environ {
+		key, val, ok := strings.Cut(kv, "=")
+		if !ok {
+			continue
+		}
+
+		for _, pattern := range allow {
+			if matched, _ := path.Match(pattern, key); matched {
+				cmd.Setenv(key, val)
+				break
+			}
+		}
 	}
 }
 
+// sftpCopier implements seashell cp for proxied SSH servers using SFTP.
+type sftpCopier struct {
+	c *goph.Client
+}
+
+// CopyTo uploads a file to the remote server.
+func (sc sftpCopier) CopyTo(_ context.Context, path string, r io.Reader) error {
+	client, err := sc.c.NewSftp()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	fl, err := client.Create(path)
+	if err != nil {
+		return err
+	}
+	defer fl.Close()
+
+	_, err = io.Copy(fl, r)
+	return err
+}
+
+// CopyFrom downloads a file from the remote server.
+func (sc sftpCopier) CopyFrom(_ context.Context, path string, w io.Writer) error {
+	client, err := sc.c.NewSftp()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	fl, err := client.Open(path)
+	if err != nil {
+		return err
+	}
+	defer fl.Close()
+
+	_, err = io.Copy(w, fl)
+	return err
+}
+
 // requestPassword asks the client for the remote server's password
 func requestPassword(opts proxySettings, sess ssh.Session, addr string) func() (secret string, err error) {
 	return func() (secret string, err error) {
@@ -234,6 +697,41 @@ func sshHandleResize(resizeCh <-chan ssh.Window, cmd *goph.Cmd) {
 	}
 }
 
+// readLine reads a line of input from the SSH session, echoing what the
+// user types back to them.
+//
+// It handles interrupts (Ctrl+C), EOF (Ctrl+D), and backspace.
+func readLine(sess ssh.Session) (string, error) {
+	var out []byte
+
+	for {
+		buf := make([]byte, 1)
+		_, err := sess.Read(buf)
+		if err != nil {
+			return "", err
+		}
+
+		switch buf[0] {
+		case '\r', '\n':
+			sess.Write([]byte("\r\n"))
+			return string(out), nil
+		case '\x7F':
+			if len(out) != 0 {
+				out = out[:len(out)-1]
+				sess.Write([]byte("\x08 \x08"))
+			}
+			continue
+		case '\x03', '\x04':
+			sess.Write([]byte("\r\n"))
+			return "", errors.New("input canceled")
+		default:
+			sess.Write(buf)
+		}
+
+		out = append(out, buf[0])
+	}
+}
+
 // readPassword reads a password from the SSH session, sending an asterisk
 // for each character typed.
 //
@@ -0,0 +1,248 @@
+/*
+ * Seashell - SSH server with virtual hosts and username-based routing
+ *
+ * Copyright (C) 2024 Elara6331 <elara@elara.ws>
+ *
+ * This file is part of Seashell.
+ *
+ * Seashell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * Seashell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with Seashell.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package backends
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/melbahja/goph"
+	"go.elara.ws/seashell/internal/sshctx"
+	"go.elara.ws/seashell/internal/vault"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// proxyAuth returns the authentication methods used to connect to the
+// upstream server. Public key authentication is tried first if a key is
+// configured. Then, password authentication is attempted using the password
+// stored in Vault or in a file, or by asking the client for it.
+func proxyAuth(opts proxySettings, sess ssh.Session, addr string) (goph.Auth, error) {
+	var auth goph.Auth
+
+	signer, err := proxySigner(opts, sess)
+	if err != nil {
+		return nil, err
+	}
+	if signer != nil {
+		auth = append(auth, gossh.PublicKeys(signer))
+	}
+
+	if opts.VaultPassword != nil {
+		pwd, err := vault.Default().ReadField(sess.Context(), *opts.VaultPassword)
+		if err != nil {
+			return nil, err
+		}
+		auth = append(auth, gossh.Password(pwd))
+	} else if opts.PasswordFile != nil {
+		pwd, err := readSecretFile(*opts.PasswordFile)
+		if err != nil {
+			return nil, err
+		}
+		auth = append(auth, gossh.Password(pwd))
+	} else {
+		auth = append(auth, gossh.PasswordCallback(requestPassword(opts, sess, addr)))
+	}
+
+	return auth, nil
+}
+
+// proxySigner returns the signer used for public key authentication
+// to the upstream server, or nil if no key is configured.
+func proxySigner(opts proxySettings, sess ssh.Session) (gossh.Signer, error) {
+	if opts.CAKeyPath != nil {
+		return proxySignCert(opts, sess)
+	} else if opts.VaultSSHRole != nil {
+		return proxyVaultSignCert(opts, sess)
+	}
+
+	var data []byte
+	if opts.VaultPrivkey != nil {
+		privkey, err := vault.Default().ReadField(sess.Context(), *opts.VaultPrivkey)
+		if err != nil {
+			return nil, err
+		}
+		data = []byte(privkey)
+	} else if privkeyPath := proxyPrivkeyPath(opts, sess); privkeyPath != "" {
+		var err error
+		data, err = os.ReadFile(privkeyPath)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		return nil, nil
+	}
+
+	var pk gossh.Signer
+	if opts.PrivkeyPassphraseFile != nil {
+		passphrase, err := readSecretFile(*opts.PrivkeyPassphraseFile)
+		if err != nil {
+			return nil, err
+		}
+		pk, err = gossh.ParsePrivateKeyWithPassphrase(data, []byte(passphrase))
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		var err error
+		pk, err = gossh.ParsePrivateKey(data)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.CertPath != nil {
+		return proxyLoadCert(*opts.CertPath, pk)
+	}
+
+	return pk, nil
+}
+
+// proxyPrivkeyPath returns the path of the private key that should be used
+// to authenticate the current user to the upstream server. Keys can be mapped
+// to seashell users by name or to groups using a "group:" prefix. User entries
+// take priority over group entries, and the default privkey setting is used
+// if there's no matching entry.
+func proxyPrivkeyPath(opts proxySettings, sess ssh.Session) string {
+	user, _ := sshctx.GetUser(sess.Context())
+	if path, ok := lookupUserMap(ctyObjToStringMap(opts.PrivkeyMap), user); ok {
+		return path
+	}
+	return valueOr(opts.PrivkeyPath, "")
+}
+
+// proxyLoadCert loads the SSH certificate at path and returns a signer
+// that presents it along with the given private key.
+func proxyLoadCert(path string, pk gossh.Signer) (gossh.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	pubkey, _, _, _, err := gossh.ParseAuthorizedKey(data)
+	if err != nil {
+		return nil, err
+	}
+
+	cert, ok := pubkey.(*gossh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an SSH certificate", path)
+	}
+
+	return gossh.NewCertSigner(cert, pk)
+}
+
+// proxySignCert generates an ephemeral keypair and signs a short-lived
+// user certificate for it using the configured CA key.
+func proxySignCert(opts proxySettings, sess ssh.Session) (gossh.Signer, error) {
+	data, err := os.ReadFile(*opts.CAKeyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	ca, err := gossh.ParsePrivateKey(data)
+	if err != nil {
+		return nil, err
+	}
+
+	validity, err := time.ParseDuration(valueOr(opts.CertValidity, "5m"))
+	if err != nil {
+		return nil, err
+	}
+
+	pubkey, privkey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	sshPubkey, err := gossh.NewPublicKey(pubkey)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, err := gossh.NewSignerFromSigner(privkey)
+	if err != nil {
+		return nil, err
+	}
+
+	user, _ := sshctx.GetUser(sess.Context())
+	now := time.Now()
+	cert := &gossh.Certificate{
+		Key:             sshPubkey,
+		CertType:        gossh.UserCert,
+		KeyId:           "seashell:" + user.Name,
+		ValidPrincipals: []string{*opts.User},
+		// Allow for some clock skew between seashell and the upstream server
+		ValidAfter:  uint64(now.Add(-time.Minute).Unix()),
+		ValidBefore: uint64(now.Add(validity).Unix()),
+		Permissions: gossh.Permissions{
+			Extensions: map[string]string{
+				"permit-pty":              "",
+				"permit-agent-forwarding": "",
+				"permit-port-forwarding":  "",
+				"permit-user-rc":          "",
+			},
+		},
+	}
+
+	if err = cert.SignCert(rand.Reader, ca); err != nil {
+		return nil, err
+	}
+
+	return gossh.NewCertSigner(cert, signer)
+}
+
+// proxyVaultSignCert generates an ephemeral keypair and asks the Vault SSH
+// secrets engine to sign a user certificate for it.
+func proxyVaultSignCert(opts proxySettings, sess ssh.Session) (gossh.Signer, error) {
+	_, privkey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, err := gossh.NewSignerFromSigner(privkey)
+	if err != nil {
+		return nil, err
+	}
+
+	pubkey := gossh.MarshalAuthorizedKey(signer.PublicKey())
+	certData, err := vault.Default().SignSSHKey(sess.Context(), *opts.VaultSSHRole, pubkey, *opts.User)
+	if err != nil {
+		return nil, err
+	}
+
+	certKey, _, _, _, err := gossh.ParseAuthorizedKey(certData)
+	if err != nil {
+		return nil, err
+	}
+
+	cert, ok := certKey.(*gossh.Certificate)
+	if !ok {
+		return nil, errors.New("vault returned a key that isn't an SSH certificate")
+	}
+
+	return gossh.NewCertSigner(cert, signer)
+}
@@ -0,0 +1,106 @@
+/*
+ * Seashell - SSH server with virtual hosts and username-based routing
+ *
+ * Copyright (C) 2024 Elara6331 <elara@elara.ws>
+ *
+ * This file is part of Seashell.
+ *
+ * Seashell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * Seashell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with Seashell.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package backends
+
+import (
+	"io"
+
+	"github.com/gliderlabs/ssh"
+	"golang.org/x/time/rate"
+)
+
+// rateLimitedSession wraps an SSH session, limiting how fast data can be
+// read from and written to it. Both directions, as well as stderr, share
+// the same limit.
+type rateLimitedSession struct {
+	ssh.Session
+	limiter *rate.Limiter
+}
+
+// limitSession returns a session that transfers at most bytesPerSec bytes
+// per second. If bytesPerSec is nil, the session is returned as-is.
+func limitSession(sess ssh.Session, bytesPerSec *int) ssh.Session {
+	if bytesPerSec == nil || *bytesPerSec <= 0 {
+		return sess
+	}
+	return &rateLimitedSession{
+		Session: sess,
+		limiter: rate.NewLimiter(rate.Limit(*bytesPerSec), *bytesPerSec),
+	}
+}
+
+// Read reads data from the session, waiting until the limit allows it.
+func (rs *rateLimitedSession) Read(b []byte) (int, error) {
+	if len(b) > rs.limiter.Burst() {
+		b = b[:rs.limiter.Burst()]
+	}
+
+	n, err := rs.Session.Read(b)
+	if n > 0 {
+		if werr := rs.limiter.WaitN(rs.Context(), n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+// Write writes data to the session in chunks, waiting until the limit
+// allows each one.
+func (rs *rateLimitedSession) Write(b []byte) (int, error) {
+	return rs.writeLimited(rs.Session, b)
+}
+
+// Stderr returns the session's stderr stream. Writes to it share the
+// session's limit, so stderr can't be used to get around it.
+func (rs *rateLimitedSession) Stderr() io.ReadWriter {
+	return rateLimitedStderr{ReadWriter: rs.Session.Stderr(), rs: rs}
+}
+
+// writeLimited writes data to w in chunks, waiting until the session's
+// limit allows each one.
+func (rs *rateLimitedSession) writeLimited(w io.Writer, b []byte) (n int, err error) {
+	for len(b) > 0 {
+		chunk := b[:min(len(b), rs.limiter.Burst())]
+		if err = rs.limiter.WaitN(rs.Context(), len(chunk)); err != nil {
+			return n, err
+		}
+
+		written, err := w.Write(chunk)
+		n += written
+		if err != nil {
+			return n, err
+		}
+		b = b[written:]
+	}
+	return n, nil
+}
+
+// rateLimitedStderr is the stderr stream of a [rateLimitedSession].
+type rateLimitedStderr struct {
+	io.ReadWriter
+	rs *rateLimitedSession
+}
+
+// Write writes data to the stream, waiting until the session's limit allows it.
+func (s rateLimitedStderr) Write(b []byte) (int, error) {
+	return s.rs.writeLimited(s.ReadWriter, b)
+}
@@ -22,33 +22,56 @@
 package backends
 
 import (
+	"cmp"
+	"context"
 	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/gliderlabs/ssh"
+	"github.com/zclconf/go-cty/cty"
 	"github.com/zclconf/go-cty/cty/gocty"
 	"go.bug.st/serial"
 	"go.elara.ws/seashell/internal/config"
 	"go.elara.ws/seashell/internal/router"
 	"go.elara.ws/seashell/internal/sshctx"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/ianaindex"
+	"golang.org/x/text/transform"
 )
 
 // serialSettings represents settings for the serial backend.
 type serialSettings struct {
-	Directory     *string `cty:"directory"`
-	File          *string `cty:"file"`
-	Delimiter     *string `cty:"delimeter"`
-	BaudRate      *int    `cty:"baud_rate"`
-	Configuration *string `cty:"config"`
+	Directory     *string    `cty:"directory"`
+	File          *string    `cty:"file"`
+	Delimiter     *string    `cty:"delimiter"`
+	OldDelimiter  *string    `cty:"delimeter"`
+	BaudRate      *int       `cty:"baud_rate"`
+	Configuration *string    `cty:"config"`
+	RateLimit     *int       `cty:"rate_limit"`
+	Shared        *bool      `cty:"shared"`
+	EscapeChar    *string    `cty:"escape_char"`
+	IMap          *cty.Value `cty:"imap"`
+	OMap          *cty.Value `cty:"omap"`
+	IdleTimeout   *string    `cty:"idle_timeout"`
+	Encoding      *string    `cty:"encoding"`
+	LogDir        *string    `cty:"log_dir"`
+	LogMaxSize    *string    `cty:"log_max_size"`
+	LogMaxFiles   *int       `cty:"log_max_files"`
+	Capture       *cty.Value `cty:"capture"`
 }
 
 // Serial is the serial backend. It returns a handler that
 // exposes a serial port on an SSH connection.
 func Serial(route config.Route) router.Handler {
+	startSerialCaptures(route)
+
 	return func(sess ssh.Session, arg string) error {
 		user, _ := sshctx.GetUser(sess.Context())
 
@@ -57,11 +80,24 @@ func Serial(route config.Route) router.Handler {
 		if err != nil {
 			return err
 		}
+		sess = limitSession(sess, opts.RateLimit)
 
 		if opts.Directory == nil && opts.File == nil {
 			return errors.New("either directory or file must be set in the server config")
 		}
 
+		err = expandSettings(newTemplateData(sess, arg), map[string]*string{
+			"directory": opts.Directory,
+			"file":      opts.File,
+		})
+		if err != nil {
+			return err
+		}
+
+		if arg == "" && opts.File == nil {
+			return serialListPorts(sess, route, *opts.Directory)
+		}
+
 		// Since we can't specify the size of a physical serial port,
 		// we can discard the window size channel and the pty info.
 		_, _, ok := sess.Pty()
@@ -69,8 +105,8 @@ func Serial(route config.Route) router.Handler {
 			return errors.New("this route only accepts pty sessions")
 		}
 
-		delimeter := valueOr(opts.Delimiter, ".")
-		args := strings.Split(arg, delimeter)
+		delimiter := routeDelimiter(opts.Delimiter, opts.OldDelimiter)
+		args := strings.Split(arg, delimiter)
 
 		if len(args) == 0 {
 			return errors.New("at least one argument required")
@@ -96,27 +132,261 @@ func Serial(route config.Route) router.Handler {
 			}
 		}
 
-		if !route.Permissions.IsAllowed(user, filepath.Base(file)) {
+		mode, err := getSerialMode(opts, baudRate, config)
+		if err != nil {
+			return err
+		}
+
+		// Baud rate and mode restrictions are only enforced if the
+		// permissions mention them, so that existing rules keep working.
+		items := []string{filepath.Base(file)}
+		if route.Permissions.Mentions("baud:") {
+			items = append(items, "baud:"+strconv.Itoa(mode.BaudRate))
+		}
+		if route.Permissions.Mentions("mode:") {
+			items = append(items, "mode:"+strings.ToLower(cmp.Or(config, valueOr(opts.Configuration, ""))))
+		}
+
+		if !route.Permissions.IsAllowed(user, items...) {
 			return router.ErrUnauthorized
 		}
+		readOnly := route.Permissions.Mentions("write") && !route.Permissions.IsAllowed(user, "write")
 
-		mode, err := getSerialMode(opts, baudRate, config)
+		logCfg, err := opts.logConfig()
 		if err != nil {
 			return err
 		}
 
-		port, err := serial.Open(file, mode)
+		clientOpts, err := opts.clientOptions()
+		if err != nil {
+			return err
+		}
+
+		if err := router.InjectDialFailure(route.Chaos); err != nil {
+			return err
+		}
+
+		hub, err := openSerialHub(file, mode, serialHubOptions{
+			shared: valueOr(opts.Shared, false),
+			log:    logCfg,
+		})
 		if err != nil {
 			return err
 		}
-		defer port.Close()
 
-		go io.Copy(sess, port)
-		io.Copy(port, sess)
+		client := hub.attach(user.Name, readOnly)
+		defer hub.detach(client)
+
+		return serveSerialClient(sess, hub, client, clientOpts)
+	}
+}
+
+// startSerialCaptures starts capturing traffic in the background for the
+// route's serial ports if traffic logging is enabled. For routes with
+// a directory, only the ports listed in the capture setting are captured.
+func startSerialCaptures(route config.Route) {
+	var opts serialSettings
+	err := gocty.FromCtyValue(route.Settings, &opts)
+	if err != nil {
+		// The handler reports invalid settings when someone connects
+		return
+	}
+
+	logCfg, err := opts.logConfig()
+	if err != nil || logCfg == nil {
+		return
+	}
+
+	var paths []string
+	if opts.File != nil {
+		paths = append(paths, *opts.File)
+	} else if opts.Directory != nil {
+		for _, name := range ctyTupleToStrings(opts.Capture) {
+			paths = append(paths, filepath.Join(*opts.Directory, name))
+		}
+	}
+
+	if len(paths) == 0 {
+		return
+	}
+
+	mode, err := getSerialMode(opts, "", "")
+	if err != nil {
+		slog.Warn("Can't capture serial traffic without a default configuration", slog.String("route", route.Name), slog.Any("error", err))
+		return
+	}
+
+	for _, path := range paths {
+		go serialCapture(path, mode, serialHubOptions{
+			shared: valueOr(opts.Shared, false),
+			log:    logCfg,
+		})
+	}
+}
+
+// serialClientOptions represents the settings that affect how data is
+// exchanged between a session and a serial port.
+type serialClientOptions struct {
+	// escape is nil if escape sequences are disabled
+	escape *serialEscape
+	// imap translates data from the port, and omap
+	// translates data sent to the port.
+	imap, omap *serialLineMap
+	// idleTimeout is zero if sessions never time out
+	idleTimeout time.Duration
+	// encoding is the character set used by the device,
+	// or nil if its output is sent to the client as-is.
+	encoding encoding.Encoding
+}
+
+// clientOptions returns the client options configured for the route.
+func (opts serialSettings) clientOptions() (co serialClientOptions, err error) {
+	co.escape, err = newSerialEscape(opts.EscapeChar)
+	if err != nil {
+		return co, err
+	}
+	co.imap, err = newSerialLineMap(opts.IMap)
+	if err != nil {
+		return co, err
+	}
+	co.omap, err = newSerialLineMap(opts.OMap)
+	if err != nil {
+		return co, err
+	}
+	if opts.IdleTimeout != nil {
+		co.idleTimeout, err = time.ParseDuration(*opts.IdleTimeout)
+		if err != nil {
+			return co, err
+		}
+	}
+	if opts.Encoding != nil {
+		co.encoding, err = ianaindex.IANA.Encoding(*opts.Encoding)
+		if err != nil {
+			return co, err
+		} else if co.encoding == nil {
+			return co, fmt.Errorf("unsupported encoding: %q", *opts.Encoding)
+		}
+	}
+	return co, nil
+}
+
+// serveSerialClient copies data between the SSH session and the serial hub
+// until either the client disconnects, the hub is closed, the client uses the
+// disconnect escape sequence, or there's no traffic for the idle timeout.
+func serveSerialClient(sess ssh.Session, hub *serialHub, client *serialClient, co serialClientOptions) error {
+	var lastActive atomic.Int64
+	touch := func() { lastActive.Store(time.Now().UnixNano()) }
+	touch()
+
+	// The decoder is kept for the whole session, so that multi-byte
+	// characters split across reads are still decoded correctly.
+	var out io.Writer = sess
+	if co.encoding != nil {
+		out = transform.NewWriter(sess, co.encoding.NewDecoder())
+	}
+
+	outDone := make(chan struct{})
+	go func() {
+		defer close(outDone)
+		for {
+			select {
+			case data, ok := <-client.out:
+				if !ok {
+					// Make sure any final status messages are shown
+					for {
+						select {
+						case msg := <-client.notify:
+							writeSerialNotice(sess, msg)
+						default:
+							return
+						}
+					}
+				}
+				touch()
+				out.Write(co.imap.apply(data))
+			case msg := <-client.notify:
+				writeSerialNotice(sess, msg)
+			}
+		}
+	}()
+
+	write := func(data []byte) error {
+		return hub.write(client, co.omap.apply(data))
+	}
+	command := func(cmd byte) error {
+		return serialEscapeCommand(sess, hub, client, co.escape, cmd)
+	}
+
+	inDone := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, err := sess.Read(buf)
+			if n > 0 {
+				touch()
+				var werr error
+				if co.escape != nil {
+					werr = co.escape.process(buf[:n], write, command)
+				} else {
+					werr = write(buf[:n])
+				}
+
+				if errors.Is(werr, errSerialDisconnect) {
+					inDone <- nil
+					return
+				} else if werr != nil {
+					inDone <- werr
+					return
+				}
+			}
+			if err != nil {
+				inDone <- nil
+				return
+			}
+		}
+	}()
+
+	idle := make(chan struct{})
+	if co.idleTimeout > 0 {
+		go serialIdleWatch(sess.Context(), co.idleTimeout, &lastActive, idle)
+	}
+
+	select {
+	case <-outDone:
+		return nil
+	case err := <-inDone:
+		return err
+	case <-idle:
+		writeSerialNotice(sess, fmt.Sprintf("Disconnected after %s without any traffic", co.idleTimeout))
 		return nil
 	}
 }
 
+// serialIdleWatch closes idle once lastActive, a Unix timestamp in
+// nanoseconds, is older than timeout. It returns when ctx is canceled.
+func serialIdleWatch(ctx context.Context, timeout time.Duration, lastActive *atomic.Int64, idle chan<- struct{}) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+			inactive := time.Since(time.Unix(0, lastActive.Load()))
+			if inactive >= timeout {
+				close(idle)
+				return
+			}
+			timer.Reset(timeout - inactive)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// writeSerialNotice writes a status message from seashell to the session.
+func writeSerialNotice(sess ssh.Session, msg string) {
+	fmt.Fprintf(sess.Stderr(), "\r\n[seashell] %s\r\n", msg)
+}
+
 // getSerialMode tries to get the serial mode configuration from the
 // config or from the argument provided by the client.
 func getSerialMode(opts serialSettings, baudRate, config string) (out *serial.Mode, err error) {
@@ -0,0 +1,165 @@
+/*
+ * Seashell - SSH server with virtual hosts and username-based routing
+ *
+ * Copyright (C) 2024 Elara6331 <elara@elara.ws>
+ *
+ * This file is part of Seashell.
+ *
+ * Seashell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * Seashell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with Seashell.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package backends
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/gliderlabs/ssh"
+)
+
+// errSerialDisconnect is returned by an escape command
+// when the session should be ended.
+var errSerialDisconnect = errors.New("serial session ended by escape sequence")
+
+// serialEscapeCommands contains descriptions of the available escape commands
+var serialEscapeCommands = []struct {
+	char byte
+	desc string
+}{
+	{'.', "Disconnect"},
+	{'d', "Toggle DTR"},
+	{'r', "Toggle RTS"},
+	{'?', "Show this help message"},
+}
+
+// serialEscape detects OpenSSH-style escape sequences in the input from a
+// client. An escape sequence is the escape character followed by a command
+// character, and it's only recognized at the start of a line.
+type serialEscape struct {
+	char      byte
+	lineStart bool
+	pending   bool
+}
+
+// newSerialEscape returns an escape sequence detector for the given escape
+// character, or nil if escape sequences are disabled.
+func newSerialEscape(char *string) (*serialEscape, error) {
+	c := valueOr(char, "~")
+	if c == "none" {
+		return nil, nil
+	}
+	if len(c) != 1 {
+		return nil, fmt.Errorf("invalid escape character %q", c)
+	}
+	return &serialEscape{char: c[0], lineStart: true}, nil
+}
+
+// process handles input from the client. Data that isn't part of an escape
+// sequence is passed to write, and escape commands are passed to command.
+// Any error returned by either function stops processing and is returned.
+func (e *serialEscape) process(data []byte, write func([]byte) error, command func(byte) error) error {
+	start := 0
+	for i, b := range data {
+		if e.pending {
+			e.pending = false
+			start = i + 1
+			if b == e.char {
+				// Typing the escape character twice sends it once
+				if err := write([]byte{b}); err != nil {
+					return err
+				}
+				e.lineStart = false
+				continue
+			} else if !e.isCommand(b) {
+				// Not an escape sequence, so the escape character is
+				// sent along with this character.
+				if err := write([]byte{e.char, b}); err != nil {
+					return err
+				}
+				e.lineStart = b == '\r' || b == '\n'
+				continue
+			}
+
+			if err := command(b); err != nil {
+				return err
+			}
+			e.lineStart = true
+			continue
+		}
+
+		if e.lineStart && b == e.char {
+			if i > start {
+				if err := write(data[start:i]); err != nil {
+					return err
+				}
+			}
+			e.pending = true
+			start = i + 1
+			continue
+		}
+
+		e.lineStart = b == '\r' || b == '\n'
+	}
+
+	if start < len(data) {
+		return write(data[start:])
+	}
+	return nil
+}
+
+// isCommand checks whether b is a known escape command.
+func (e *serialEscape) isCommand(b byte) bool {
+	for _, cmd := range serialEscapeCommands {
+		if cmd.char == b {
+			return true
+		}
+	}
+	return false
+}
+
+// serialEscapeCommand runs the escape command identified by cmd.
+func serialEscapeCommand(sess ssh.Session, hub *serialHub, client *serialClient, esc *serialEscape, cmd byte) error {
+	switch cmd {
+	case '.':
+		return errSerialDisconnect
+	case 'd', 'r':
+		line := "DTR"
+		if cmd == 'r' {
+			line = "RTS"
+		}
+
+		state, err := hub.toggleLine(client, line)
+		if err != nil {
+			writeSerialNotice(sess, err.Error())
+			return nil
+		}
+
+		status := "off"
+		if state {
+			status = "on"
+		}
+		writeSerialNotice(sess, fmt.Sprintf("%s is now %s", line, status))
+	case '?':
+		sb := strings.Builder{}
+		sb.WriteString("Supported escape sequences:\r\n")
+		for _, cmd := range serialEscapeCommands {
+			fmt.Fprintf(&sb, " %c%c - %s\r\n", esc.char, cmd.char, cmd.desc)
+		}
+		fmt.Fprintf(&sb, " %c%c - Send the escape character\r\n", esc.char, esc.char)
+		sb.WriteString("(Note that escapes are only recognized immediately after newline.)\r\n")
+		fmt.Fprint(sess.Stderr(), "\r\n"+sb.String())
+	}
+	return nil
+}
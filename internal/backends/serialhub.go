@@ -0,0 +1,385 @@
+/*
+ * Seashell - SSH server with virtual hosts and username-based routing
+ *
+ * Copyright (C) 2024 Elara6331 <elara@elara.ws>
+ *
+ * This file is part of Seashell.
+ *
+ * Seashell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * Seashell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with Seashell.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package backends
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"go.bug.st/serial"
+)
+
+var (
+	// serialHubsMu protects serialHubs and the state of every hub in it
+	serialHubsMu sync.Mutex
+	serialHubs   = map[string]*serialHub{}
+)
+
+// serialReconnectInterval is how often to check whether a
+// disconnected serial device has come back.
+const serialReconnectInterval = time.Second
+
+// serialHub shares an open serial port between all the sessions attached
+// to it. Only one session can write to the port at a time, and any other
+// sessions are attached as read-only observers. When the writer detaches,
+// the observer that's been attached the longest takes over.
+//
+// In shared mode, every session can write to the port. Writes are
+// serialized, so input from different sessions is never interleaved
+// within a single write.
+type serialHub struct {
+	path   string
+	mode   serial.Mode
+	port   serial.Port
+	shared bool
+	// persistent hubs stay open when no clients are attached
+	persistent bool
+	logger     *serialLogger
+	// done is closed once the hub is closed
+	done chan struct{}
+	// writeMu serializes writes to the port
+	writeMu sync.Mutex
+	// connected is false while waiting for the device to come back
+	connected bool
+	// dtr and rts contain the current state of the modem control
+	// lines, which are both asserted when the port is opened.
+	dtr, rts bool
+
+	clients []*serialClient
+	writer  *serialClient
+	closed  bool
+}
+
+// serialHubOptions represents the options used to open a serial hub.
+type serialHubOptions struct {
+	shared     bool
+	persistent bool
+	log        *serialLogConfig
+}
+
+// serialClient represents a session attached to a serial hub.
+type serialClient struct {
+	user string
+	// readOnly clients can never write to the port
+	readOnly bool
+	// out receives the data read from the serial port. It's closed
+	// when the client is detached or the hub is closed.
+	out chan []byte
+	// notify receives status messages for the client.
+	notify chan string
+}
+
+// openSerialHub returns the hub for the serial port at path,
+// opening the port if it isn't already open.
+func openSerialHub(path string, mode *serial.Mode, opts serialHubOptions) (*serialHub, error) {
+	serialHubsMu.Lock()
+	defer serialHubsMu.Unlock()
+
+	if hub, ok := serialHubs[path]; ok {
+		if !serialModesEqual(hub.mode, *mode) {
+			return nil, fmt.Errorf("%s is already open with a different configuration", filepath.Base(path))
+		}
+		if hub.shared != opts.shared {
+			return nil, fmt.Errorf("%s is already open by a route with a different sharing mode", filepath.Base(path))
+		}
+		if opts.persistent {
+			hub.persistent = true
+		}
+		if hub.logger == nil && opts.log != nil {
+			hub.logger = newSerialLogger(*opts.log, path)
+		}
+		return hub, nil
+	}
+
+	port, err := serial.Open(path, mode)
+	if err != nil {
+		return nil, err
+	}
+
+	hub := &serialHub{
+		path:       path,
+		mode:       *mode,
+		port:       port,
+		shared:     opts.shared,
+		persistent: opts.persistent,
+		done:       make(chan struct{}),
+		connected:  true,
+		dtr:        true,
+		rts:        true,
+	}
+	if opts.log != nil {
+		hub.logger = newSerialLogger(*opts.log, path)
+	}
+	serialHubs[path] = hub
+	go hub.readLoop()
+	return hub, nil
+}
+
+// attach attaches a new client to the hub. If no one is currently
+// writing to the port, the client becomes the writer, unless it's
+// read-only. In shared mode, the other clients are told that someone
+// joined instead.
+func (h *serialHub) attach(user string, readOnly bool) *serialClient {
+	serialHubsMu.Lock()
+	defer serialHubsMu.Unlock()
+
+	c := &serialClient{
+		user:     user,
+		readOnly: readOnly,
+		out:      make(chan []byte, 256),
+		notify:   make(chan string, 8),
+	}
+	h.clients = append(h.clients, c)
+
+	if readOnly {
+		c.sendNotice(fmt.Sprintf("You only have read access to %s", filepath.Base(h.path)))
+	} else if h.shared {
+		h.broadcastNotice(c, fmt.Sprintf("%s attached to %s", user, filepath.Base(h.path)))
+	} else if h.writer == nil {
+		h.writer = c
+	} else {
+		c.sendNotice(fmt.Sprintf("%s is in use by %s, attached read-only", filepath.Base(h.path), h.writer.user))
+	}
+
+	return c
+}
+
+// detach detaches a client from the hub. If the client was the writer, the
+// next client in line becomes the writer. The port is closed once the last
+// client detaches, unless the hub is persistent.
+func (h *serialHub) detach(c *serialClient) {
+	serialHubsMu.Lock()
+	defer serialHubsMu.Unlock()
+
+	i := slices.Index(h.clients, c)
+	if i == -1 {
+		return
+	}
+	h.clients = slices.Delete(h.clients, i, i+1)
+	close(c.out)
+
+	if h.shared {
+		h.broadcastNotice(c, fmt.Sprintf("%s detached from %s", c.user, filepath.Base(h.path)))
+	} else if h.writer == c {
+		h.writer = nil
+		for _, next := range h.clients {
+			if !next.readOnly {
+				h.writer = next
+				next.sendNotice("You now have write access to " + filepath.Base(h.path))
+				break
+			}
+		}
+	}
+
+	if len(h.clients) == 0 && !h.persistent {
+		h.close()
+	}
+}
+
+// write writes data to the port if c holds the write lock. Data from
+// observers, and data sent while the port is disconnected, is discarded.
+func (h *serialHub) write(c *serialClient, data []byte) error {
+	serialHubsMu.Lock()
+	port, ok := h.port, h.connected && h.canWrite(c)
+	serialHubsMu.Unlock()
+	if !ok {
+		return nil
+	}
+
+	h.writeMu.Lock()
+	defer h.writeMu.Unlock()
+	// Write errors aren't returned because they mean the port has
+	// gone away, which readLoop notices and recovers from.
+	if _, err := port.Write(data); err != nil {
+		return nil
+	}
+	if h.logger != nil {
+		h.logger.log("TX", data)
+	}
+	return nil
+}
+
+// canWrite checks whether c is allowed to write to the port.
+// serialHubsMu must be held by the caller.
+func (h *serialHub) canWrite(c *serialClient) bool {
+	return !c.readOnly && (h.shared || h.writer == c)
+}
+
+// toggleLine toggles the DTR or RTS line of the port and returns its new
+// state. Only clients that are allowed to write to the port can do this.
+func (h *serialHub) toggleLine(c *serialClient, line string) (bool, error) {
+	serialHubsMu.Lock()
+	defer serialHubsMu.Unlock()
+
+	if !h.canWrite(c) {
+		return false, errors.New("read-only observers can't change " + line)
+	} else if !h.connected {
+		return false, errors.New(filepath.Base(h.path) + " is disconnected")
+	}
+
+	var err error
+	var state bool
+	switch line {
+	case "DTR":
+		state = !h.dtr
+		if err = h.port.SetDTR(state); err == nil {
+			h.dtr = state
+		}
+	case "RTS":
+		state = !h.rts
+		if err = h.port.SetRTS(state); err == nil {
+			h.rts = state
+		}
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if h.logger != nil {
+		h.logger.log(line, []byte(fmt.Sprintf("%t", state)))
+	}
+	return state, nil
+}
+
+// readLoop reads from the port and sends the data to every attached
+// client. Clients that can't keep up miss data rather than holding up
+// the others. If reading fails, the port is reopened once it comes back.
+func (h *serialHub) readLoop() {
+	buf := make([]byte, 4096)
+	for {
+		n, err := h.port.Read(buf)
+
+		serialHubsMu.Lock()
+		if h.closed {
+			for _, c := range h.clients {
+				close(c.out)
+			}
+			h.clients = nil
+			h.writer = nil
+			serialHubsMu.Unlock()
+			return
+		}
+
+		if err != nil {
+			h.connected = false
+			h.broadcastNotice(nil, fmt.Sprintf("Lost connection to %s (%s), waiting for it to come back...", filepath.Base(h.path), err))
+			serialHubsMu.Unlock()
+
+			if !h.reconnect() {
+				return
+			}
+			continue
+		}
+
+		if h.logger != nil {
+			h.logger.log("RX", buf[:n])
+		}
+
+		for _, c := range h.clients {
+			select {
+			case c.out <- slices.Clone(buf[:n]):
+			default:
+			}
+		}
+		serialHubsMu.Unlock()
+	}
+}
+
+// reconnect waits for the device to come back, for example after a USB
+// adapter is unplugged or re-enumerated, and reopens the port. It returns
+// false if the hub is closed while waiting.
+func (h *serialHub) reconnect() bool {
+	h.port.Close()
+	for {
+		select {
+		case <-time.After(serialReconnectInterval):
+		case <-h.done:
+			return false
+		}
+
+		port, err := serial.Open(h.path, &h.mode)
+		if err != nil {
+			continue
+		}
+
+		serialHubsMu.Lock()
+		if h.closed {
+			serialHubsMu.Unlock()
+			port.Close()
+			return false
+		}
+		h.port = port
+		h.connected = true
+		h.dtr, h.rts = true, true
+		h.broadcastNotice(nil, filepath.Base(h.path)+" reconnected")
+		serialHubsMu.Unlock()
+		return true
+	}
+}
+
+// close closes the port and removes the hub from the registry.
+// serialHubsMu must be held by the caller.
+func (h *serialHub) close() {
+	if h.closed {
+		return
+	}
+	h.closed = true
+	h.port.Close()
+	if h.logger != nil {
+		h.logger.Close()
+	}
+	close(h.done)
+	if serialHubs[h.path] == h {
+		delete(serialHubs, h.path)
+	}
+}
+
+// broadcastNotice sends a status message to every client except
+// the given one. serialHubsMu must be held by the caller.
+func (h *serialHub) broadcastNotice(except *serialClient, msg string) {
+	for _, c := range h.clients {
+		if c != except {
+			c.sendNotice(msg)
+		}
+	}
+}
+
+// sendNotice sends a status message to the client, dropping
+// it if the client has too many pending messages.
+func (c *serialClient) sendNotice(msg string) {
+	select {
+	case c.notify <- msg:
+	default:
+	}
+}
+
+// serialModesEqual checks whether two serial modes have the same settings.
+func serialModesEqual(a, b serial.Mode) bool {
+	return a.BaudRate == b.BaudRate &&
+		a.DataBits == b.DataBits &&
+		a.Parity == b.Parity &&
+		a.StopBits == b.StopBits
+}
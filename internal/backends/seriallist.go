@@ -0,0 +1,89 @@
+/*
+ * Seashell - SSH server with virtual hosts and username-based routing
+ *
+ * Copyright (C) 2024 Elara6331 <elara@elara.ws>
+ *
+ * This file is part of Seashell.
+ *
+ * Seashell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * Seashell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with Seashell.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package backends
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/gliderlabs/ssh"
+	"go.bug.st/serial/enumerator"
+	"go.elara.ws/seashell/internal/config"
+	"go.elara.ws/seashell/internal/sshctx"
+)
+
+// serialListPorts writes the serial ports in dir that the user is allowed
+// to access to the session, along with a description of any USB devices.
+func serialListPorts(sess ssh.Session, route config.Route, dir string) error {
+	user, _ := sshctx.GetUser(sess.Context())
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	// Getting the port details is best-effort, since it isn't
+	// supported everywhere. The ports are still listed without them.
+	details := map[string]*enumerator.PortDetails{}
+	if ports, err := enumerator.GetDetailedPortsList(); err == nil {
+		for _, port := range ports {
+			details[port.Name] = port
+		}
+	}
+
+	tw := tabwriter.NewWriter(sess, 0, 0, 2, ' ', 0)
+	for _, entry := range entries {
+		if entry.IsDir() || !route.Permissions.IsAllowed(user, entry.Name()) {
+			continue
+		}
+
+		path := filepath.Join(dir, entry.Name())
+		// Entries such as the ones in /dev/serial/by-id
+		// are symlinks to the actual device files.
+		if target, err := filepath.EvalSymlinks(path); err == nil {
+			path = target
+		}
+
+		fmt.Fprintf(tw, "%s\t%s\r\n", entry.Name(), serialPortDescription(details[path]))
+	}
+
+	return tw.Flush()
+}
+
+// serialPortDescription returns a human-readable description of a port.
+func serialPortDescription(port *enumerator.PortDetails) string {
+	if port == nil || !port.IsUSB {
+		return ""
+	}
+
+	desc := []string{"USB " + port.VID + ":" + port.PID}
+	if port.Product != "" {
+		desc = append(desc, port.Product)
+	}
+	if port.SerialNumber != "" {
+		desc = append(desc, "(serial "+port.SerialNumber+")")
+	}
+	return strings.Join(desc, " ")
+}
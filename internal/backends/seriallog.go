@@ -0,0 +1,180 @@
+/*
+ * Seashell - SSH server with virtual hosts and username-based routing
+ *
+ * Copyright (C) 2024 Elara6331 <elara@elara.ws>
+ *
+ * This file is part of Seashell.
+ *
+ * Seashell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * Seashell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with Seashell.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package backends
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/docker/go-units"
+	"go.bug.st/serial"
+)
+
+// serialCaptureRetry is how long to wait before trying to
+// open a captured serial port again after it fails.
+const serialCaptureRetry = 5 * time.Second
+
+// serialLogConfig represents the settings used to log serial traffic.
+type serialLogConfig struct {
+	dir      string
+	maxSize  int64
+	maxFiles int
+}
+
+// logConfig returns the traffic logging settings for the route,
+// or nil if logging isn't enabled.
+func (opts serialSettings) logConfig() (*serialLogConfig, error) {
+	if opts.LogDir == nil {
+		return nil, nil
+	}
+
+	maxSize, err := units.FromHumanSize(valueOr(opts.LogMaxSize, "10MB"))
+	if err != nil {
+		return nil, err
+	}
+
+	return &serialLogConfig{
+		dir:      *opts.LogDir,
+		maxSize:  maxSize,
+		maxFiles: valueOr(opts.LogMaxFiles, 10),
+	}, nil
+}
+
+// serialLogger writes all the data sent to and received from a serial port
+// to timestamped files. A new file is started whenever the current one grows
+// beyond the maximum size, and the oldest files are removed once there are
+// too many of them.
+type serialLogger struct {
+	cfg  serialLogConfig
+	name string
+
+	mu       sync.Mutex
+	file     *os.File
+	size     int64
+	lastKind string
+}
+
+// newSerialLogger creates a logger for the serial port at path.
+func newSerialLogger(cfg serialLogConfig, path string) *serialLogger {
+	return &serialLogger{cfg: cfg, name: filepath.Base(path)}
+}
+
+// log writes data to the current log file. kind is either RX or TX, and a
+// header with the current time is written whenever it changes. Logging is
+// best-effort, so errors are ignored rather than interrupting the session.
+func (l *serialLogger) log(kind string, data []byte) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.file == nil || l.size >= l.cfg.maxSize {
+		if err := l.rotate(); err != nil {
+			return
+		}
+	}
+
+	if kind != l.lastKind {
+		n, _ := fmt.Fprintf(l.file, "\n[%s %s]\n", time.Now().Format(time.RFC3339Nano), kind)
+		l.size += int64(n)
+		l.lastKind = kind
+	}
+
+	n, _ := l.file.Write(data)
+	l.size += int64(n)
+}
+
+// rotate closes the current log file, starts a new one, and removes the
+// oldest files if there are more than the maximum. l.mu must be held by
+// the caller.
+func (l *serialLogger) rotate() error {
+	if l.file != nil {
+		l.file.Close()
+		l.file = nil
+	}
+
+	err := os.MkdirAll(l.cfg.dir, 0o755)
+	if err != nil {
+		return err
+	}
+
+	filename := fmt.Sprintf("%s-%s.log", l.name, time.Now().Format("20060102-150405"))
+	fl, err := os.OpenFile(filepath.Join(l.cfg.dir, filename), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+
+	info, err := fl.Stat()
+	if err != nil {
+		fl.Close()
+		return err
+	}
+
+	l.file = fl
+	l.size = info.Size()
+	l.lastKind = ""
+
+	files, err := filepath.Glob(filepath.Join(l.cfg.dir, l.name+"-*.log"))
+	if err != nil {
+		return err
+	}
+
+	// The timestamps in the file names sort chronologically
+	slices.Sort(files)
+	for len(files) > l.cfg.maxFiles {
+		os.Remove(files[0])
+		files = files[1:]
+	}
+
+	return nil
+}
+
+// Close closes the current log file.
+func (l *serialLogger) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+// serialCapture keeps the serial port at path open in the background so
+// that its traffic is logged even when no one is connected to it. If the
+// port can't be opened, it's tried again after a delay.
+func serialCapture(path string, mode *serial.Mode, opts serialHubOptions) {
+	opts.persistent = true
+	for {
+		hub, err := openSerialHub(path, mode, opts)
+		if err != nil {
+			slog.Warn("Error opening serial port for capture", slog.String("path", path), slog.Any("error", err))
+		} else {
+			<-hub.done
+		}
+		time.Sleep(serialCaptureRetry)
+	}
+}
@@ -0,0 +1,88 @@
+/*
+ * Seashell - SSH server with virtual hosts and username-based routing
+ *
+ * Copyright (C) 2024 Elara6331 <elara@elara.ws>
+ *
+ * This file is part of Seashell.
+ *
+ * Seashell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * Seashell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with Seashell.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package backends
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/zclconf/go-cty/cty"
+)
+
+// serialLineMap translates line endings in the data sent between a client
+// and a serial port. The mappings are the same as picocom's imap and omap
+// options: crlf, crcrlf, igncr, lfcr, lfcrlf, and ignlf.
+type serialLineMap struct {
+	// cr and lf are what CR and LF characters are replaced with
+	cr, lf []byte
+}
+
+// newSerialLineMap parses a list of line-ending mappings. It returns
+// nil if the list is empty.
+func newSerialLineMap(val *cty.Value) (*serialLineMap, error) {
+	maps := ctyTupleToStrings(val)
+	if len(maps) == 0 {
+		return nil, nil
+	}
+
+	lm := &serialLineMap{cr: []byte{'\r'}, lf: []byte{'\n'}}
+	for _, m := range maps {
+		switch m {
+		case "crlf":
+			lm.cr = []byte{'\n'}
+		case "crcrlf":
+			lm.cr = []byte{'\r', '\n'}
+		case "igncr":
+			lm.cr = nil
+		case "lfcr":
+			lm.lf = []byte{'\r'}
+		case "lfcrlf":
+			lm.lf = []byte{'\r', '\n'}
+		case "ignlf":
+			lm.lf = nil
+		default:
+			return nil, fmt.Errorf("unknown line-ending mapping: %q", m)
+		}
+	}
+	return lm, nil
+}
+
+// apply translates the line endings in data. If lm is nil,
+// data is returned unchanged.
+func (lm *serialLineMap) apply(data []byte) []byte {
+	if lm == nil || bytes.IndexAny(data, "\r\n") == -1 {
+		return data
+	}
+
+	out := make([]byte, 0, len(data))
+	for _, b := range data {
+		switch b {
+		case '\r':
+			out = append(out, lm.cr...)
+		case '\n':
+			out = append(out, lm.lf...)
+		default:
+			out = append(out, b)
+		}
+	}
+	return out
+}
@@ -0,0 +1,221 @@
+/*
+ * Seashell - SSH server with virtual hosts and username-based routing
+ *
+ * Copyright (C) 2024 Elara6331 <elara@elara.ws>
+ *
+ * This file is part of Seashell.
+ *
+ * Seashell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * Seashell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with Seashell.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package backends
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/pkg/sftp"
+)
+
+// sftpFS is implemented by backends that can serve the SFTP
+// subsystem from their native file API.
+type sftpFS interface {
+	// Stat returns information about the file at the given path.
+	Stat(ctx context.Context, name string) (fs.FileInfo, error)
+	// ReadDir returns information about the files in the given directory.
+	ReadDir(ctx context.Context, name string) ([]fs.FileInfo, error)
+	// Open opens the file at the given path for reading.
+	Open(ctx context.Context, name string) (io.ReadCloser, error)
+}
+
+// sftpWriteFS is implemented by backends that allow SFTP clients
+// to modify files. Backends that don't implement it are read-only.
+type sftpWriteFS interface {
+	sftpFS
+	// WriteFile writes everything read from r to the given path.
+	WriteFile(ctx context.Context, name string, r io.Reader) error
+	// Mkdir creates a directory at the given path.
+	Mkdir(ctx context.Context, name string) error
+}
+
+// sftpReaderAtFS is implemented by backends that support random access
+// reads, so that files don't have to be downloaded before being read.
+type sftpReaderAtFS interface {
+	sftpFS
+	// OpenReaderAt opens the file at the given path for random access reads.
+	OpenReaderAt(ctx context.Context, name string) (io.ReaderAt, error)
+}
+
+// serveSFTP serves the SFTP subsystem over the SSH session using fsys.
+func serveSFTP(sess ssh.Session, fsys sftpFS) error {
+	h := sftpHandler{ctx: sess.Context(), fsys: fsys}
+	srv := sftp.NewRequestServer(sess, sftp.Handlers{
+		FileGet:  h,
+		FilePut:  h,
+		FileCmd:  h,
+		FileList: h,
+	})
+	defer srv.Close()
+
+	err := srv.Serve()
+	if errors.Is(err, io.EOF) {
+		return nil
+	}
+	return err
+}
+
+// sftpHandler implements the SFTP request handlers on top of an sftpFS.
+//
+// Backend file APIs are generally stream-based, while SFTP needs random
+// access, so files are buffered in temporary files while they're open.
+type sftpHandler struct {
+	ctx  context.Context
+	fsys sftpFS
+}
+
+// Fileread downloads the requested file so it can be read by the client,
+// unless the backend supports random access reads.
+func (h sftpHandler) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	if rfs, ok := h.fsys.(sftpReaderAtFS); ok {
+		return rfs.OpenReaderAt(h.ctx, r.Filepath)
+	}
+
+	rc, err := h.fsys.Open(h.ctx, r.Filepath)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	tmp, err := newSFTPTempFile()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = io.Copy(tmp, rc); err != nil {
+		tmp.Close()
+		return nil, err
+	}
+
+	return tmp, nil
+}
+
+// Filewrite returns a temporary file that the client can write to, which
+// gets uploaded when it's closed.
+func (h sftpHandler) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	wfs, ok := h.fsys.(sftpWriteFS)
+	if !ok {
+		return nil, os.ErrPermission
+	}
+
+	tmp, err := newSFTPTempFile()
+	if err != nil {
+		return nil, err
+	}
+
+	// Upload the file once the client closes it
+	tmp.onClose = func(f *os.File) error {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		return wfs.WriteFile(h.ctx, r.Filepath, f)
+	}
+
+	return tmp, nil
+}
+
+// Filecmd handles commands that modify the filesystem.
+func (h sftpHandler) Filecmd(r *sftp.Request) error {
+	switch r.Method {
+	case "Setstat":
+		// Backend file APIs don't generally allow changing file
+		// attributes, but clients expect this to succeed after
+		// uploading a file, so it's ignored.
+		return nil
+	case "Mkdir":
+		wfs, ok := h.fsys.(sftpWriteFS)
+		if !ok {
+			return os.ErrPermission
+		}
+		return wfs.Mkdir(h.ctx, r.Filepath)
+	default:
+		return sftp.ErrSSHFxOpUnsupported
+	}
+}
+
+// Filelist handles directory listing and stat requests.
+func (h sftpHandler) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	switch r.Method {
+	case "List":
+		files, err := h.fsys.ReadDir(h.ctx, r.Filepath)
+		return sftpLister(files), err
+	case "Stat", "Lstat":
+		// The backends' file APIs have no way to stat a symlink itself,
+		// so lstat requests, which many clients send when listing
+		// directories, are treated the same as stat requests.
+		fi, err := h.fsys.Stat(h.ctx, r.Filepath)
+		if err != nil {
+			return nil, err
+		}
+		return sftpLister{fi}, nil
+	default:
+		return nil, sftp.ErrSSHFxOpUnsupported
+	}
+}
+
+// sftpLister implements sftp.ListerAt for a slice of file info.
+type sftpLister []fs.FileInfo
+
+// ListAt copies file info starting at offset into out.
+func (l sftpLister) ListAt(out []fs.FileInfo, offset int64) (int, error) {
+	if offset >= int64(len(l)) {
+		return 0, io.EOF
+	}
+
+	n := copy(out, l[offset:])
+	if n < len(out) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// sftpTempFile is a temporary file that's removed when it's closed.
+// If onClose is set, it's called before the file is removed.
+type sftpTempFile struct {
+	*os.File
+	onClose func(*os.File) error
+}
+
+// newSFTPTempFile creates a new temporary file for an SFTP transfer.
+func newSFTPTempFile() (*sftpTempFile, error) {
+	f, err := os.CreateTemp("", "seashell-sftp-*")
+	if err != nil {
+		return nil, err
+	}
+	return &sftpTempFile{File: f}, nil
+}
+
+// Close runs onClose if it's set, then closes and removes the file.
+func (tf *sftpTempFile) Close() error {
+	defer os.Remove(tf.Name())
+	defer tf.File.Close()
+
+	if tf.onClose != nil {
+		return tf.onClose(tf.File)
+	}
+	return nil
+}
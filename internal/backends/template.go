@@ -0,0 +1,91 @@
+/*
+ * Seashell - SSH server with virtual hosts and username-based routing
+ *
+ * Copyright (C) 2024 Elara6331 <elara@elara.ws>
+ *
+ * This file is part of Seashell.
+ *
+ * Seashell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * Seashell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with Seashell.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package backends
+
+import (
+	"strings"
+	"text/template"
+
+	"github.com/gliderlabs/ssh"
+	"go.elara.ws/seashell/internal/sshctx"
+)
+
+// templateData is the data available to per-session templates
+// in route settings, e.x. {{.User}}.
+type templateData struct {
+	// User is the name of the authenticated user
+	User string
+	// Group is the user's first group, if they have any
+	Group string
+	// Groups contains all of the user's groups
+	Groups []string
+	// Arg is the argument extracted from the route match
+	Arg string
+}
+
+// newTemplateData creates template data for the given session and arg.
+func newTemplateData(sess ssh.Session, arg string) templateData {
+	user, _ := sshctx.GetUser(sess.Context())
+	data := templateData{
+		User:   user.Name,
+		Groups: user.Groups,
+		Arg:    arg,
+	}
+	if len(user.Groups) > 0 {
+		data.Group = user.Groups[0]
+	}
+	return data
+}
+
+// expandTemplate expands a per-session template in a setting value.
+// Values without any template actions are returned as-is.
+func expandTemplate(name, text string, data templateData) (string, error) {
+	if !strings.Contains(text, "{{") {
+		return text, nil
+	}
+
+	tmpl, err := template.New(name).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", err
+	}
+
+	sb := &strings.Builder{}
+	err = tmpl.Execute(sb, data)
+	return sb.String(), err
+}
+
+// expandSettings expands the per-session templates in the given string
+// settings in place. Settings that aren't set are skipped.
+func expandSettings(data templateData, settings map[string]*string) error {
+	for name, val := range settings {
+		if val == nil {
+			continue
+		}
+
+		expanded, err := expandTemplate(name, *val, data)
+		if err != nil {
+			return err
+		}
+		*val = expanded
+	}
+	return nil
+}
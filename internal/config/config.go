@@ -22,58 +22,636 @@
 package config
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/hashicorp/hcl/v2"
 	"github.com/hashicorp/hcl/v2/hclsimple"
 	"github.com/zclconf/go-cty/cty"
+	"gopkg.in/yaml.v3"
 )
 
 // Config represents the main config structure.
 type Config struct {
+	// Include contains glob patterns matching additional files that
+	// contain route, route_defaults, and user blocks. Relative patterns
+	// are resolved relative to the directory of the main config file.
+	Include  []string  `hcl:"include,optional"`
 	Settings *Settings `hcl:"settings,block"`
-	Routes   []Route   `hcl:"route,block"`
-	Auth     Auth      `hcl:"auth,block"`
+	// BackendDefaults contains the default settings for each backend,
+	// which are used by routes that don't set them.
+	BackendDefaults []BackendDefaults `hcl:"backend_defaults,block"`
+	RouteDefaults   []RouteDefaults   `hcl:"route_defaults,block"`
+	Routes          []Route           `hcl:"route,block"`
+	Auth            Auth              `hcl:"auth,block"`
+	Vault           *Vault            `hcl:"vault,block"`
+}
+
+// Vault contains the settings used to connect to a HashiCorp Vault server.
+// If address or token are empty, VAULT_ADDR and VAULT_TOKEN are used.
+type Vault struct {
+	Address   string `hcl:"address,optional"`
+	Token     string `hcl:"token,optional"`
+	TokenFile string `hcl:"token_file,optional"`
+	Namespace string `hcl:"namespace,optional"`
 }
 
 // Settings represents settings for the SSH server.
 type Settings struct {
-	SSHDir     string `hcl:"ssh_dir,optional"`
-	ListenAddr string `hcl:"listen_addr,optional"`
-	Debug      bool   `hcl:"debug,optional"`
+	SSHDir      string `hcl:"ssh_dir,optional"`
+	ListenAddr  string `hcl:"listen_addr,optional"`
+	MetricsAddr string `hcl:"metrics_addr,optional"`
+	Debug       bool   `hcl:"debug,optional"`
+	// AllowCIDRs and DenyCIDRs filter incoming connections by the
+	// client's address before they're allowed to authenticate.
+	AllowCIDRs []string `hcl:"allow_cidrs,optional"`
+	DenyCIDRs  []string `hcl:"deny_cidrs,optional"`
+	// MaxSessions limits the number of concurrent sessions each user
+	// can have across all routes. Zero means there's no limit.
+	MaxSessions int `hcl:"max_sessions,optional"`
+	// HostKeyTypes contains the algorithms (ed25519, rsa, or ecdsa) to
+	// generate host keys for if the ssh directory doesn't have one.
+	HostKeyTypes []string `hcl:"host_key_types,optional"`
+	// HostKeyRSABits and HostKeyECDSABits are the sizes of generated RSA
+	// (3072 by default) and ECDSA (256, 384, or 521, 256 by default) keys.
+	HostKeyRSABits   int `hcl:"host_key_rsa_bits,optional"`
+	HostKeyECDSABits int `hcl:"host_key_ecdsa_bits,optional"`
+	// KexAlgorithms, Ciphers, MACs, and HostKeyAlgorithms restrict the
+	// algorithms the server offers to clients, in order of preference.
+	// Empty lists use the defaults.
+	KexAlgorithms     []string `hcl:"kex_algorithms,optional"`
+	Ciphers           []string `hcl:"ciphers,optional"`
+	MACs              []string `hcl:"macs,optional"`
+	HostKeyAlgorithms []string `hcl:"host_key_algorithms,optional"`
+	// Version replaces the software version in the SSH identification
+	// string sent to clients, which is "SSH-2.0-" followed by it.
+	Version string `hcl:"version,optional"`
+	// Banner is a message, like a legal notice, that's
+	// shown to clients before they authenticate.
+	Banner string `hcl:"banner,optional"`
 }
 
 // Route represents a virtual host configuration.
 type Route struct {
-	Name        string         `hcl:"name,label"`
-	Backend     string         `hcl:"backend"`
-	Match       string         `hcl:"match"`
-	Settings    cty.Value      `hcl:"settings"`
-	Permissions PermissionsMap `hcl:"permissions,optional"`
+	Name string `hcl:"name,label"`
+	// Extends is the name of a route_defaults block whose
+	// settings are used for anything the route doesn't set.
+	Extends     string            `hcl:"extends,optional"`
+	Backend     string            `hcl:"backend,optional"`
+	Match       string            `hcl:"match"`
+	Labels      map[string]string `hcl:"labels,optional"`
+	Permissions PermissionsMap    `hcl:"permissions,optional"`
+	Users       []string          `hcl:"users,optional"`
+	Groups      []string          `hcl:"groups,optional"`
+	MaxSessions int               `hcl:"max_sessions,optional"`
+	// Settings contains the backend's settings. Instead, they can be
+	// set in a block named after the backend, e.x. docker { ... }.
+	Settings cty.Value        `hcl:"settings,optional"`
+	Proxy    *BackendSettings `hcl:"proxy,block"`
+	Docker   *BackendSettings `hcl:"docker,block"`
+	Nomad    *BackendSettings `hcl:"nomad,block"`
+	Serial   *BackendSettings `hcl:"serial,block"`
+	// RequireReauth makes users enter their password or a TOTP code
+	// again at the start of each session. It can be "password" or "totp".
+	RequireReauth string `hcl:"require_reauth,optional"`
+	// Approval makes sessions wait until a second user approves them.
+	Approval *Approval `hcl:"approval,block"`
+	Chaos    *Chaos    `hcl:"chaos,block"`
+}
+
+// BackendSettings is a block containing the settings of a route's
+// backend. Its attributes are checked by the backend at startup.
+type BackendSettings struct {
+	Body hcl.Body `hcl:",remain"`
+}
+
+// BackendDefaults is a block containing the default settings for all
+// routes that use the backend it's labeled with.
+type BackendDefaults struct {
+	Backend string   `hcl:"backend,label"`
+	Body    hcl.Body `hcl:",remain"`
+}
+
+// settingsValidators contains the functions registered using
+// [RegisterBackend], keyed by the name of their backend.
+var settingsValidators = map[string]func(Route) error{}
+
+// RegisterBackend registers a backend that settings blocks can be used
+// with, along with a function that checks the settings of routes using
+// it. [Load] calls it for each of those routes after resolving their
+// settings, so invalid settings are reported when the config is loaded.
+func RegisterBackend(name string, validate func(Route) error) {
+	settingsValidators[name] = validate
+}
+
+// Approval contains the settings for routes where a second user has to
+// approve each session, using the admin route, before the backend starts.
+type Approval struct {
+	// Users and Groups are the users and groups that can approve
+	// sessions. If both are empty, any admin can approve them.
+	Users  []string `hcl:"users,optional"`
+	Groups []string `hcl:"groups,optional"`
+	// Timeout is how long to wait for approval before
+	// the session is rejected. It's 5 minutes by default.
+	Timeout string `hcl:"timeout,optional"`
+}
+
+// Chaos contains fault injection settings for a route, used to rehearse
+// how users and tooling behave when the connection degrades. They only
+// take effect when debug mode is enabled.
+type Chaos struct {
+	Latency         string  `hcl:"latency,optional"`
+	FailureRate     float64 `hcl:"failure_rate,optional"`
+	DisconnectAfter string  `hcl:"disconnect_after,optional"`
+	DisconnectRate  float64 `hcl:"disconnect_rate,optional"`
 }
 
 // Auth contains the authentication settings.
 type Auth struct {
 	Fail2Ban *Fail2Ban `hcl:"fail2ban,block"`
+	LDAP     *LDAP     `hcl:"ldap,block"`
+	Database *Database `hcl:"database,block"`
+	Webhook  *Webhook  `hcl:"webhook,block"`
+	GSSAPI   *GSSAPI   `hcl:"gssapi,block"`
 	Users    []User    `hcl:"user,block"`
+	// Groups contain group members, in addition to
+	// the groups listed in each user's settings.
+	Groups []Group `hcl:"group,block"`
+	// Schedules limit when users and groups can connect
+	Schedules []Schedule `hcl:"schedule,block"`
+	// VaultCacheTTL is how long user credentials read from Vault are cached
+	VaultCacheTTL string `hcl:"vault_cache_ttl,optional"`
+	// UserFiles contains glob patterns matching additional files that
+	// contain user blocks. Relative patterns are resolved relative to
+	// the directory of the main config file.
+	UserFiles []string `hcl:"user_files,optional"`
+	// Chain contains authentication methods (publickey, password, or totp)
+	// that users must complete, in order, before they can log in.
+	Chain []string `hcl:"chain,optional"`
+	// PasswordAuth is the default for whether users can log in using
+	// a password. It's true if unset.
+	PasswordAuth *bool `hcl:"password_auth,optional"`
+	// PubkeyLookup enables finding users by the public key they present
+	// when the SSH username doesn't contain one, so the whole username
+	// can be used as the routing argument.
+	PubkeyLookup bool `hcl:"pubkey_lookup,optional"`
+	// RevokedKeys contains paths to OpenSSH KRLs or files with
+	// revoked public keys, which are reloaded when they change.
+	RevokedKeys []string `hcl:"revoked_keys,optional"`
+	// SelfService enables the built-in routes users can use to
+	// manage their own public keys and change their password.
+	SelfService *SelfService `hcl:"self_service,block"`
+	// Admin enables the built-in admin route.
+	Admin *Admin `hcl:"admin,block"`
+}
+
+// Admin contains the settings for the built-in route admins can use to
+// manage seashell while it's running, such as granting temporary access.
+type Admin struct {
+	// Match is the pattern matching the route's routing
+	// argument. It's "^admin$" by default.
+	Match string `hcl:"match,optional"`
+	// Users and Groups are the users and groups that can use the
+	// admin route. At least one of them has to be set.
+	Users  []string `hcl:"users,optional"`
+	Groups []string `hcl:"groups,optional"`
+	// GrantsFile is where access grants are saved, so they
+	// aren't lost on restart. If it's unset, they're only
+	// kept in memory.
+	GrantsFile string `hcl:"grants_file,optional"`
+}
+
+// SelfService contains the settings for the built-in routes where
+// users can manage their own public keys and change their password.
+type SelfService struct {
+	// Match is the pattern matching the route's routing
+	// argument. It's "^keys$" by default.
+	Match string `hcl:"match,optional"`
+	// KeysDir is the directory where keys added by users from the config
+	// are saved, in a file named after each user. Keys of users from the
+	// user database are saved in the database.
+	KeysDir string `hcl:"keys_dir"`
+	// PasswdMatch is the pattern matching the routing argument of the
+	// route where users can change their password. It's "^passwd$"
+	// by default.
+	PasswdMatch string `hcl:"passwd_match,optional"`
+	// PasswordsDir is the directory where password hashes set by users
+	// from the config are saved. If it's unset, only users from the user
+	// database can change their password.
+	PasswordsDir string `hcl:"passwords_dir,optional"`
+}
+
+// GSSAPI contains the settings used to authenticate users with Kerberos
+// tickets. Principals are mapped to seashell users using regular
+// expressions, and the mapped user must be the one the client logs in as.
+type GSSAPI struct {
+	Keytab string `hcl:"keytab"`
+	// ServicePrincipal overrides the principal used
+	// to find the service key in the keytab.
+	ServicePrincipal string `hcl:"service_principal,optional"`
+	// Principals contains regular expressions matching Kerberos principals.
+	// The username is the "user" capture group, or the whole match if the
+	// pattern doesn't have one.
+	Principals []string `hcl:"principals"`
 }
 
 // Fail2Ban contains the fail2ban rate limiter settings.
 type Fail2Ban struct {
 	Limit    string `hcl:"limit"`
 	Attempts int    `hcl:"attempts"`
+	// BanTime is how long addresses are banned the first time.
+	// It defaults to the limit, and doubles for every repeated offense.
+	BanTime string `hcl:"ban_time,optional"`
+	// MaxBanTime is the longest a ban can last. It defaults to 24h.
+	MaxBanTime string `hcl:"max_ban_time,optional"`
+	// SubnetAttempts is the amount of failed logins from a /24 (IPv4)
+	// or /64 (IPv6) subnet after which the whole subnet is banned.
+	// Subnets aren't banned if it's not set.
+	SubnetAttempts int `hcl:"subnet_attempts,optional"`
+	// UserAttempts is the amount of failed password logins for a single
+	// user, from any address, after which the user is locked out. Users
+	// aren't locked out if it's not set.
+	UserAttempts int `hcl:"user_attempts,optional"`
+	// IgnoreCIDRs contains the ranges of addresses that are never banned,
+	// such as monitoring probes and internal automation.
+	IgnoreCIDRs []string `hcl:"ignore_cidrs,optional"`
+	// BanCommand and UnbanCommand are run when an address or subnet is
+	// banned or unbanned. Their arguments are templates, e.x. {{.Addr}}.
+	BanCommand   []string `hcl:"ban_command,optional"`
+	UnbanCommand []string `hcl:"unban_command,optional"`
+	// LockCommand is run when a user is locked out, e.x. to notify them.
+	// Its arguments are templates, e.x. {{.User}}.
+	LockCommand []string `hcl:"lock_command,optional"`
+	// NFTablesSet is an nftables set ("family table set") that banned
+	// addresses are added to for as long as they're banned.
+	NFTablesSet string `hcl:"nftables_set,optional"`
+	// StateFile is where the attempt counts and bans are saved,
+	// so they aren't reset when seashell restarts.
+	StateFile string `hcl:"state_file,optional"`
+	// Redis is used to store the attempt counts and bans instead, so that
+	// they're shared by multiple seashell instances.
+	Redis *Redis `hcl:"redis,block"`
 }
 
-// User contains the configuration for a virtual user.
-type User struct {
+// Redis contains the settings used to connect to a Redis server.
+type Redis struct {
+	URL    string `hcl:"url"`
+	Prefix string `hcl:"prefix,optional"`
+}
+
+// LDAP contains the settings used to authenticate users against an LDAP
+// or Active Directory server. Users found in the directory are mapped to
+// seashell groups based on the groups they're a member of.
+type LDAP struct {
+	URL              string            `hcl:"url"`
+	BindDN           string            `hcl:"bind_dn,optional"`
+	BindPassword     string            `hcl:"bind_password,optional"`
+	BindPasswordFile string            `hcl:"bind_password_file,optional"`
+	SearchBase       string            `hcl:"search_base"`
+	UserFilter       string            `hcl:"user_filter,optional"`
+	GroupAttribute   string            `hcl:"group_attribute,optional"`
+	GroupMap         map[string]string `hcl:"group_map,optional"`
+	DefaultGroups    []string          `hcl:"default_groups,optional"`
+	StartTLS         bool              `hcl:"start_tls,optional"`
+	TLSCACert        string            `hcl:"tls_ca_cert,optional"`
+	TLSSkipVerify    bool              `hcl:"tls_skip_verify,optional"`
+}
+
+// Database contains the settings used to load users from a database.
+// The supported drivers are sqlite and postgres.
+type Database struct {
+	Driver  string `hcl:"driver"`
+	DSN     string `hcl:"dsn,optional"`
+	DSNFile string `hcl:"dsn_file,optional"`
+}
+
+// Webhook contains the settings for an HTTP endpoint that decides whether
+// users that aren't configured anywhere else are allowed to log in.
+type Webhook struct {
+	URL     string            `hcl:"url"`
+	Timeout string            `hcl:"timeout,optional"`
+	Headers map[string]string `hcl:"headers,optional"`
+}
+
+// Schedule restricts the listed users and members of the listed groups to
+// connecting during certain times. Days are given as names like "mon", and
+// the start and end times as HH:MM in the schedule's timezone.
+type Schedule struct {
 	Name     string   `hcl:"name,label"`
-	Password string   `hcl:"password,optional"`
+	Users    []string `hcl:"users,optional"`
 	Groups   []string `hcl:"groups,optional"`
-	Pubkeys  []string `hcl:"pubkeys,optional"`
+	Days     []string `hcl:"days,optional"`
+	Start    string   `hcl:"start"`
+	End      string   `hcl:"end"`
+	Timezone string   `hcl:"timezone,optional"`
+}
+
+// User contains the configuration for a virtual user.
+type User struct {
+	Name         string   `hcl:"name,label"`
+	Password     string   `hcl:"password,optional"`
+	PasswordFile string   `hcl:"password_file,optional"`
+	Groups       []string `hcl:"groups,optional"`
+	Pubkeys      []string `hcl:"pubkeys,optional"`
+	// VaultPassword and VaultPubkeys are references to Vault secret
+	// fields in the form path#field, which are read at login time.
+	VaultPassword string `hcl:"vault_password,optional"`
+	VaultPubkeys  string `hcl:"vault_pubkeys,optional"`
+	// Expires is the date (YYYY-MM-DD) or RFC 3339 timestamp
+	// after which the user can no longer log in.
+	Expires string `hcl:"expires,optional"`
+	// TOTPSecret is the base32-encoded secret used
+	// to check codes in a totp authentication step.
+	TOTPSecret string `hcl:"totp_secret,optional"`
+	// Guest users can log in without any credentials, but can
+	// only use routes that explicitly list them in their users.
+	Guest bool `hcl:"guest,optional"`
+	// PasswordAuth overrides the default for whether
+	// this user can log in using a password.
+	PasswordAuth *bool `hcl:"password_auth,optional"`
+}
+
+// usersFile represents the structure of an additional users file.
+type usersFile struct {
+	Users []User `hcl:"user,block"`
+}
+
+// includeFile represents the structure of an included config file.
+type includeFile struct {
+	RouteDefaults []RouteDefaults `hcl:"route_defaults,block"`
+	Routes        []Route         `hcl:"route,block"`
+	Users         []User          `hcl:"user,block"`
 }
 
 // Load loads the configuration from the specified path.
 func Load(path string) (cfg Config, err error) {
-	err = hclsimple.DecodeFile(path, nil, &cfg)
+	ctx := evalContext(filepath.Dir(path))
+
+	err = decodeFile(path, ctx, &cfg)
 	if cfg.Settings == nil {
 		cfg.Settings = &Settings{}
 	}
-	return cfg, err
+	if err != nil {
+		return cfg, err
+	}
+
+	err = loadIncludes(&cfg, filepath.Dir(path), ctx)
+	if err != nil {
+		return cfg, err
+	}
+
+	err = loadUserFiles(&cfg, filepath.Dir(path), ctx)
+	if err != nil {
+		return cfg, err
+	}
+
+	err = loadSecrets(&cfg, filepath.Dir(path))
+	if err != nil {
+		return cfg, err
+	}
+
+	err = resolveRoutes(&cfg, ctx)
+	if err != nil {
+		return cfg, err
+	}
+	return cfg, nil
+}
+
+// loadSecrets reads the secrets that were given as file paths, so they
+// can be mounted from places like systemd credentials or Kubernetes
+// secrets instead of being written into the config.
+func loadSecrets(cfg *Config, dir string) error {
+	if cfg.Vault != nil {
+		if err := readSecret(&cfg.Vault.Token, cfg.Vault.TokenFile, dir, "vault", "token"); err != nil {
+			return err
+		}
+	}
+
+	if cfg.Auth.LDAP != nil {
+		if err := readSecret(&cfg.Auth.LDAP.BindPassword, cfg.Auth.LDAP.BindPasswordFile, dir, "ldap", "bind_password"); err != nil {
+			return err
+		}
+	}
+
+	if cfg.Auth.Database != nil {
+		if err := readSecret(&cfg.Auth.Database.DSN, cfg.Auth.Database.DSNFile, dir, "database", "dsn"); err != nil {
+			return err
+		} else if cfg.Auth.Database.DSN == "" {
+			return errors.New("database: one of dsn or dsn_file must be set")
+		}
+	}
+
+	for i, user := range cfg.Auth.Users {
+		block := fmt.Sprintf("user %q", user.Name)
+		if err := readSecret(&cfg.Auth.Users[i].Password, user.PasswordFile, dir, block, "password"); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// readSecret sets val to the contents of the file at path, with any
+// surrounding whitespace removed. Relative paths are resolved from dir.
+// It does nothing if path is empty, and returns an error if val was
+// already set in the config. block and field are used in error messages.
+func readSecret(val *string, path, dir, block, field string) error {
+	if path == "" {
+		return nil
+	} else if *val != "" {
+		return fmt.Errorf("%s: %s and %s_file can't both be set", block, field, field)
+	}
+
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("%s: %s_file: %w", block, field, err)
+	}
+	*val = strings.TrimSpace(string(data))
+	return nil
+}
+
+// resolveSettings sets the route's settings to the attributes of its
+// backend settings block, if it has one. Routes without any settings
+// get an empty object.
+func resolveSettings(route *Route, ctx *hcl.EvalContext) error {
+	blocks := map[string]*BackendSettings{
+		"proxy":  route.Proxy,
+		"docker": route.Docker,
+		"nomad":  route.Nomad,
+		"serial": route.Serial,
+	}
+
+	hasSettings := route.Settings != cty.NilVal && !route.Settings.IsNull()
+	for name, block := range blocks {
+		if block == nil {
+			continue
+		} else if name != route.Backend {
+			return fmt.Errorf("route %q: %s block can't be used with the %s backend", route.Name, name, route.Backend)
+		} else if hasSettings {
+			return fmt.Errorf("route %q: settings and %s block can't both be set", route.Name, name)
+		}
+
+		val, err := bodyValue(block.Body, ctx)
+		if err != nil {
+			return err
+		}
+		route.Settings = val
+		return nil
+	}
+
+	if !hasSettings {
+		route.Settings = cty.EmptyObjectVal
+	}
+	return nil
+}
+
+// bodyValue evaluates the attributes in body and returns them as an object.
+func bodyValue(body hcl.Body, ctx *hcl.EvalContext) (cty.Value, error) {
+	attrs, diags := body.JustAttributes()
+	if diags.HasErrors() {
+		return cty.NilVal, diags
+	}
+
+	vals := make(map[string]cty.Value, len(attrs))
+	for name, attr := range attrs {
+		val, diags := attr.Expr.Value(ctx)
+		if diags.HasErrors() {
+			return cty.NilVal, diags
+		}
+		vals[name] = val
+	}
+	return cty.ObjectVal(vals), nil
+}
+
+// decodeFile decodes the config file at path into target, evaluating
+// expressions using ctx. The format is selected using the file extension:
+// ".json" files use HCL's JSON syntax, ".yaml" and ".yml" files use the
+// same structure written in YAML, and all other files use HCL's native
+// syntax.
+func decodeFile(path string, ctx *hcl.EvalContext, target any) error {
+	switch filepath.Ext(path) {
+	case ".yaml", ".yml":
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		var val any
+		if err := yaml.Unmarshal(data, &val); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		if val == nil {
+			val = map[string]any{}
+		}
+
+		data, err = json.Marshal(val)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+
+		// hclsimple uses the file name to select the
+		// syntax, so the JSON version needs a .json suffix.
+		return hclsimple.Decode(path+".json", data, ctx, target)
+	default:
+		return hclsimple.DecodeFile(path, ctx, target)
+	}
+}
+
+// loadIncludes loads the route, route_defaults, and user blocks from the files
+// matching the patterns in include and adds them to the config, in the order
+// the files are matched. Routes and users can't be defined more than once.
+func loadIncludes(cfg *Config, dir string, ctx *hcl.EvalContext) error {
+	routes := make(map[string]struct{}, len(cfg.Routes))
+	for _, route := range cfg.Routes {
+		routes[route.Name] = struct{}{}
+	}
+
+	users := make(map[string]struct{}, len(cfg.Auth.Users))
+	for _, user := range cfg.Auth.Users {
+		users[user.Name] = struct{}{}
+	}
+
+	for _, pattern := range cfg.Include {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(dir, pattern)
+		}
+
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return err
+		}
+
+		for _, match := range matches {
+			var inc includeFile
+			if err := decodeFile(match, ctx, &inc); err != nil {
+				return err
+			}
+
+			cfg.RouteDefaults = append(cfg.RouteDefaults, inc.RouteDefaults...)
+
+			for _, route := range inc.Routes {
+				if _, ok := routes[route.Name]; ok {
+					return fmt.Errorf("%s: route %q is already defined", match, route.Name)
+				}
+				routes[route.Name] = struct{}{}
+				cfg.Routes = append(cfg.Routes, route)
+			}
+
+			for _, user := range inc.Users {
+				if _, ok := users[user.Name]; ok {
+					return fmt.Errorf("%s: user %q is already defined", match, user.Name)
+				}
+				users[user.Name] = struct{}{}
+				cfg.Auth.Users = append(cfg.Auth.Users, user)
+			}
+		}
+	}
+
+	return nil
+}
+
+// loadUserFiles loads the user blocks from the files matching the patterns
+// in user_files and adds them to the config. Users in the main config file
+// can't be redefined in the additional files.
+func loadUserFiles(cfg *Config, dir string, ctx *hcl.EvalContext) error {
+	seen := make(map[string]struct{}, len(cfg.Auth.Users))
+	for _, user := range cfg.Auth.Users {
+		seen[user.Name] = struct{}{}
+	}
+
+	for _, pattern := range cfg.Auth.UserFiles {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(dir, pattern)
+		}
+
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return err
+		}
+
+		for _, match := range matches {
+			var uf usersFile
+			if err := decodeFile(match, ctx, &uf); err != nil {
+				return err
+			}
+
+			for _, user := range uf.Users {
+				if _, ok := seen[user.Name]; ok {
+					return fmt.Errorf("%s: user %q is already defined", match, user.Name)
+				}
+				seen[user.Name] = struct{}{}
+				cfg.Auth.Users = append(cfg.Auth.Users, user)
+			}
+		}
+	}
+
+	return nil
 }
@@ -0,0 +1,238 @@
+/*
+ * Seashell - SSH server with virtual hosts and username-based routing
+ *
+ * Copyright (C) 2024 Elara6331 <elara@elara.ws>
+ *
+ * This file is part of Seashell.
+ *
+ * Seashell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * Seashell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with Seashell.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package config
+
+import (
+	"fmt"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/zclconf/go-cty/cty"
+)
+
+// RouteDefaults is a reusable route template. Routes that extend it
+// inherit any settings they don't set themselves. It has the same
+// fields as a route, except for the match pattern.
+type RouteDefaults struct {
+	Name string `hcl:"name,label"`
+	// Extends is the name of another template whose
+	// settings this template inherits.
+	Extends       string            `hcl:"extends,optional"`
+	Backend       string            `hcl:"backend,optional"`
+	Labels        map[string]string `hcl:"labels,optional"`
+	Permissions   PermissionsMap    `hcl:"permissions,optional"`
+	Users         []string          `hcl:"users,optional"`
+	Groups        []string          `hcl:"groups,optional"`
+	MaxSessions   int               `hcl:"max_sessions,optional"`
+	Settings      cty.Value         `hcl:"settings,optional"`
+	Proxy         *BackendSettings  `hcl:"proxy,block"`
+	Docker        *BackendSettings  `hcl:"docker,block"`
+	Nomad         *BackendSettings  `hcl:"nomad,block"`
+	Serial        *BackendSettings  `hcl:"serial,block"`
+	RequireReauth string            `hcl:"require_reauth,optional"`
+	Approval      *Approval         `hcl:"approval,block"`
+	Chaos         *Chaos            `hcl:"chaos,block"`
+}
+
+// route converts the template to a route, so that
+// it can be resolved the same way as routes are.
+func (rd RouteDefaults) route() Route {
+	return Route{
+		Name:          rd.Name,
+		Extends:       rd.Extends,
+		Backend:       rd.Backend,
+		Labels:        rd.Labels,
+		Permissions:   rd.Permissions,
+		Users:         rd.Users,
+		Groups:        rd.Groups,
+		MaxSessions:   rd.MaxSessions,
+		Settings:      rd.Settings,
+		Proxy:         rd.Proxy,
+		Docker:        rd.Docker,
+		Nomad:         rd.Nomad,
+		Serial:        rd.Serial,
+		RequireReauth: rd.RequireReauth,
+		Approval:      rd.Approval,
+		Chaos:         rd.Chaos,
+	}
+}
+
+// resolveRoutes resolves the settings of every route and applies the
+// templates they extend, followed by the defaults for their backend.
+func resolveRoutes(cfg *Config, ctx *hcl.EvalContext) error {
+	backendDefaults := make(map[string]cty.Value, len(cfg.BackendDefaults))
+	for _, bd := range cfg.BackendDefaults {
+		if _, ok := settingsValidators[bd.Backend]; !ok {
+			return fmt.Errorf("backend_defaults %q: unknown backend", bd.Backend)
+		} else if _, ok := backendDefaults[bd.Backend]; ok {
+			return fmt.Errorf("backend_defaults %q is defined more than once", bd.Backend)
+		}
+
+		val, err := bodyValue(bd.Body, ctx)
+		if err != nil {
+			return err
+		}
+		backendDefaults[bd.Backend] = val
+	}
+
+	defaults := make(map[string]RouteDefaults, len(cfg.RouteDefaults))
+	for _, rd := range cfg.RouteDefaults {
+		if _, ok := defaults[rd.Name]; ok {
+			return fmt.Errorf("route_defaults %q is defined more than once", rd.Name)
+		}
+		defaults[rd.Name] = rd
+	}
+
+	for i := range cfg.Routes {
+		route := &cfg.Routes[i]
+		if err := extend(route, defaults, map[string]bool{}, ctx); err != nil {
+			return err
+		}
+
+		if route.Backend == "" {
+			return fmt.Errorf("route %q: backend must be set", route.Name)
+		}
+
+		if err := route.Permissions.Validate(); err != nil {
+			return fmt.Errorf("route %q: %w", route.Name, err)
+		}
+
+		if val, ok := backendDefaults[route.Backend]; ok {
+			route.Settings = mergeSettings(val, route.Settings)
+		}
+
+		if validate, ok := settingsValidators[route.Backend]; ok {
+			if err := validate(*route); err != nil {
+				return fmt.Errorf("route %q: invalid backend settings: %w", route.Name, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// resolveDefaults returns the template with the given name as a route,
+// after applying the templates it extends. seen contains the templates
+// that have already been visited, and is used to detect cycles.
+func resolveDefaults(name string, defaults map[string]RouteDefaults, seen map[string]bool, ctx *hcl.EvalContext) (Route, error) {
+	rd, ok := defaults[name]
+	if !ok {
+		return Route{}, fmt.Errorf("no route_defaults named %q", name)
+	} else if seen[name] {
+		return Route{}, fmt.Errorf("route_defaults %q extends itself", name)
+	}
+	seen[name] = true
+
+	route := rd.route()
+	if err := extend(&route, defaults, seen, ctx); err != nil {
+		return Route{}, err
+	}
+	return route, nil
+}
+
+// extend resolves the route's settings and applies the template it
+// extends, if any. The backend is inherited before the settings are
+// resolved, so that routes can use settings blocks for a backend
+// that's only set in the template.
+func extend(route *Route, defaults map[string]RouteDefaults, seen map[string]bool, ctx *hcl.EvalContext) error {
+	if route.Extends == "" {
+		return resolveSettings(route, ctx)
+	}
+
+	base, err := resolveDefaults(route.Extends, defaults, seen, ctx)
+	if err != nil {
+		return fmt.Errorf("route %q: %w", route.Name, err)
+	}
+
+	if route.Backend == "" {
+		route.Backend = base.Backend
+	}
+	if err := resolveSettings(route, ctx); err != nil {
+		return err
+	}
+
+	inherit(route, base)
+	return nil
+}
+
+// inherit copies the settings that aren't set in route from base. Maps,
+// including the backend settings, are merged, with the entries in route
+// taking priority over the ones in base.
+func inherit(route *Route, base Route) {
+	if route.Users == nil {
+		route.Users = base.Users
+	}
+	if route.Groups == nil {
+		route.Groups = base.Groups
+	}
+	if route.MaxSessions == 0 {
+		route.MaxSessions = base.MaxSessions
+	}
+	if route.RequireReauth == "" {
+		route.RequireReauth = base.RequireReauth
+	}
+	if route.Approval == nil {
+		route.Approval = base.Approval
+	}
+	if route.Chaos == nil {
+		route.Chaos = base.Chaos
+	}
+
+	route.Labels = mergeMaps(base.Labels, route.Labels)
+	route.Permissions = mergeMaps(base.Permissions, route.Permissions)
+
+	route.Settings = mergeSettings(base.Settings, route.Settings)
+}
+
+// mergeSettings returns the attributes of base and settings, with the
+// ones in settings taking priority. If either of them isn't an object,
+// settings is returned unchanged, and the backend reports the error.
+func mergeSettings(base, settings cty.Value) cty.Value {
+	if !base.Type().IsObjectType() || !settings.Type().IsObjectType() {
+		return settings
+	}
+
+	vals := mergeMaps(base.AsValueMap(), settings.AsValueMap())
+	if len(vals) == 0 {
+		return cty.EmptyObjectVal
+	}
+	return cty.ObjectVal(vals)
+}
+
+// mergeMaps returns a map containing the entries of base and m,
+// with the entries in m taking priority. If both maps are nil,
+// it returns nil.
+func mergeMaps[K comparable, V any, M ~map[K]V](base, m M) M {
+	if base == nil {
+		return m
+	} else if m == nil {
+		return base
+	}
+
+	out := make(M, len(base)+len(m))
+	for k, v := range base {
+		out[k] = v
+	}
+	for k, v := range m {
+		out[k] = v
+	}
+	return out
+}
@@ -0,0 +1,97 @@
+/*
+ * Seashell - SSH server with virtual hosts and username-based routing
+ *
+ * Copyright (C) 2024 Elara6331 <elara@elara.ws>
+ *
+ * This file is part of Seashell.
+ *
+ * Seashell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * Seashell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with Seashell.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package config
+
+import (
+	"fmt"
+	"slices"
+)
+
+// Group contains the members of a group, so that large teams can be
+// managed in one place instead of each user listing their groups.
+type Group struct {
+	Name string `hcl:"name,label"`
+	// Users contains the names of the group's members.
+	Users []string `hcl:"users,optional"`
+	// Groups contains groups whose members are
+	// also members of this group.
+	Groups []string `hcl:"groups,optional"`
+}
+
+// Membership finds the groups users are members of
+// based on the group blocks in the config.
+type Membership struct {
+	// direct maps users to the groups that list them
+	direct map[string][]string
+	// parents maps groups to the groups that include them
+	parents map[string][]string
+}
+
+// NewMembership creates a Membership from the given groups.
+func NewMembership(groups []Group) (Membership, error) {
+	m := Membership{
+		direct:  map[string][]string{},
+		parents: map[string][]string{},
+	}
+
+	seen := make(map[string]struct{}, len(groups))
+	for _, group := range groups {
+		if _, ok := seen[group.Name]; ok {
+			return Membership{}, fmt.Errorf("group %q is defined more than once", group.Name)
+		}
+		seen[group.Name] = struct{}{}
+
+		for _, user := range group.Users {
+			m.direct[user] = append(m.direct[user], group.Name)
+		}
+		for _, member := range group.Groups {
+			m.parents[member] = append(m.parents[member], group.Name)
+		}
+	}
+
+	return m, nil
+}
+
+// Expand returns the user with all the groups they're a member of,
+// including groups that list them and groups that include one of
+// their groups, directly or through other groups.
+func (m Membership) Expand(user User) User {
+	groups := slices.Clone(user.Groups)
+	for _, group := range m.direct[user.Name] {
+		if !slices.Contains(groups, group) {
+			groups = append(groups, group)
+		}
+	}
+
+	// groups is extended while it's being iterated over,
+	// so that the parents of added groups are added too.
+	for i := 0; i < len(groups); i++ {
+		for _, parent := range m.parents[groups[i]] {
+			if !slices.Contains(groups, parent) {
+				groups = append(groups, parent)
+			}
+		}
+	}
+
+	user.Groups = groups
+	return user
+}
@@ -22,7 +22,12 @@
 package config
 
 import (
+	"fmt"
+	"regexp"
+	"regexp/syntax"
+	"slices"
 	"strings"
+	"sync"
 )
 
 // PermissionsMap defines the config structure for permissions.
@@ -38,11 +43,14 @@ func (pm PermissionsMap) IsAllowed(u User, items ...string) bool {
 		return true
 	}
 
+	// A new slice is used, since appending to the user's groups
+	// could write to an array shared with other sessions.
+	groups := slices.Concat(u.Groups, []string{"all"})
+
 	for _, item := range items {
 		allowed := false
 		denied := false
 
-		groups := append(u.Groups, "all")
 		for _, group := range groups {
 			perms, ok := pm[group]
 			if !ok {
@@ -79,11 +87,172 @@ func (pm PermissionsMap) IsAllowed(u User, items ...string) bool {
 	return true
 }
 
-// matchPattern checks if an item matches a given pattern.
+// IsGranted checks if the user has been explicitly granted the item. Unlike
+// [PermissionsMap.IsAllowed], empty permissions and allow rules consisting
+// only of a wildcard don't grant anything, so this can be used for items
+// that should be denied unless an admin has opted into them.
+func (pm PermissionsMap) IsGranted(u User, item string) bool {
+	if pm == nil || !pm.IsAllowed(u, item) {
+		return false
+	}
+
+	for _, group := range slices.Concat(u.Groups, []string{"all"}) {
+		for _, allowItem := range pm[group]["allow"] {
+			if allowItem != "*" && matchPattern(allowItem, item) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Mentions checks whether any allow or deny rule refers to an item that
+// starts with prefix. Regular expressions count if they can match such an
+// item. Wildcard-only rules, including expressions that match everything,
+// don't count. This lets backends enforce optional restrictions only when
+// they've been configured, so that existing permissions keep working.
+func (pm PermissionsMap) Mentions(prefix string) bool {
+	for _, perms := range pm {
+		for _, list := range perms {
+			for _, item := range list {
+				if expr, ok := strings.CutPrefix(item, "~"); ok {
+					if patternMentions(expr, prefix) {
+						return true
+					}
+				} else if item != "*" && strings.HasPrefix(item, prefix) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// patternMentions checks whether a regular expression pattern can match an
+// item that starts with prefix. It runs the prefix through the compiled
+// expression, and checks whether any of its threads are still alive at
+// the end. Expressions that match any item are ignored.
+func patternMentions(expr, prefix string) bool {
+	re, err := syntax.Parse(expr, syntax.Perl)
+	if err != nil {
+		return false
+	}
+	re = re.Simplify()
+
+	if (re.Op == syntax.OpStar || re.Op == syntax.OpPlus) &&
+		(re.Sub[0].Op == syntax.OpAnyChar || re.Sub[0].Op == syntax.OpAnyCharNotNL) {
+		return false
+	}
+
+	prog, err := syntax.Compile(re)
+	if err != nil {
+		return false
+	}
+
+	threads := addThread(prog, nil, uint32(prog.Start))
+	for _, r := range prefix {
+		var next []uint32
+		for _, pc := range threads {
+			inst := prog.Inst[pc]
+			switch inst.Op {
+			case syntax.InstRuneAny:
+			case syntax.InstRuneAnyNotNL:
+				if r == '\n' {
+					continue
+				}
+			case syntax.InstRune, syntax.InstRune1:
+				if !inst.MatchRune(r) {
+					continue
+				}
+			default:
+				continue
+			}
+			next = addThread(prog, next, inst.Out)
+		}
+
+		if len(next) == 0 {
+			return false
+		}
+		threads = next
+	}
+	return true
+}
+
+// addThread adds the instruction at pc to threads, following instructions
+// that don't consume any input. Empty-width assertions are assumed to pass.
+func addThread(prog *syntax.Prog, threads []uint32, pc uint32) []uint32 {
+	if slices.Contains(threads, pc) {
+		return threads
+	}
+	threads = append(threads, pc)
+
+	inst := prog.Inst[pc]
+	switch inst.Op {
+	case syntax.InstAlt, syntax.InstAltMatch:
+		threads = addThread(prog, threads, inst.Out)
+		threads = addThread(prog, threads, inst.Arg)
+	case syntax.InstCapture, syntax.InstNop, syntax.InstEmptyWidth:
+		threads = addThread(prog, threads, inst.Out)
+	case syntax.InstFail:
+		return threads[:len(threads)-1]
+	}
+	return threads
+}
+
+// Validate checks that all the regular expressions in the permissions
+// are valid, so that mistakes are found when the config is loaded.
+func (pm PermissionsMap) Validate() error {
+	for group, perms := range pm {
+		for _, list := range perms {
+			for _, item := range list {
+				expr, ok := strings.CutPrefix(item, "~")
+				if !ok {
+					continue
+				}
+				if _, err := compilePattern(expr); err != nil {
+					return fmt.Errorf("permissions for %q: invalid pattern %q: %w", group, item, err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// patterns caches compiled regular expression patterns
+var patterns sync.Map
+
+// compilePattern compiles a regular expression pattern, anchoring it so
+// that it has to match the whole item.
+func compilePattern(expr string) (*regexp.Regexp, error) {
+	if re, ok := patterns.Load(expr); ok {
+		return re.(*regexp.Regexp), nil
+	}
+
+	// The expression is compiled on its own first, so that
+	// errors don't refer to the anchors added around it.
+	if _, err := regexp.Compile(expr); err != nil {
+		return nil, err
+	}
+
+	re, err := regexp.Compile("^(?:" + expr + ")$")
+	if err != nil {
+		return nil, err
+	}
+	patterns.Store(expr, re)
+	return re, nil
+}
+
+// matchPattern checks if an item matches a given pattern. Patterns
+// starting with "~" are regular expressions, which have to match the
+// whole item.
 func matchPattern(pattern, item string) bool {
 	if pattern == "*" {
 		return true
 	}
+	if expr, ok := strings.CutPrefix(pattern, "~"); ok {
+		re, err := compilePattern(expr)
+		return err == nil && re.MatchString(item)
+	}
 	if before, after, ok := strings.Cut(pattern, "*"); ok {
 		return strings.HasPrefix(item, before) && strings.HasSuffix(item, after)
 	}
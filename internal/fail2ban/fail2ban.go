@@ -22,61 +22,604 @@
 package fail2ban
 
 import (
+	"errors"
 	"net"
+	"net/netip"
+	"slices"
 	"strings"
 	"sync"
 	"time"
+
+	"go.elara.ws/seashell/internal/config"
+	"go.elara.ws/seashell/internal/metrics"
 )
 
-// Fail2Ban represents a fail2ban-like rate limiter
+// defaultMaxBanTime is the longest a ban can last if
+// the maximum ban time isn't configured.
+const defaultMaxBanTime = 24 * time.Hour
+
+// Fail2Ban represents a fail2ban-like rate limiter. Addresses that exceed
+// the allowed amount of failed logins within the time limit are banned,
+// and the ban duration doubles every time the same address is banned
+// again, up to a maximum. Optionally, attempts are also counted per
+// subnet, so that whole subnets can be banned, and per username, so that
+// accounts targeted from many addresses can be locked.
+//
+// The state is kept in memory by default, optionally saved to a file
+// so that restarting seashell doesn't forgive any bans. It can also be
+// kept in Redis, so that it's shared by multiple seashell instances.
 type Fail2Ban struct {
-	limit    time.Duration
-	amount   int
-	mtx      sync.Mutex
-	attempts map[string]int
+	limit      time.Duration
+	amount     int
+	subnets    int
+	users      int
+	banTime    time.Duration
+	maxBanTime time.Duration
+	ignore     []netip.Prefix
+	store      store
+
+	mtx   sync.Mutex
+	hooks Hooks
 }
 
-// New creates a new [Fail2Ban] instance.
-func New(limit time.Duration, attempts int) *Fail2Ban {
+// Hooks contains functions that are called when an address or subnet is
+// banned or unbanned, for example to enforce bans at the firewall, or when
+// a user is locked out. The address is an IP address, or a CIDR range for
+// subnets. Hooks are run in their own goroutine, so they can block. Nil
+// hooks are ignored.
+type Hooks struct {
+	Ban   func(addr string, duration time.Duration)
+	Unban func(addr string)
+	// Lock is called when a user is locked out
+	Lock func(user string, duration time.Duration)
+	// Error is called when the state can't be read, in which
+	// case logins are allowed.
+	Error func(err error)
+}
+
+// record contains the failed logins and bans of a single address.
+type record struct {
+	// Attempts contains the times of the failed logins within the time
+	// limit. Each one expires individually once the limit has passed.
+	Attempts    []time.Time `json:"attempts,omitempty"`
+	Offenses    int         `json:"offenses,omitempty"`
+	BannedUntil time.Time   `json:"banned_until"`
+}
+
+// New creates a new [Fail2Ban] instance using the given settings. If a
+// state file is configured, the state that was saved there before is
+// loaded. Saved attempts and bans are restored until they expire.
+func New(cfg config.Fail2Ban) (*Fail2Ban, error) {
+	limit, err := time.ParseDuration(cfg.Limit)
+	if err != nil {
+		return nil, err
+	}
+
+	banTime := limit
+	if cfg.BanTime != "" {
+		banTime, err = time.ParseDuration(cfg.BanTime)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	maxBanTime := max(defaultMaxBanTime, banTime)
+	if cfg.MaxBanTime != "" {
+		maxBanTime, err = time.ParseDuration(cfg.MaxBanTime)
+		if err != nil {
+			return nil, err
+		} else if maxBanTime < banTime {
+			return nil, errors.New("max_ban_time can't be shorter than ban_time")
+		}
+	}
+
+	ignore := make([]netip.Prefix, len(cfg.IgnoreCIDRs))
+	for i, cidr := range cfg.IgnoreCIDRs {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, err
+		}
+		ignore[i] = prefix.Masked()
+	}
+
 	f := &Fail2Ban{
-		limit:    limit,
-		amount:   attempts,
-		attempts: map[string]int{},
+		limit:      limit,
+		amount:     cfg.Attempts,
+		subnets:    cfg.SubnetAttempts,
+		users:      cfg.UserAttempts,
+		banTime:    banTime,
+		maxBanTime: maxBanTime,
+		ignore:     ignore,
+	}
+
+	if cfg.Redis != nil {
+		f.store, err = newRedisStore(*cfg.Redis, f.expiry)
+	} else {
+		f.store, err = newMemoryStore(cfg.StateFile)
 	}
-	go f.clear()
-	return f
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	err = f.store.each(func(key string, rec *record) bool {
+		if now.Before(rec.BannedUntil) {
+			f.scheduleUnban(key, rec.BannedUntil)
+		}
+		return f.keep(rec, now)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	go f.prune()
+	go f.updateActiveBans()
+	return f, nil
 }
 
-// AddFailedLogin adds a failed login attempt from the given address.
-func (f *Fail2Ban) AddFailedLogin(addr net.Addr) {
+// Detach stops saving the state to the state file. It's used when another
+// seashell process has taken over during an upgrade, so that this one
+// doesn't overwrite the state saved by the new process. State kept in
+// Redis is shared between processes, so it isn't affected.
+func (f *Fail2Ban) Detach() {
+	if f == nil {
+		return
+	}
+	if ms, ok := f.store.(*memoryStore); ok {
+		ms.detach()
+	}
+}
+
+// AddFailedLogin adds a failed login attempt from the given address, and
+// bans it if it has exceeded the allowed amount of attempts. If subnet
+// banning is enabled, the attempt is also counted towards the address's
+// subnet. The returned error is non-nil if the state couldn't be saved.
+func (f *Fail2Ban) AddFailedLogin(addr net.Addr) error {
+	if f == nil || f.Ignored(addr) {
+		return nil
+	}
+	failedLogins.Inc(metrics.Labels{"kind": kindAddress})
+
+	now := time.Now()
+	keys := f.keys(addr)
+	amounts := []int{f.amount, f.subnets}
+
+	var banned []int
+	err := f.store.update(keys, func(recs []*record) bool {
+		banned = banned[:0]
+		for _, rec := range recs {
+			if now.Before(rec.BannedUntil) {
+				// Logins from banned addresses are rejected before they're
+				// checked, so they shouldn't extend the ban.
+				return false
+			}
+		}
+
+		for i, rec := range recs {
+			rec.Attempts = append(f.expireAttempts(rec.Attempts, now), now)
+			if len(rec.Attempts) >= amounts[i] {
+				rec.Attempts = nil
+				rec.Offenses++
+				rec.BannedUntil = now.Add(f.banDuration(rec.Offenses))
+				banned = append(banned, i)
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, i := range banned {
+		f.banned(keys[i], now)
+	}
+	return nil
+}
+
+// AddFailedUserLogin adds a failed login attempt for the given username,
+// and locks the user out if they've exceeded the allowed amount of
+// attempts, regardless of which addresses the attempts came from.
+// Attempts from ignored addresses aren't counted.
+func (f *Fail2Ban) AddFailedUserLogin(addr net.Addr, username string) error {
+	if f == nil || f.users <= 0 || f.Ignored(addr) {
+		return nil
+	}
+	failedLogins.Inc(metrics.Labels{"kind": kindUser})
+
+	now := time.Now()
+	locked := false
+	err := f.store.update([]string{userKey(username)}, func(recs []*record) bool {
+		rec := recs[0]
+		if now.Before(rec.BannedUntil) {
+			return false
+		}
+
+		rec.Attempts = append(f.expireAttempts(rec.Attempts, now), now)
+		locked = len(rec.Attempts) >= f.users
+		if locked {
+			rec.Attempts = nil
+			rec.Offenses++
+			rec.BannedUntil = now.Add(f.banDuration(rec.Offenses))
+		}
+		return true
+	})
+	if err != nil || !locked {
+		return err
+	}
+	bansTotal.Inc(metrics.Labels{"kind": kindUser})
+
+	recs, err := f.store.get([]string{userKey(username)})
+	if err != nil || recs[0] == nil {
+		return err
+	}
+
+	f.mtx.Lock()
+	hook := f.hooks.Lock
+	f.mtx.Unlock()
+	if hook != nil {
+		go hook(username, recs[0].BannedUntil.Sub(now))
+	}
+	return nil
+}
+
+// UserAllowed checks whether the user is allowed to log in,
+// which is the case unless they've been locked out.
+func (f *Fail2Ban) UserAllowed(username string) bool {
+	if f == nil || f.users <= 0 {
+		return true
+	}
+
+	recs, err := f.store.get([]string{userKey(username)})
+	if err != nil {
+		f.mtx.Lock()
+		hook := f.hooks.Error
+		f.mtx.Unlock()
+		if hook != nil {
+			hook(err)
+		}
+		return true
+	}
+	if recs[0] != nil && time.Now().Before(recs[0].BannedUntil) {
+		blockedLogins.Inc(metrics.Labels{"kind": kindUser})
+		return false
+	}
+	return true
+}
+
+// Lockout is an active lockout of a user.
+type Lockout struct {
+	User     string
+	Until    time.Time
+	Offenses int
+}
+
+// Lockouts returns the users that are currently locked out, sorted by name.
+func (f *Fail2Ban) Lockouts() ([]Lockout, error) {
+	recs, err := f.store.all()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	var out []Lockout
+	for key, rec := range recs {
+		user, ok := strings.CutPrefix(key, userKeyPrefix)
+		if ok && now.Before(rec.BannedUntil) {
+			out = append(out, Lockout{User: user, Until: rec.BannedUntil, Offenses: rec.Offenses})
+		}
+	}
+	slices.SortFunc(out, func(a, b Lockout) int { return strings.Compare(a.User, b.User) })
+	return out, nil
+}
+
+// Unlock removes a user's lockout and forgets their past offenses and
+// failed attempts. It returns false if the user wasn't locked out.
+func (f *Fail2Ban) Unlock(username string) (bool, error) {
+	locked := false
+	err := f.store.update([]string{userKey(username)}, func(recs []*record) bool {
+		locked = time.Now().Before(recs[0].BannedUntil)
+		*recs[0] = record{}
+		return true
+	})
+	return locked, err
+}
+
+// userKeyPrefix is prepended to usernames to get the keys of their
+// records. IP addresses and CIDR ranges never contain it.
+const userKeyPrefix = "user:"
+
+// userKey returns the key of the record for the given username.
+func userKey(username string) string {
+	return userKeyPrefix + username
+}
+
+// banned runs the ban hook for the record with the given
+// key, and schedules the unban hook for when the ban expires.
+func (f *Fail2Ban) banned(key string, now time.Time) {
+	recs, err := f.store.get([]string{key})
+	if err != nil || recs[0] == nil {
+		return
+	}
+	bansTotal.Inc(metrics.Labels{"kind": keyKind(key)})
+
+	f.mtx.Lock()
+	hook := f.hooks.Ban
+	f.mtx.Unlock()
+
+	if hook != nil {
+		go hook(key, recs[0].BannedUntil.Sub(now))
+	}
+	f.scheduleUnban(key, recs[0].BannedUntil)
+}
+
+// SetHooks sets the functions that are called when
+// an address or subnet is banned or unbanned.
+func (f *Fail2Ban) SetHooks(hooks Hooks) {
 	if f == nil {
 		return
 	}
 
 	f.mtx.Lock()
 	defer f.mtx.Unlock()
-	f.attempts[getAddrString(addr)]++
+	f.hooks = hooks
+}
+
+// scheduleUnban calls the unban hook when the ban on the record with
+// the given key expires, unless the record has changed since then.
+// Lockouts don't have an unban hook, so they aren't scheduled.
+func (f *Fail2Ban) scheduleUnban(key string, until time.Time) {
+	if strings.HasPrefix(key, userKeyPrefix) {
+		return
+	}
+
+	time.AfterFunc(time.Until(until), func() {
+		f.mtx.Lock()
+		hook := f.hooks.Unban
+		f.mtx.Unlock()
+		if hook == nil {
+			return
+		}
+
+		recs, err := f.store.get([]string{key})
+		if err != nil || recs[0] == nil || !recs[0].BannedUntil.Equal(until) {
+			return
+		}
+		hook(key)
+	})
 }
 
 // LoginAllowed checks if login is allowed from the given address.
+// Logins aren't allowed if either the address or its subnet is banned.
 func (f *Fail2Ban) LoginAllowed(addr net.Addr) bool {
-	if f == nil {
+	if f == nil || f.Ignored(addr) {
 		return true
 	}
 
+	keys := f.keys(addr)
+	recs, err := f.store.get(keys)
+	if err != nil {
+		f.mtx.Lock()
+		hook := f.hooks.Error
+		f.mtx.Unlock()
+		if hook != nil {
+			hook(err)
+		}
+		return true
+	}
+
+	now := time.Now()
+	for i, rec := range recs {
+		if rec != nil && now.Before(rec.BannedUntil) {
+			blockedLogins.Inc(metrics.Labels{"kind": keyKind(keys[i])})
+			return false
+		}
+	}
+	return true
+}
+
+// Ban is an active ban on an address or subnet.
+type Ban struct {
+	// Addr is the banned IP address, or CIDR range for subnets
+	Addr     string
+	Until    time.Time
+	Offenses int
+}
+
+// Bans returns the active bans, sorted by address.
+func (f *Fail2Ban) Bans() ([]Ban, error) {
+	recs, err := f.store.all()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	var out []Ban
+	for key, rec := range recs {
+		if !strings.HasPrefix(key, userKeyPrefix) && now.Before(rec.BannedUntil) {
+			out = append(out, Ban{Addr: key, Until: rec.BannedUntil, Offenses: rec.Offenses})
+		}
+	}
+	slices.SortFunc(out, func(a, b Ban) int { return strings.Compare(a.Addr, b.Addr) })
+	return out, nil
+}
+
+// Ban bans an IP address or CIDR range immediately. If duration is zero,
+// the ban lasts as long as it would if the address had exceeded the limit.
+// It returns the normalized address and the time the ban expires.
+func (f *Fail2Ban) Ban(addr string, duration time.Duration) (string, time.Time, error) {
+	key, err := normalizeKey(addr)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	now := time.Now()
+	var until time.Time
+	err = f.store.update([]string{key}, func(recs []*record) bool {
+		recs[0].Attempts = nil
+		recs[0].Offenses++
+		d := duration
+		if d <= 0 {
+			d = f.banDuration(recs[0].Offenses)
+		}
+		until = now.Add(d)
+		recs[0].BannedUntil = until
+		return true
+	})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	f.banned(key, now)
+	return key, until, nil
+}
+
+// Unban removes the ban on an IP address or CIDR range, and forgets its
+// past offenses and failed attempts. It returns the normalized address
+// and false if the address wasn't banned.
+func (f *Fail2Ban) Unban(addr string) (string, bool, error) {
+	key, err := normalizeKey(addr)
+	if err != nil {
+		return "", false, err
+	}
+
+	banned := false
+	err = f.store.update([]string{key}, func(recs []*record) bool {
+		banned = time.Now().Before(recs[0].BannedUntil)
+		*recs[0] = record{}
+		return true
+	})
+	if err != nil || !banned {
+		return key, false, err
+	}
+
 	f.mtx.Lock()
-	defer f.mtx.Unlock()
-	return f.attempts[getAddrString(addr)] < f.amount
+	hook := f.hooks.Unban
+	f.mtx.Unlock()
+	if hook != nil {
+		go hook(key)
+	}
+	return key, true, nil
+}
+
+// normalizeKey converts an IP address or CIDR range
+// to the key used for its record.
+func normalizeKey(addr string) (string, error) {
+	if strings.Contains(addr, "/") {
+		prefix, err := netip.ParsePrefix(addr)
+		if err != nil {
+			return "", err
+		}
+		return prefix.Masked().String(), nil
+	}
+
+	ip, err := netip.ParseAddr(addr)
+	if err != nil {
+		return "", err
+	}
+	return ip.Unmap().String(), nil
+}
+
+// keys returns the keys of the records an address's attempts are counted
+// in. The first one is always the address itself, and the second one is
+// its /24 (IPv4) or /64 (IPv6) subnet, if subnet banning is enabled.
+func (f *Fail2Ban) keys(addr net.Addr) []string {
+	addrstr := getAddrString(addr)
+	if f.subnets <= 0 {
+		return []string{addrstr}
+	}
+
+	ip, err := netip.ParseAddr(addrstr)
+	if err != nil {
+		return []string{addrstr}
+	}
+	ip = ip.Unmap()
+
+	bits := 64
+	if ip.Is4() {
+		bits = 24
+	}
+	prefix, err := ip.WithZone("").Prefix(bits)
+	if err != nil {
+		return []string{addrstr}
+	}
+	return []string{addrstr, prefix.String()}
+}
+
+// Ignored checks whether the address is in one of the ignored ranges,
+// which means it's never banned.
+func (f *Fail2Ban) Ignored(addr net.Addr) bool {
+	if f == nil || len(f.ignore) == 0 {
+		return false
+	}
+
+	ip, err := netip.ParseAddr(getAddrString(addr))
+	if err != nil {
+		return false
+	}
+	ip = ip.Unmap()
+
+	for _, prefix := range f.ignore {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
 }
 
-// clear resets the login attempts at regular intervals.
-func (f *Fail2Ban) clear() {
+// banDuration returns how long an address should be banned for
+// after the given amount of offenses.
+func (f *Fail2Ban) banDuration(offenses int) time.Duration {
+	d := f.banTime
+	for range offenses - 1 {
+		if d >= f.maxBanTime/2 {
+			return f.maxBanTime
+		}
+		d *= 2
+	}
+	return min(d, f.maxBanTime)
+}
+
+// prune regularly removes expired attempts and records, so
+// that memory isn't used by addresses that stopped trying.
+func (f *Fail2Ban) prune() {
 	for range time.Tick(f.limit) {
-		f.mtx.Lock()
-		clear(f.attempts)
-		f.attempts = map[string]int{}
-		f.mtx.Unlock()
+		now := time.Now()
+		f.store.each(func(_ string, rec *record) bool {
+			return f.keep(rec, now)
+		})
+	}
+}
+
+// keep removes the record's expired attempts, and reports whether it should
+// be kept. Records of addresses that haven't been banned for longer than the
+// maximum ban time are removed, which means their past offenses are forgotten.
+func (f *Fail2Ban) keep(rec *record, now time.Time) bool {
+	rec.Attempts = f.expireAttempts(rec.Attempts, now)
+	return now.Before(f.expiry(rec))
+}
+
+// expiry returns the time after which the record can be removed.
+func (f *Fail2Ban) expiry(rec *record) time.Time {
+	expiry := rec.BannedUntil.Add(f.maxBanTime)
+	if len(rec.Attempts) > 0 {
+		last := rec.Attempts[len(rec.Attempts)-1].Add(f.limit)
+		if last.After(expiry) {
+			expiry = last
+		}
+	}
+	return expiry
+}
+
+// expireAttempts removes the attempts that are older than the time limit.
+// Attempts are always in chronological order, so it only has to find the
+// first one that hasn't expired.
+func (f *Fail2Ban) expireAttempts(attempts []time.Time, now time.Time) []time.Time {
+	cutoff := now.Add(-f.limit)
+	i := 0
+	for i < len(attempts) && !attempts[i].After(cutoff) {
+		i++
 	}
+	return attempts[i:]
 }
 
 // getAddrString gets an IP address string from a [net.Addr].
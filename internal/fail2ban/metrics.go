@@ -0,0 +1,92 @@
+/*
+ * Seashell - SSH server with virtual hosts and username-based routing
+ *
+ * Copyright (C) 2024 Elara6331 <elara@elara.ws>
+ *
+ * This file is part of Seashell.
+ *
+ * Seashell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * Seashell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with Seashell.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package fail2ban
+
+import (
+	"strings"
+	"time"
+
+	"go.elara.ws/seashell/internal/metrics"
+)
+
+// activeBansInterval is how often the active bans gauge is updated.
+const activeBansInterval = 15 * time.Second
+
+// Kinds of records, used as the "kind" label of the metrics
+const (
+	kindAddress = "address"
+	kindSubnet  = "subnet"
+	kindUser    = "user"
+)
+
+var (
+	failedLogins = metrics.NewCounter(
+		"seashell_fail2ban_failed_logins_total",
+		"Total number of failed logins counted by fail2ban",
+	)
+	blockedLogins = metrics.NewCounter(
+		"seashell_fail2ban_blocked_logins_total",
+		"Total number of login attempts blocked by fail2ban",
+	)
+	bansTotal = metrics.NewCounter(
+		"seashell_fail2ban_bans_total",
+		"Total number of bans and lockouts issued by fail2ban",
+	)
+	activeBans = metrics.NewGauge(
+		"seashell_fail2ban_active_bans",
+		"Number of addresses, subnets, and users currently banned or locked out",
+	)
+)
+
+// keyKind returns the kind of the record with the given key.
+func keyKind(key string) string {
+	switch {
+	case strings.HasPrefix(key, userKeyPrefix):
+		return kindUser
+	case strings.Contains(key, "/"):
+		return kindSubnet
+	default:
+		return kindAddress
+	}
+}
+
+// updateActiveBans regularly updates the active bans gauge. The state is
+// read every time, since other instances may share it.
+func (f *Fail2Ban) updateActiveBans() {
+	for range time.Tick(activeBansInterval) {
+		recs, err := f.store.all()
+		if err != nil {
+			continue
+		}
+
+		now := time.Now()
+		counts := map[string]int{kindAddress: 0, kindSubnet: 0, kindUser: 0}
+		for key, rec := range recs {
+			if now.Before(rec.BannedUntil) {
+				counts[keyKind(key)]++
+			}
+		}
+		for kind, n := range counts {
+			activeBans.Set(metrics.Labels{"kind": kind}, float64(n))
+		}
+	}
+}
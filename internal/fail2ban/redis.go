@@ -0,0 +1,193 @@
+/*
+ * Seashell - SSH server with virtual hosts and username-based routing
+ *
+ * Copyright (C) 2024 Elara6331 <elara@elara.ws>
+ *
+ * This file is part of Seashell.
+ *
+ * Seashell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * Seashell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with Seashell.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package fail2ban
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"go.elara.ws/seashell/internal/config"
+)
+
+const (
+	// defaultRedisPrefix is prepended to record keys if no prefix is configured.
+	defaultRedisPrefix = "seashell:fail2ban:"
+	// redisTimeout is how long Redis operations may take.
+	redisTimeout = 5 * time.Second
+	// redisRetries is how many times an update is retried if
+	// another instance changes the same records concurrently.
+	redisRetries = 10
+)
+
+// redisStore is a [store] that keeps the records in Redis, so they're
+// shared by every seashell instance that uses the same server. Each
+// record is saved as a JSON value that expires when it's no longer needed.
+type redisStore struct {
+	client *redis.Client
+	prefix string
+	expiry func(rec *record) time.Time
+}
+
+// newRedisStore connects to the Redis server described by cfg.
+func newRedisStore(cfg config.Redis, expiry func(rec *record) time.Time) (*redisStore, error) {
+	opts, err := redis.ParseURL(cfg.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	rs := &redisStore{
+		client: redis.NewClient(opts),
+		prefix: cfg.Prefix,
+		expiry: expiry,
+	}
+	if rs.prefix == "" {
+		rs.prefix = defaultRedisPrefix
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	if err := rs.client.Ping(ctx).Err(); err != nil {
+		rs.client.Close()
+		return nil, err
+	}
+	return rs, nil
+}
+
+func (rs *redisStore) get(keys []string) ([]*record, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	return rs.getRecords(ctx, rs.client, keys)
+}
+
+func (rs *redisStore) update(keys []string, fn func(recs []*record) bool) error {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+
+	rkeys := rs.redisKeys(keys)
+	for range redisRetries {
+		err := rs.client.Watch(ctx, func(tx *redis.Tx) error {
+			recs, err := rs.getRecords(ctx, tx, keys)
+			if err != nil {
+				return err
+			}
+			for i := range recs {
+				if recs[i] == nil {
+					recs[i] = &record{}
+				}
+			}
+
+			if !fn(recs) {
+				return nil
+			}
+
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				for i, rec := range recs {
+					data, err := json.Marshal(rec)
+					if err != nil {
+						return err
+					}
+					ttl := time.Until(rs.expiry(rec))
+					if ttl <= 0 {
+						pipe.Del(ctx, rkeys[i])
+						continue
+					}
+					pipe.Set(ctx, rkeys[i], data, ttl)
+				}
+				return nil
+			})
+			return err
+		}, rkeys...)
+		if !errors.Is(err, redis.TxFailedErr) {
+			return err
+		}
+	}
+	return errors.New("too many concurrent fail2ban updates")
+}
+
+// each doesn't do anything, since Redis expires the records on its own.
+func (rs *redisStore) each(func(key string, rec *record) bool) error {
+	return nil
+}
+
+func (rs *redisStore) all() (map[string]*record, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+
+	var keys []string
+	iter := rs.client.Scan(ctx, 0, rs.prefix+"*", 0).Iterator()
+	for iter.Next(ctx) {
+		keys = append(keys, strings.TrimPrefix(iter.Val(), rs.prefix))
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+
+	out := make(map[string]*record, len(keys))
+	if len(keys) == 0 {
+		return out, nil
+	}
+
+	recs, err := rs.getRecords(ctx, rs.client, keys)
+	if err != nil {
+		return nil, err
+	}
+	for i, rec := range recs {
+		if rec != nil {
+			out[keys[i]] = rec
+		}
+	}
+	return out, nil
+}
+
+// getRecords gets the records with the given keys using c.
+func (rs *redisStore) getRecords(ctx context.Context, c redis.Cmdable, keys []string) ([]*record, error) {
+	vals, err := c.MGet(ctx, rs.redisKeys(keys)...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]*record, len(keys))
+	for i, val := range vals {
+		data, ok := val.(string)
+		if !ok {
+			continue
+		}
+		out[i] = &record{}
+		if err := json.Unmarshal([]byte(data), out[i]); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// redisKeys adds the store's prefix to the given keys.
+func (rs *redisStore) redisKeys(keys []string) []string {
+	out := make([]string, len(keys))
+	for i, key := range keys {
+		out[i] = rs.prefix + key
+	}
+	return out
+}
@@ -0,0 +1,173 @@
+/*
+ * Seashell - SSH server with virtual hosts and username-based routing
+ *
+ * Copyright (C) 2024 Elara6331 <elara@elara.ws>
+ *
+ * This file is part of Seashell.
+ *
+ * Seashell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * Seashell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with Seashell.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package fail2ban
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"sync"
+)
+
+// store contains the records of a [Fail2Ban] instance.
+type store interface {
+	// get returns the records with the given keys. Records
+	// that don't exist are nil.
+	get(keys []string) ([]*record, error)
+	// update atomically calls fn with the records with the given keys,
+	// and saves the changes it made if it returns true. Records that
+	// don't exist are passed as empty records. fn may be called more
+	// than once if the records were changed concurrently.
+	update(keys []string, fn func(recs []*record) bool) error
+	// each calls fn for every record, and removes the ones it returns
+	// false for. Stores that expire records on their own may skip this.
+	each(fn func(key string, rec *record) bool) error
+	// all returns copies of every record.
+	all() (map[string]*record, error)
+}
+
+// memoryStore is a [store] that keeps the records in memory. If it has
+// a path, the records are saved to it whenever they're updated.
+type memoryStore struct {
+	path string
+
+	mtx     sync.Mutex
+	records map[string]*record
+}
+
+// state is the saved state of a [memoryStore].
+type state struct {
+	Records map[string]*record `json:"records"`
+}
+
+// newMemoryStore creates a new [memoryStore], loading the
+// records saved at path, if it isn't empty.
+func newMemoryStore(path string) (*memoryStore, error) {
+	ms := &memoryStore{path: path, records: map[string]*record{}}
+	if path == "" {
+		return ms, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return ms, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var st state
+	if err := json.Unmarshal(data, &st); err != nil {
+		return nil, err
+	}
+	if st.Records != nil {
+		ms.records = st.Records
+	}
+	return ms, nil
+}
+
+func (ms *memoryStore) get(keys []string) ([]*record, error) {
+	ms.mtx.Lock()
+	defer ms.mtx.Unlock()
+
+	out := make([]*record, len(keys))
+	for i, key := range keys {
+		if rec, ok := ms.records[key]; ok {
+			recCopy := *rec
+			out[i] = &recCopy
+		}
+	}
+	return out, nil
+}
+
+func (ms *memoryStore) update(keys []string, fn func(recs []*record) bool) error {
+	ms.mtx.Lock()
+	defer ms.mtx.Unlock()
+
+	recs := make([]*record, len(keys))
+	for i, key := range keys {
+		rec, ok := ms.records[key]
+		if !ok {
+			rec = &record{}
+		}
+		recCopy := *rec
+		recs[i] = &recCopy
+	}
+
+	if !fn(recs) {
+		return nil
+	}
+
+	for i, key := range keys {
+		ms.records[key] = recs[i]
+	}
+	return ms.saveLocked()
+}
+
+func (ms *memoryStore) each(fn func(key string, rec *record) bool) error {
+	ms.mtx.Lock()
+	defer ms.mtx.Unlock()
+
+	for key, rec := range ms.records {
+		if !fn(key, rec) {
+			delete(ms.records, key)
+		}
+	}
+	return nil
+}
+
+func (ms *memoryStore) all() (map[string]*record, error) {
+	ms.mtx.Lock()
+	defer ms.mtx.Unlock()
+
+	out := make(map[string]*record, len(ms.records))
+	for key, rec := range ms.records {
+		recCopy := *rec
+		out[key] = &recCopy
+	}
+	return out, nil
+}
+
+// detach stops saving the records to the store's path.
+func (ms *memoryStore) detach() {
+	ms.mtx.Lock()
+	defer ms.mtx.Unlock()
+	ms.path = ""
+}
+
+// saveLocked saves the records to the store's path, if it has one.
+// ms.mtx must be held by the caller.
+func (ms *memoryStore) saveLocked() error {
+	if ms.path == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(state{Records: ms.records})
+	if err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(ms.path+".tmp", data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(ms.path+".tmp", ms.path)
+}
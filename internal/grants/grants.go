@@ -0,0 +1,169 @@
+/*
+ * Seashell - SSH server with virtual hosts and username-based routing
+ *
+ * Copyright (C) 2024 Elara6331 <elara@elara.ws>
+ *
+ * This file is part of Seashell.
+ *
+ * Seashell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * Seashell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with Seashell.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package grants
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Grant allows a user to use a route until it expires,
+// even if the route's user and group lists don't include them.
+type Grant struct {
+	ID        string    `json:"id"`
+	User      string    `json:"user"`
+	Route     string    `json:"route"`
+	Expires   time.Time `json:"expires"`
+	CreatedBy string    `json:"created_by"`
+	Reason    string    `json:"reason,omitempty"`
+}
+
+// Store contains the current access grants. If it has a path, grants are
+// saved to it whenever they change, so they aren't lost on restart.
+type Store struct {
+	path string
+
+	mu     sync.Mutex
+	grants []Grant
+}
+
+// Open loads the grants saved at path. If path is empty,
+// grants are only kept in memory.
+func Open(path string) (*Store, error) {
+	s := &Store{path: path}
+	if path == "" {
+		return s, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &s.grants); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Add adds a new grant and returns it with its ID filled in.
+func (s *Store) Add(g Grant) (Grant, error) {
+	id := make([]byte, 4)
+	if _, err := rand.Read(id); err != nil {
+		return Grant{}, err
+	}
+	g.ID = hex.EncodeToString(id)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.pruneLocked(time.Now())
+	s.grants = append(s.grants, g)
+	return g, s.saveLocked()
+}
+
+// Remove removes the grant with the given ID. It returns
+// false if there's no such grant.
+func (s *Store) Remove(id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := slices.IndexFunc(s.grants, func(g Grant) bool { return g.ID == id })
+	if i == -1 {
+		return false, nil
+	}
+	s.grants = slices.Delete(s.grants, i, i+1)
+	return true, s.saveLocked()
+}
+
+// Active returns the grants that haven't expired yet.
+func (s *Store) Active() []Grant {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	return slices.DeleteFunc(slices.Clone(s.grants), func(g Grant) bool {
+		return !now.Before(g.Expires)
+	})
+}
+
+// Allowed checks whether the user has an active grant for the route.
+// It returns false if s is nil.
+func (s *Store) Allowed(user, route string) bool {
+	if s == nil {
+		return false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	return slices.ContainsFunc(s.grants, func(g Grant) bool {
+		return g.User == user && g.Route == route && now.Before(g.Expires)
+	})
+}
+
+// pruneLocked removes expired grants. s.mu must be held by the caller.
+func (s *Store) pruneLocked(now time.Time) {
+	s.grants = slices.DeleteFunc(s.grants, func(g Grant) bool {
+		return !now.Before(g.Expires)
+	})
+}
+
+// Detach stops saving grants to the store's path. It's used when another
+// seashell process has taken over during an upgrade, so that this one
+// doesn't overwrite the grants saved by the new process.
+func (s *Store) Detach() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.path = ""
+}
+
+// saveLocked saves the grants to the store's path, if it has one.
+// s.mu must be held by the caller.
+func (s *Store) saveLocked() error {
+	if s.path == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(s.grants, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(s.path+".tmp", data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(s.path+".tmp", s.path)
+}
@@ -0,0 +1,241 @@
+/*
+ * Seashell - SSH server with virtual hosts and username-based routing
+ *
+ * Copyright (C) 2024 Elara6331 <elara@elara.ws>
+ *
+ * This file is part of Seashell.
+ *
+ * Seashell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * Seashell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with Seashell.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package krbauth
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+
+	"github.com/jcmturner/gofork/encoding/asn1"
+	"github.com/jcmturner/gokrb5/v8/asn1tools"
+	"github.com/jcmturner/gokrb5/v8/crypto"
+	"github.com/jcmturner/gokrb5/v8/gssapi"
+	"github.com/jcmturner/gokrb5/v8/iana"
+	"github.com/jcmturner/gokrb5/v8/iana/asnAppTag"
+	"github.com/jcmturner/gokrb5/v8/iana/chksumtype"
+	"github.com/jcmturner/gokrb5/v8/iana/keyusage"
+	"github.com/jcmturner/gokrb5/v8/iana/msgtype"
+	"github.com/jcmturner/gokrb5/v8/keytab"
+	"github.com/jcmturner/gokrb5/v8/messages"
+	"github.com/jcmturner/gokrb5/v8/service"
+	"github.com/jcmturner/gokrb5/v8/spnego"
+	"github.com/jcmturner/gokrb5/v8/types"
+	"go.elara.ws/seashell/internal/config"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// ErrInvalidTicket is returned when a client's Kerberos ticket can't be verified.
+var ErrInvalidTicket = errors.New("invalid kerberos ticket")
+
+// Acceptor accepts Kerberos credentials from clients using GSSAPI, and
+// maps the principals they belong to to seashell usernames.
+type Acceptor struct {
+	keytab     *keytab.Keytab
+	spn        string
+	principals []*regexp.Regexp
+}
+
+// New creates a new acceptor using the given settings.
+func New(cfg config.GSSAPI) (*Acceptor, error) {
+	kt, err := keytab.Load(cfg.Keytab)
+	if err != nil {
+		return nil, err
+	}
+
+	a := &Acceptor{keytab: kt, spn: cfg.ServicePrincipal}
+	for _, pattern := range cfg.Principals {
+		// The pattern is compiled on its own first, so that
+		// errors don't refer to the anchors added around it.
+		if _, err := regexp.Compile(pattern); err != nil {
+			return nil, err
+		}
+
+		// Patterns have to match the whole principal, so that
+		// principals from other realms can't match by suffix.
+		re, err := regexp.Compile("^(?:" + pattern + ")$")
+		if err != nil {
+			return nil, err
+		}
+		a.principals = append(a.principals, re)
+	}
+	return a, nil
+}
+
+// MapPrincipal returns the seashell username for a Kerberos principal, using
+// the first principal pattern that matches all of it. The username is the
+// "user" capture group of the pattern, or the whole principal if it doesn't
+// have one.
+func (a *Acceptor) MapPrincipal(principal string) (string, bool) {
+	for _, re := range a.principals {
+		matches := re.FindStringSubmatch(principal)
+		if matches == nil {
+			continue
+		}
+
+		if idx := re.SubexpIndex("user"); idx != -1 {
+			return matches[idx], true
+		}
+		return matches[0], true
+	}
+	return "", false
+}
+
+// NewContext returns a GSSAPI security context for a single connection.
+// remoteAddr is used to check tickets that are restricted to specific client
+// addresses. It may return nil if the address isn't known yet, in which case
+// those tickets are rejected.
+func (a *Acceptor) NewContext(remoteAddr func() net.Addr) gossh.GSSAPIServer {
+	return &securityContext{acceptor: a, remoteAddr: remoteAddr}
+}
+
+// securityContext implements the acceptor side of the Kerberos
+// GSSAPI mechanism, as described in RFC 1964 and RFC 4121.
+type securityContext struct {
+	acceptor   *Acceptor
+	remoteAddr func() net.Addr
+	// key is the key used to verify the client's MIC tokens
+	key types.EncryptionKey
+}
+
+// AcceptSecContext verifies the AP-REQ sent by the client, and returns
+// an AP-REP if the client requested mutual authentication.
+func (c *securityContext) AcceptSecContext(token []byte) (outputToken []byte, srcName string, needContinue bool, err error) {
+	var tok spnego.KRB5Token
+	if err := tok.Unmarshal(token); err != nil {
+		return nil, "", false, err
+	}
+	if !tok.IsAPReq() {
+		return nil, "", false, errors.New("expected a kerberos AP-REQ")
+	}
+
+	opts := []func(*service.Settings){}
+	if c.acceptor.spn != "" {
+		opts = append(opts, service.KeytabPrincipal(c.acceptor.spn))
+	}
+	if addr, ok := c.remoteAddr().(*net.TCPAddr); ok {
+		opts = append(opts, service.ClientAddress(types.HostAddressFromNetIP(addr.IP)))
+	}
+
+	ok, _, err := service.VerifyAPREQ(&tok.APReq, service.NewSettings(c.acceptor.keytab, opts...))
+	if err != nil {
+		return nil, "", false, fmt.Errorf("%w: %w", ErrInvalidTicket, err)
+	} else if !ok {
+		return nil, "", false, ErrInvalidTicket
+	}
+
+	// The client signs its MIC tokens using the subkey from its
+	// authenticator if there is one, or the session key otherwise.
+	c.key = tok.APReq.Authenticator.SubKey
+	if c.key.KeyType == 0 {
+		c.key = tok.APReq.Ticket.DecryptedEncPart.Key
+	}
+
+	if mutualRequested(tok.APReq.Authenticator) {
+		outputToken, err = apRep(tok.APReq)
+		if err != nil {
+			return nil, "", false, err
+		}
+	}
+
+	ticket := tok.APReq.Ticket.DecryptedEncPart
+	return outputToken, ticket.CName.PrincipalNameString() + "@" + ticket.CRealm, false, nil
+}
+
+// VerifyMIC verifies the client's signature of the SSH session data.
+func (c *securityContext) VerifyMIC(micField, micToken []byte) error {
+	var mt gssapi.MICToken
+	if err := mt.Unmarshal(micToken, false); err != nil {
+		return err
+	}
+	mt.Payload = micField
+
+	ok, err := mt.Verify(c.key, keyusage.GSSAPI_INITIATOR_SIGN)
+	if err != nil {
+		return err
+	} else if !ok {
+		return errors.New("invalid gssapi mic")
+	}
+	return nil
+}
+
+// DeleteSecContext discards the security context's key.
+func (c *securityContext) DeleteSecContext() error {
+	c.key = types.EncryptionKey{}
+	return nil
+}
+
+// mutualRequested checks the GSSAPI flags in the authenticator's
+// checksum to see whether the client requested mutual authentication.
+func mutualRequested(auth types.Authenticator) bool {
+	cksum := auth.Cksum.Checksum
+	if auth.Cksum.CksumType != chksumtype.GSSAPI || len(cksum) < 24 {
+		return false
+	}
+	flags := binary.LittleEndian.Uint32(cksum[20:24])
+	return flags&gssapi.ContextFlagMutual != 0
+}
+
+// apRep creates the GSSAPI token containing the AP-REP that
+// proves the server's identity to the client.
+func apRep(req messages.APReq) ([]byte, error) {
+	var seq [4]byte
+	if _, err := rand.Read(seq[:]); err != nil {
+		return nil, err
+	}
+
+	part, err := asn1.Marshal(messages.EncAPRepPart{
+		CTime:          req.Authenticator.CTime,
+		Cusec:          req.Authenticator.Cusec,
+		SequenceNumber: int64(binary.BigEndian.Uint32(seq[:]) & 0x3fffffff),
+	})
+	if err != nil {
+		return nil, err
+	}
+	part = asn1tools.AddASNAppTag(part, asnAppTag.EncAPRepPart)
+
+	encPart, err := crypto.GetEncryptedData(part, req.Ticket.DecryptedEncPart.Key, keyusage.AP_REP_ENCPART, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	rep, err := asn1.Marshal(messages.APRep{
+		PVNO:    iana.PVNO,
+		MsgType: msgtype.KRB_AP_REP,
+		EncPart: encPart,
+	})
+	if err != nil {
+		return nil, err
+	}
+	rep = asn1tools.AddASNAppTag(rep, asnAppTag.APREP)
+
+	out, err := asn1.Marshal(gssapi.OIDKRB5.OID())
+	if err != nil {
+		return nil, err
+	}
+	out = append(out, 0x02, 0x00) // TOK_ID for KRB_AP_REP
+	out = append(out, rep...)
+	return asn1tools.AddASNAppTag(out, 0), nil
+}
@@ -0,0 +1,278 @@
+/*
+ * Seashell - SSH server with virtual hosts and username-based routing
+ *
+ * Copyright (C) 2024 Elara6331 <elara@elara.ws>
+ *
+ * This file is part of Seashell.
+ *
+ * Seashell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * Seashell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with Seashell.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package krl
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"slices"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// Magic is the value every OpenSSH KRL starts with.
+const Magic = "SSHKRL\n\x00"
+
+// ErrInvalid is returned when a KRL can't be parsed.
+var ErrInvalid = errors.New("invalid krl")
+
+// Section types, as described in OpenSSH's PROTOCOL.krl
+const (
+	sectionCertificates      = 1
+	sectionExplicitKey       = 2
+	sectionFingerprintSHA1   = 3
+	sectionSignature         = 4
+	sectionFingerprintSHA256 = 5
+
+	certSectionSerialList   = 0x20
+	certSectionSerialRange  = 0x21
+	certSectionSerialBitmap = 0x22
+	certSectionKeyID        = 0x23
+)
+
+// KRL is a parsed OpenSSH key revocation list. Signatures in the KRL
+// aren't verified, so it should come from a trusted source.
+type KRL struct {
+	Version uint64
+	Comment string
+
+	// keys contains the wire format of explicitly revoked keys
+	keys   [][]byte
+	sha1   [][]byte
+	sha256 [][]byte
+	certs  []certRevocation
+}
+
+// certRevocation contains the certificates revoked for a single CA.
+type certRevocation struct {
+	// caKey is the wire format of the CA key. If it's empty,
+	// the revocations apply to certificates from any CA.
+	caKey   []byte
+	serials []serialRange
+	keyIDs  []string
+}
+
+// serialRange is a range of revoked certificate serial numbers.
+type serialRange struct {
+	min, max uint64
+}
+
+// Parse parses a binary KRL, as generated by ssh-keygen -k.
+func Parse(data []byte) (*KRL, error) {
+	r := newReader(data)
+	if string(r.bytes(len(Magic))) != Magic {
+		return nil, fmt.Errorf("%w: bad magic", ErrInvalid)
+	}
+	if version := r.uint32(); version != 1 {
+		return nil, fmt.Errorf("%w: unsupported format version %d", ErrInvalid, version)
+	}
+
+	k := &KRL{Version: r.uint64()}
+	r.uint64() // generated date
+	r.uint64() // flags
+	r.string() // reserved
+	k.Comment = string(r.string())
+
+	for r.more() {
+		sectionType, section := r.byte(), newReader(r.string())
+		switch sectionType {
+		case sectionCertificates:
+			k.certs = append(k.certs, parseCertSection(section))
+		case sectionExplicitKey:
+			for section.more() {
+				k.keys = append(k.keys, section.string())
+			}
+		case sectionFingerprintSHA1:
+			for section.more() {
+				k.sha1 = append(k.sha1, section.string())
+			}
+		case sectionFingerprintSHA256:
+			for section.more() {
+				k.sha256 = append(k.sha256, section.string())
+			}
+		case sectionSignature:
+			// Signatures are always at the end, and aren't verified
+			return k, nil
+		default:
+			return nil, fmt.Errorf("%w: unknown section type %d", ErrInvalid, sectionType)
+		}
+
+		if section.failed() {
+			return nil, fmt.Errorf("%w: truncated section", ErrInvalid)
+		}
+	}
+
+	if r.failed() {
+		return nil, fmt.Errorf("%w: truncated data", ErrInvalid)
+	}
+	return k, nil
+}
+
+// parseCertSection parses the revocations for a single CA.
+func parseCertSection(r *reader) certRevocation {
+	cr := certRevocation{caKey: r.string()}
+	r.string() // reserved
+
+	for r.more() {
+		subType, sub := r.byte(), newReader(r.string())
+		switch subType {
+		case certSectionSerialList:
+			for sub.more() {
+				serial := sub.uint64()
+				cr.serials = append(cr.serials, serialRange{serial, serial})
+			}
+		case certSectionSerialRange:
+			cr.serials = append(cr.serials, serialRange{sub.uint64(), sub.uint64()})
+		case certSectionSerialBitmap:
+			offset := sub.uint64()
+			bitmap := new(big.Int).SetBytes(sub.string())
+			for i := range bitmap.BitLen() {
+				if bitmap.Bit(i) == 1 {
+					serial := offset + uint64(i)
+					cr.serials = append(cr.serials, serialRange{serial, serial})
+				}
+			}
+		case certSectionKeyID:
+			for sub.more() {
+				cr.keyIDs = append(cr.keyIDs, string(sub.string()))
+			}
+		}
+
+		if sub.failed() {
+			r.err = true
+		}
+	}
+	return cr
+}
+
+// IsRevoked checks whether a key has been revoked. For certificates, the
+// certificate itself, the key it certifies, and the CA key that signed it
+// are all checked.
+func (k *KRL) IsRevoked(key gossh.PublicKey) bool {
+	if cert, ok := key.(*gossh.Certificate); ok {
+		if k.certRevoked(cert) || k.keyRevoked(cert.Key) || k.keyRevoked(cert.SignatureKey) {
+			return true
+		}
+	}
+	return k.keyRevoked(key)
+}
+
+// keyRevoked checks whether a key is explicitly revoked or has a revoked fingerprint.
+func (k *KRL) keyRevoked(key gossh.PublicKey) bool {
+	blob := key.Marshal()
+	if slices.ContainsFunc(k.keys, func(b []byte) bool { return bytes.Equal(b, blob) }) {
+		return true
+	}
+
+	sha1Sum := sha1.Sum(blob)
+	if slices.ContainsFunc(k.sha1, func(b []byte) bool { return bytes.Equal(b, sha1Sum[:]) }) {
+		return true
+	}
+
+	sha256Sum := sha256.Sum256(blob)
+	return slices.ContainsFunc(k.sha256, func(b []byte) bool { return bytes.Equal(b, sha256Sum[:]) })
+}
+
+// certRevoked checks whether a certificate's serial number or key ID is
+// revoked for the CA that signed it.
+func (k *KRL) certRevoked(cert *gossh.Certificate) bool {
+	caKey := cert.SignatureKey.Marshal()
+	for _, cr := range k.certs {
+		if len(cr.caKey) != 0 && !bytes.Equal(cr.caKey, caKey) {
+			continue
+		}
+
+		if slices.Contains(cr.keyIDs, cert.KeyId) {
+			return true
+		}
+
+		// Serial numbers are only meaningful for a specific CA
+		if len(cr.caKey) == 0 {
+			continue
+		}
+		for _, sr := range cr.serials {
+			if cert.Serial >= sr.min && cert.Serial <= sr.max {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// reader reads values in the SSH wire format. Once a read runs out of
+// data, every further read returns zero values and failed returns true.
+type reader struct {
+	data []byte
+	err  bool
+}
+
+func newReader(data []byte) *reader { return &reader{data: data} }
+
+func (r *reader) bytes(n int) []byte {
+	if r.err || len(r.data) < n {
+		r.err = true
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *reader) byte() byte {
+	if b := r.bytes(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *reader) uint32() uint32 {
+	if b := r.bytes(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (r *reader) uint64() uint64 {
+	if b := r.bytes(8); b != nil {
+		return binary.BigEndian.Uint64(b)
+	}
+	return 0
+}
+
+func (r *reader) string() []byte {
+	n := r.uint32()
+	if uint64(n) > uint64(len(r.data)) {
+		r.err = true
+		return nil
+	}
+	return r.bytes(int(n))
+}
+
+// more checks whether there's data left to read.
+func (r *reader) more() bool { return !r.err && len(r.data) > 0 }
+
+func (r *reader) failed() bool { return r.err }
@@ -0,0 +1,158 @@
+/*
+ * Seashell - SSH server with virtual hosts and username-based routing
+ *
+ * Copyright (C) 2024 Elara6331 <elara@elara.ws>
+ *
+ * This file is part of Seashell.
+ *
+ * Seashell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * Seashell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with Seashell.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package ldapauth
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	"go.elara.ws/seashell/internal/config"
+)
+
+// ErrInvalidCredentials is returned when the directory rejects
+// a user's credentials or the user doesn't exist.
+var ErrInvalidCredentials = errors.New("invalid ldap credentials")
+
+// dialTimeout is the maximum amount of time to wait
+// for a connection to the LDAP server.
+const dialTimeout = 10 * time.Second
+
+// Client authenticates users against an LDAP directory.
+type Client struct {
+	cfg       config.LDAP
+	tlsConfig *tls.Config
+}
+
+// New creates a new client using the given settings.
+func New(cfg config.LDAP) (*Client, error) {
+	if cfg.UserFilter == "" {
+		cfg.UserFilter = "(uid=%s)"
+	}
+	if cfg.GroupAttribute == "" {
+		cfg.GroupAttribute = "memberOf"
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: cfg.TLSSkipVerify}
+	if cfg.TLSCACert != "" {
+		data, err := os.ReadFile(cfg.TLSCACert)
+		if err != nil {
+			return nil, err
+		}
+
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates found in %s", cfg.TLSCACert)
+		}
+	}
+
+	return &Client{cfg: cfg, tlsConfig: tlsConfig}, nil
+}
+
+// Authenticate checks the given credentials against the directory and
+// returns the seashell user they belong to. The user is looked up using
+// the configured filter, and then the server is asked to verify the
+// password by binding as that user.
+func (c *Client) Authenticate(username, password string) (config.User, error) {
+	// Many servers treat a bind with an empty password as an anonymous
+	// bind, which would succeed for any user.
+	if password == "" {
+		return config.User{}, ErrInvalidCredentials
+	}
+
+	conn, err := ldap.DialURL(
+		c.cfg.URL,
+		ldap.DialWithTLSConfig(c.tlsConfig),
+		ldap.DialWithDialer(&net.Dialer{Timeout: dialTimeout}),
+	)
+	if err != nil {
+		return config.User{}, err
+	}
+	defer conn.Close()
+
+	if c.cfg.StartTLS {
+		if err := conn.StartTLS(c.tlsConfig); err != nil {
+			return config.User{}, err
+		}
+	}
+
+	if c.cfg.BindDN != "" {
+		if err := conn.Bind(c.cfg.BindDN, c.cfg.BindPassword); err != nil {
+			return config.User{}, fmt.Errorf("ldap service account bind: %w", err)
+		}
+	}
+
+	res, err := conn.Search(ldap.NewSearchRequest(
+		c.cfg.SearchBase,
+		ldap.ScopeWholeSubtree,
+		ldap.NeverDerefAliases,
+		2, 0, false,
+		fmt.Sprintf(c.cfg.UserFilter, ldap.EscapeFilter(username)),
+		[]string{c.cfg.GroupAttribute},
+		nil,
+	))
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+		return config.User{}, fmt.Errorf("ldap filter matches more than one entry for %s", username)
+	} else if err != nil {
+		return config.User{}, err
+	}
+
+	if len(res.Entries) == 0 {
+		return config.User{}, ErrInvalidCredentials
+	} else if len(res.Entries) > 1 {
+		return config.User{}, fmt.Errorf("ldap filter matches more than one entry for %s", username)
+	}
+	entry := res.Entries[0]
+
+	err = conn.Bind(entry.DN, password)
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+		return config.User{}, ErrInvalidCredentials
+	} else if err != nil {
+		return config.User{}, err
+	}
+
+	return config.User{
+		Name:   username,
+		Groups: c.mapGroups(entry.GetAttributeValues(c.cfg.GroupAttribute)),
+	}, nil
+}
+
+// mapGroups converts the directory groups a user is a member of to seashell
+// groups. Group DNs are compared case-insensitively, and groups that aren't
+// in the group map are ignored.
+func (c *Client) mapGroups(dns []string) []string {
+	groups := append([]string(nil), c.cfg.DefaultGroups...)
+	for _, dn := range dns {
+		for groupDN, group := range c.cfg.GroupMap {
+			if strings.EqualFold(dn, groupDN) {
+				groups = append(groups, group)
+			}
+		}
+	}
+	return groups
+}
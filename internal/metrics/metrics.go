@@ -0,0 +1,184 @@
+/*
+ * Seashell - SSH server with virtual hosts and username-based routing
+ *
+ * Copyright (C) 2024 Elara6331 <elara@elara.ws>
+ *
+ * This file is part of Seashell.
+ *
+ * Seashell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * Seashell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with Seashell.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Labels represents the labels attached to a metric value.
+type Labels map[string]string
+
+// key returns a canonical string representation of the labels,
+// in Prometheus exposition format.
+func (l Labels) key() string {
+	if len(l) == 0 {
+		return ""
+	}
+
+	keys := make([]string, 0, len(l))
+	for k := range l {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+
+	var sb strings.Builder
+	sb.WriteByte('{')
+	for i, k := range keys {
+		if i != 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(sanitizeName(k))
+		sb.WriteByte('=')
+		sb.WriteString(strconv.Quote(l[k]))
+	}
+	sb.WriteByte('}')
+	return sb.String()
+}
+
+// metric represents a single named metric and all of its labeled values.
+type metric struct {
+	name   string
+	help   string
+	kind   string
+	mtx    sync.Mutex
+	values map[string]float64
+}
+
+// add adds v to the value with the given labels.
+func (m *metric) add(labels Labels, v float64) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.values[labels.key()] += v
+}
+
+// set sets the value with the given labels to v.
+func (m *metric) set(labels Labels, v float64) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.values[labels.key()] = v
+}
+
+// writeTo writes the metric to w in Prometheus exposition format.
+func (m *metric) writeTo(w io.Writer) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n", m.name, m.help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", m.name, m.kind)
+
+	keys := make([]string, 0, len(m.values))
+	for k := range m.values {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s%s %s\n", m.name, k, strconv.FormatFloat(m.values[k], 'f', -1, 64))
+	}
+}
+
+// Counter is a metric whose values only ever increase.
+type Counter struct{ m *metric }
+
+// Inc increments the value with the given labels by one.
+func (c Counter) Inc(labels Labels) { c.m.add(labels, 1) }
+
+// Add adds v to the value with the given labels.
+func (c Counter) Add(labels Labels, v float64) { c.m.add(labels, v) }
+
+// Gauge is a metric whose values can go up and down.
+type Gauge struct{ m *metric }
+
+// Inc increments the value with the given labels by one.
+func (g Gauge) Inc(labels Labels) { g.m.add(labels, 1) }
+
+// Dec decrements the value with the given labels by one.
+func (g Gauge) Dec(labels Labels) { g.m.add(labels, -1) }
+
+// Set sets the value with the given labels to v.
+func (g Gauge) Set(labels Labels, v float64) { g.m.set(labels, v) }
+
+var (
+	mtx     sync.Mutex
+	metrics []*metric
+)
+
+// register adds a new metric to the global registry.
+func register(name, help, kind string) *metric {
+	m := &metric{
+		name:   name,
+		help:   help,
+		kind:   kind,
+		values: map[string]float64{},
+	}
+
+	mtx.Lock()
+	defer mtx.Unlock()
+	metrics = append(metrics, m)
+	return m
+}
+
+// NewCounter creates and registers a new [Counter].
+func NewCounter(name, help string) Counter {
+	return Counter{register(name, help, "counter")}
+}
+
+// NewGauge creates and registers a new [Gauge].
+func NewGauge(name, help string) Gauge {
+	return Gauge{register(name, help, "gauge")}
+}
+
+// WriteTo writes all the registered metrics to w
+// in Prometheus exposition format.
+func WriteTo(w io.Writer) {
+	mtx.Lock()
+	defer mtx.Unlock()
+	for _, m := range metrics {
+		m.writeTo(w)
+	}
+}
+
+// Handler returns an HTTP handler that serves all the registered metrics.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, _ *http.Request) {
+		res.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		WriteTo(res)
+	})
+}
+
+// sanitizeName replaces any characters that aren't allowed
+// in Prometheus label names with underscores.
+func sanitizeName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '_' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, name)
+}
@@ -0,0 +1,65 @@
+/*
+ * Seashell - SSH server with virtual hosts and username-based routing
+ *
+ * Copyright (C) 2024 Elara6331 <elara@elara.ws>
+ *
+ * This file is part of Seashell.
+ *
+ * Seashell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * Seashell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with Seashell.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package router
+
+import (
+	"slices"
+
+	"github.com/gliderlabs/ssh"
+	"go.elara.ws/seashell/internal/grants"
+	"go.elara.ws/seashell/internal/sshctx"
+)
+
+// AllowUsers returns a middleware that only lets the given users, and
+// members of the given groups, use a route. Everyone else gets
+// [ErrUnauthorized] before the backend runs, unless they have an active
+// grant for the route. If both lists are empty, everyone is allowed,
+// except for guest users, who can only use routes that list them by name.
+func AllowUsers(users, groups []string, gs *grants.Store) Middleware {
+	return func(next Handler) Handler {
+		return func(sess ssh.Session, arg string) error {
+			user, _ := sshctx.GetUser(sess.Context())
+			if slices.Contains(users, user.Name) {
+				return next(sess, arg)
+			}
+
+			ro, _ := sess.Context().Value(routeKey{}).(route)
+			if gs.Allowed(user.Name, ro.name) {
+				return next(sess, arg)
+			}
+
+			if user.Guest {
+				return ErrUnauthorized
+			} else if len(users) == 0 && len(groups) == 0 {
+				return next(sess, arg)
+			}
+
+			for _, group := range user.Groups {
+				if slices.Contains(groups, group) {
+					return next(sess, arg)
+				}
+			}
+
+			return ErrUnauthorized
+		}
+	}
+}
@@ -0,0 +1,91 @@
+/*
+ * Seashell - SSH server with virtual hosts and username-based routing
+ *
+ * Copyright (C) 2024 Elara6331 <elara@elara.ws>
+ *
+ * This file is part of Seashell.
+ *
+ * Seashell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * Seashell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with Seashell.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package router
+
+import (
+	"errors"
+	"math/rand"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	"go.elara.ws/seashell/internal/config"
+)
+
+// ErrChaosFailure is returned by backend connections that
+// [InjectDialFailure] decided to fail.
+var ErrChaosFailure = errors.New("chaos: injected connection failure")
+
+// InjectDialFailure randomly returns [ErrChaosFailure] according to the
+// failure rate in cfg. Backends call it every time they dial an upstream
+// server, so that injected failures go through their retry and backoff
+// logic like real ones. It always returns nil if cfg is nil.
+func InjectDialFailure(cfg *config.Chaos) error {
+	if cfg != nil && rand.Float64() < cfg.FailureRate {
+		return ErrChaosFailure
+	}
+	return nil
+}
+
+// Chaos returns a middleware that injects artificial latency and mid-session
+// disconnects according to the given settings. Connection failures are
+// injected by the backends using [InjectDialFailure]. It's meant for
+// resilience drills and should only be used in debug mode.
+func Chaos(cfg config.Chaos) (Middleware, error) {
+	var latency, disconnectAfter time.Duration
+	var err error
+
+	if cfg.Latency != "" {
+		latency, err = time.ParseDuration(cfg.Latency)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.DisconnectAfter != "" {
+		disconnectAfter, err = time.ParseDuration(cfg.DisconnectAfter)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return func(next Handler) Handler {
+		return func(sess ssh.Session, arg string) error {
+			if latency > 0 {
+				select {
+				case <-time.After(latency):
+				case <-sess.Context().Done():
+					return sess.Context().Err()
+				}
+			}
+
+			if disconnectAfter > 0 && rand.Float64() < cfg.DisconnectRate {
+				timer := time.AfterFunc(disconnectAfter, func() {
+					writeError(sess, "chaos: injected disconnect")
+					sess.Close()
+				})
+				defer timer.Stop()
+			}
+
+			return next(sess, arg)
+		}
+	}, nil
+}
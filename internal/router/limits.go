@@ -0,0 +1,68 @@
+/*
+ * Seashell - SSH server with virtual hosts and username-based routing
+ *
+ * Copyright (C) 2024 Elara6331 <elara@elara.ws>
+ *
+ * This file is part of Seashell.
+ *
+ * Seashell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * Seashell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with Seashell.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package router
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/gliderlabs/ssh"
+	"go.elara.ws/seashell/internal/sshctx"
+)
+
+// MaxSessions returns a middleware that limits each user to max concurrent
+// sessions. The sessions are counted across every handler the middleware is
+// used with, so it can limit sessions per route or across the whole server.
+// If max is zero or less, the number of sessions isn't limited.
+func MaxSessions(max int) Middleware {
+	var mu sync.Mutex
+	counts := map[string]int{}
+
+	return func(next Handler) Handler {
+		if max <= 0 {
+			return next
+		}
+
+		return func(sess ssh.Session, arg string) error {
+			user, _ := sshctx.GetUser(sess.Context())
+
+			mu.Lock()
+			if counts[user.Name] >= max {
+				mu.Unlock()
+				return fmt.Errorf("too many sessions: you already have %d active sessions, which is the maximum allowed", max)
+			}
+			counts[user.Name]++
+			mu.Unlock()
+
+			defer func() {
+				mu.Lock()
+				defer mu.Unlock()
+				counts[user.Name]--
+				if counts[user.Name] == 0 {
+					delete(counts, user.Name)
+				}
+			}()
+
+			return next(sess, arg)
+		}
+	}
+}
@@ -22,7 +22,9 @@
 package router
 
 import (
+	"errors"
 	"log/slog"
+	"slices"
 	"time"
 
 	"github.com/gliderlabs/ssh"
@@ -42,6 +44,7 @@ func Logging(log *slog.Logger) Middleware {
 				"Incoming user session",
 				slog.String("user", user.Name),
 				slog.String("route", route.name),
+				labelsGroup(route.labels),
 				slog.String("arg", arg),
 				slog.String("addr", sess.RemoteAddr().String()),
 			)
@@ -50,11 +53,22 @@ func Logging(log *slog.Logger) Middleware {
 			err := next(sess, arg)
 			duration := time.Since(start)
 
-			if err != nil {
+			var exitErr ExitStatusError
+			if errors.As(err, &exitErr) {
+				log.Info(
+					"Connection closed",
+					slog.String("user", user.Name),
+					slog.String("route", route.name),
+					labelsGroup(route.labels),
+					slog.Duration("duration", duration),
+					slog.Int("exit_status", exitErr.ExitStatus()),
+				)
+			} else if err != nil {
 				log.Error(
 					"Connection closed",
 					slog.String("user", user.Name),
 					slog.String("route", route.name),
+					labelsGroup(route.labels),
 					slog.Duration("duration", duration),
 					slog.String("addr", sess.RemoteAddr().String()),
 					slog.Any("error", err),
@@ -64,6 +78,7 @@ func Logging(log *slog.Logger) Middleware {
 					"Connection closed",
 					slog.String("user", user.Name),
 					slog.String("route", route.name),
+					labelsGroup(route.labels),
 					slog.Duration("duration", duration),
 				)
 			}
@@ -72,3 +87,18 @@ func Logging(log *slog.Logger) Middleware {
 		}
 	}
 }
+
+// labelsGroup returns a log attribute containing the route's labels.
+func labelsGroup(labels map[string]string) slog.Attr {
+	keys := make([]string, 0, len(labels))
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	attrs := make([]any, len(keys))
+	for i, key := range keys {
+		attrs[i] = slog.String(key, labels[key])
+	}
+	return slog.Group("labels", attrs...)
+}
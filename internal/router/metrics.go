@@ -0,0 +1,82 @@
+/*
+ * Seashell - SSH server with virtual hosts and username-based routing
+ *
+ * Copyright (C) 2024 Elara6331 <elara@elara.ws>
+ *
+ * This file is part of Seashell.
+ *
+ * Seashell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * Seashell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with Seashell.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package router
+
+import (
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	"go.elara.ws/seashell/internal/metrics"
+	"go.elara.ws/seashell/internal/sshctx"
+)
+
+var (
+	sessionsTotal = metrics.NewCounter(
+		"seashell_sessions_total",
+		"Total number of sessions handled by each route",
+	)
+	sessionErrors = metrics.NewCounter(
+		"seashell_session_errors_total",
+		"Total number of sessions that ended with an error",
+	)
+	sessionSeconds = metrics.NewCounter(
+		"seashell_session_seconds_total",
+		"Total time spent in sessions, for usage attribution",
+	)
+	activeSessions = metrics.NewGauge(
+		"seashell_active_sessions",
+		"Number of sessions currently active",
+	)
+)
+
+// Metrics returns a middleware that records session counts and usage
+// for each route and user. The route's labels are attached to all of
+// the recorded values.
+func Metrics() Middleware {
+	return func(next Handler) Handler {
+		return func(sess ssh.Session, arg string) error {
+			user, _ := sshctx.GetUser(sess.Context())
+			route := sess.Context().Value(routeKey{}).(route)
+
+			labels := make(metrics.Labels, len(route.labels)+2)
+			for key, val := range route.labels {
+				labels[key] = val
+			}
+			labels["route"] = route.name
+			labels["user"] = user.Name
+
+			sessionsTotal.Inc(labels)
+			activeSessions.Inc(labels)
+			defer activeSessions.Dec(labels)
+
+			start := time.Now()
+			err := next(sess, arg)
+			sessionSeconds.Add(labels, time.Since(start).Seconds())
+
+			if err != nil {
+				sessionErrors.Inc(labels)
+			}
+
+			return err
+		}
+	}
+}
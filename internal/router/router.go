@@ -33,28 +33,53 @@ import (
 // ErrUnauthorized represents an unauthorized access error.
 var ErrUnauthorized = errors.New("you are not authorized to access this resource")
 
+// ExitStatusError is implemented by errors that report the exit status of
+// a command. When a handler returns one, the exit status is sent to the
+// client instead of an error message.
+type ExitStatusError interface {
+	error
+	ExitStatus() int
+}
+
+// exitStatusError is the [ExitStatusError] returned by [ExitStatus].
+type exitStatusError int
+
+func (e exitStatusError) Error() string   { return fmt.Sprintf("command exited with status %d", int(e)) }
+func (e exitStatusError) ExitStatus() int { return int(e) }
+
+// ExitStatus returns an error that makes the router send the given exit
+// status to the client. It returns nil if code is zero.
+func ExitStatus(code int) error {
+	if code == 0 {
+		return nil
+	}
+	return exitStatusError(code)
+}
+
 // Handler defines a function type to handle SSH sessions.
 type Handler func(sess ssh.Session, arg string) error
 
 // Middleware defines a function type for middleware.
 type Middleware func(next Handler) Handler
 
-// Router manages routing and middleware for SSH sessions.
+// Router manages routing and middleware for SSH sessions. Routes are
+// matched in the order they were registered.
 type Router struct {
-	routes      map[string]route
+	routes      []route
 	middlewares []Middleware
 }
 
 // route represents a single route configuration.
 type route struct {
 	name    string
+	labels  map[string]string
 	handler Handler
 	regex   *regexp.Regexp
 }
 
 // New creates and returns a new [Router] instance.
 func New() *Router {
-	return &Router{routes: map[string]route{}}
+	return &Router{}
 }
 
 // Use adds a middleware to the router.
@@ -62,17 +87,25 @@ func (r *Router) Use(m Middleware) {
 	r.middlewares = append(r.middlewares, m)
 }
 
-// Handle registers a new route with the given name and pattern.
-func (r *Router) Handle(name, pattern string, h Handler) error {
+// Handle registers a new route with the given name, pattern, and labels.
+// It returns an error if another route already uses the same pattern.
+func (r *Router) Handle(name, pattern string, labels map[string]string, h Handler) error {
+	for _, ro := range r.routes {
+		if ro.regex.String() == pattern {
+			return fmt.Errorf("route %q has the same pattern as route %q: %q", name, ro.name, pattern)
+		}
+	}
+
 	re, err := regexp.Compile(pattern)
 	if err != nil {
 		return err
 	}
-	r.routes[pattern] = route{
+	r.routes = append(r.routes, route{
 		name:    name,
+		labels:  labels,
 		handler: h,
 		regex:   re,
-	}
+	})
 	return nil
 }
 
@@ -106,14 +139,25 @@ func (r *Router) Handler(sess ssh.Session) {
 		}
 
 		err := handler(sess, cleanArg)
-		if err != nil {
+
+		var exitErr ExitStatusError
+		if errors.As(err, &exitErr) {
+			code := exitErr.ExitStatus()
+			if code < 0 {
+				// The command was most likely killed by a signal
+				code = 255
+			}
+			sess.Exit(code)
+		} else if err != nil {
 			writeError(sess, err.Error())
+			sess.Exit(1)
 		}
 
 		return
 	}
 
 	writeError(sess, "no matching route found for %q", arg)
+	sess.Exit(1)
 }
 
 // writeError writes a formatted error message to the SSH session.
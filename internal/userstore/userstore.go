@@ -0,0 +1,187 @@
+/*
+ * Seashell - SSH server with virtual hosts and username-based routing
+ *
+ * Copyright (C) 2024 Elara6331 <elara@elara.ws>
+ *
+ * This file is part of Seashell.
+ *
+ * Seashell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * Seashell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with Seashell.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package userstore
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	_ "github.com/lib/pq"
+	"go.elara.ws/seashell/internal/config"
+	_ "modernc.org/sqlite"
+)
+
+// Store is a source of seashell users that can change while seashell is
+// running. Users are looked up every time someone logs in, so changes take
+// effect immediately.
+type Store interface {
+	// GetUser returns the user with the given name. If there's no such
+	// user, ok is false and err is nil.
+	GetUser(ctx context.Context, name string) (user config.User, ok bool, err error)
+	Close() error
+}
+
+// KeyStore is implemented by stores that can save changes
+// to users' public keys, such as ones users add themselves.
+type KeyStore interface {
+	AddPubkey(ctx context.Context, name, pubkey string) error
+	RemovePubkey(ctx context.Context, name, pubkey string) error
+}
+
+// PubkeyLookup is implemented by stores that can find users by
+// one of their public keys, which is used for public key lookup.
+type PubkeyLookup interface {
+	// UsersWithPubkey returns the names of the users that have the given
+	// public key, which is in the authorized_keys format without a comment.
+	UsersWithPubkey(ctx context.Context, pubkey string) ([]string, error)
+}
+
+// PasswordStore is implemented by stores that can save
+// new password hashes, such as ones users set themselves.
+type PasswordStore interface {
+	SetPassword(ctx context.Context, name, hash string) error
+}
+
+// drivers maps the driver names used in the config
+// to the names of the corresponding database/sql drivers.
+var drivers = map[string]string{
+	"sqlite":   "sqlite",
+	"postgres": "postgres",
+}
+
+// schema creates the tables used to store users if they don't exist yet.
+// It's written so that it works with every supported database.
+var schema = []string{
+	`CREATE TABLE IF NOT EXISTS users (
+		name TEXT PRIMARY KEY,
+		password TEXT NOT NULL DEFAULT ''
+	)`,
+	`CREATE TABLE IF NOT EXISTS user_groups (
+		user_name TEXT NOT NULL REFERENCES users(name) ON DELETE CASCADE,
+		group_name TEXT NOT NULL,
+		PRIMARY KEY (user_name, group_name)
+	)`,
+	`CREATE TABLE IF NOT EXISTS user_pubkeys (
+		user_name TEXT NOT NULL REFERENCES users(name) ON DELETE CASCADE,
+		pubkey TEXT NOT NULL
+	)`,
+}
+
+// Open connects to the database described by cfg and
+// creates the user tables if needed.
+func Open(cfg config.Database) (Store, error) {
+	driver, ok := drivers[cfg.Driver]
+	if !ok {
+		return nil, fmt.Errorf("unknown database driver: %q", cfg.Driver)
+	}
+
+	db, err := sql.Open(driver, cfg.DSN)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, stmt := range schema {
+		if _, err := db.Exec(stmt); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+
+	return &sqlStore{db: db}, nil
+}
+
+// sqlStore is a [Store] backed by an SQL database.
+type sqlStore struct {
+	db *sql.DB
+}
+
+func (s *sqlStore) GetUser(ctx context.Context, name string) (config.User, bool, error) {
+	user := config.User{Name: name}
+	err := s.db.QueryRowContext(ctx, "SELECT password FROM users WHERE name = $1", name).Scan(&user.Password)
+	if errors.Is(err, sql.ErrNoRows) {
+		return config.User{}, false, nil
+	} else if err != nil {
+		return config.User{}, false, err
+	}
+
+	user.Groups, err = s.queryStrings(ctx, "SELECT group_name FROM user_groups WHERE user_name = $1", name)
+	if err != nil {
+		return config.User{}, false, err
+	}
+
+	user.Pubkeys, err = s.queryStrings(ctx, "SELECT pubkey FROM user_pubkeys WHERE user_name = $1", name)
+	if err != nil {
+		return config.User{}, false, err
+	}
+
+	return user, true, nil
+}
+
+// queryStrings runs a query that returns a single string column
+// and returns all the values it contains.
+func (s *sqlStore) queryStrings(ctx context.Context, query string, args ...any) ([]string, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []string
+	for rows.Next() {
+		var val string
+		if err := rows.Scan(&val); err != nil {
+			return nil, err
+		}
+		out = append(out, val)
+	}
+	return out, rows.Err()
+}
+
+func (s *sqlStore) AddPubkey(ctx context.Context, name, pubkey string) error {
+	_, err := s.db.ExecContext(ctx, "INSERT INTO user_pubkeys (user_name, pubkey) VALUES ($1, $2)", name, pubkey)
+	return err
+}
+
+func (s *sqlStore) RemovePubkey(ctx context.Context, name, pubkey string) error {
+	_, err := s.db.ExecContext(ctx, "DELETE FROM user_pubkeys WHERE user_name = $1 AND pubkey = $2", name, pubkey)
+	return err
+}
+
+func (s *sqlStore) UsersWithPubkey(ctx context.Context, pubkey string) ([]string, error) {
+	// Saved keys may have a comment after the key data
+	return s.queryStrings(
+		ctx,
+		"SELECT DISTINCT user_name FROM user_pubkeys WHERE pubkey = $1 OR pubkey LIKE $2",
+		pubkey, pubkey+" %",
+	)
+}
+
+func (s *sqlStore) SetPassword(ctx context.Context, name, hash string) error {
+	_, err := s.db.ExecContext(ctx, "UPDATE users SET password = $1 WHERE name = $2", hash, name)
+	return err
+}
+
+func (s *sqlStore) Close() error {
+	return s.db.Close()
+}
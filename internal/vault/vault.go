@@ -0,0 +1,197 @@
+/*
+ * Seashell - SSH server with virtual hosts and username-based routing
+ *
+ * Copyright (C) 2024 Elara6331 <elara@elara.ws>
+ *
+ * This file is part of Seashell.
+ *
+ * Seashell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * Seashell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with Seashell.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package vault
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrNotConfigured is returned when a secret is requested from Vault,
+// but no Vault server has been configured.
+var ErrNotConfigured = errors.New("vault is not configured")
+
+// Client is a minimal client for the HashiCorp Vault HTTP API.
+type Client struct {
+	Address   string
+	Token     string
+	Namespace string
+	HTTP      *http.Client
+}
+
+var (
+	mtx           sync.Mutex
+	defaultClient *Client
+)
+
+// SetDefault sets the client returned by [Default].
+func SetDefault(c *Client) {
+	mtx.Lock()
+	defer mtx.Unlock()
+	defaultClient = c
+}
+
+// Default returns the client configured using [SetDefault],
+// or nil if there isn't one.
+func Default() *Client {
+	mtx.Lock()
+	defer mtx.Unlock()
+	return defaultClient
+}
+
+// New creates a new Vault client. If address or token are empty,
+// the VAULT_ADDR and VAULT_TOKEN environment variables are used instead.
+func New(address, token, namespace string) *Client {
+	if address == "" {
+		address = os.Getenv("VAULT_ADDR")
+	}
+	if token == "" {
+		token = os.Getenv("VAULT_TOKEN")
+	}
+	return &Client{
+		Address:   strings.TrimSuffix(address, "/"),
+		Token:     token,
+		Namespace: namespace,
+		HTTP:      &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// response represents the parts of a Vault API response that seashell uses.
+type response struct {
+	Data   map[string]any `json:"data"`
+	Errors []string       `json:"errors"`
+}
+
+// do sends a request to the Vault API and decodes the response's data.
+func (c *Client) do(ctx context.Context, method, path string, body any) (map[string]any, error) {
+	if c == nil {
+		return nil, ErrNotConfigured
+	}
+
+	var reqBody bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&reqBody).Encode(body); err != nil {
+			return nil, err
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.Address+"/v1/"+strings.TrimPrefix(path, "/"), &reqBody)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Vault-Token", c.Token)
+	if c.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", c.Namespace)
+	}
+
+	res, err := c.HTTP.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	var out response
+	if err := json.NewDecoder(res.Body).Decode(&out); err != nil {
+		return nil, fmt.Errorf("vault: decoding response for %s: %w", path, err)
+	}
+
+	if res.StatusCode >= 400 {
+		return nil, fmt.Errorf("vault: %s: %s", path, strings.Join(out.Errors, ", "))
+	}
+
+	return out.Data, nil
+}
+
+// Read reads the secret at the given path. Both KV v1 and KV v2 secrets
+// are supported. For KV v2, the path must include the data/ segment,
+// just like when using the API directly.
+func (c *Client) Read(ctx context.Context, path string) (map[string]any, error) {
+	data, err := c.do(ctx, http.MethodGet, path, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// KV v2 secrets nest the actual data inside a data field
+	// next to the secret's metadata.
+	if inner, ok := data["data"].(map[string]any); ok {
+		if _, ok := data["metadata"]; ok {
+			return inner, nil
+		}
+	}
+
+	return data, nil
+}
+
+// Write writes data to the given path and returns the response data.
+func (c *Client) Write(ctx context.Context, path string, data map[string]any) (map[string]any, error) {
+	return c.do(ctx, http.MethodPost, path, data)
+}
+
+// ReadField reads a single string field from a secret. The reference must be
+// in the form path#field, e.x. "secret/data/hosts/web#password".
+func (c *Client) ReadField(ctx context.Context, ref string) (string, error) {
+	path, field, ok := strings.Cut(ref, "#")
+	if !ok {
+		return "", fmt.Errorf("vault: secret reference %q is missing a #field suffix", ref)
+	}
+
+	data, err := c.Read(ctx, path)
+	if err != nil {
+		return "", err
+	}
+
+	val, ok := data[field].(string)
+	if !ok {
+		return "", fmt.Errorf("vault: secret %q has no string field %q", path, field)
+	}
+
+	return val, nil
+}
+
+// SignSSHKey asks the Vault SSH secrets engine to sign a public key.
+// The path should be the sign endpoint of a role, e.x. "ssh-client-signer/sign/my-role".
+// It returns the signed certificate in authorized_keys format.
+func (c *Client) SignSSHKey(ctx context.Context, path string, pubkey []byte, principals ...string) ([]byte, error) {
+	data, err := c.Write(ctx, path, map[string]any{
+		"public_key":       string(pubkey),
+		"valid_principals": strings.Join(principals, ","),
+		"cert_type":        "user",
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	signed, ok := data["signed_key"].(string)
+	if !ok {
+		return nil, fmt.Errorf("vault: response from %s contains no signed key", path)
+	}
+
+	return []byte(signed), nil
+}
@@ -22,9 +22,15 @@
 package main
 
 import (
+	"cmp"
+	"crypto"
+	"crypto/ecdsa"
 	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rand"
+	"crypto/rsa"
 	"encoding/pem"
+	"fmt"
 	"io/fs"
 	"log/slog"
 	"os"
@@ -36,17 +42,47 @@ import (
 	gossh "golang.org/x/crypto/ssh"
 )
 
-// ensureHostKeys attempts to add any host ssh keys to the server.
-// If no keys are found, it generates and saves a new ed25519 keypair.
-func ensureHostKeys(sshdir string, srv *ssh.Server) error {
+// Default host key generation settings
+const (
+	defaultRSABits    = 3072
+	defaultECDSABits  = 256
+	defaultKeyType    = "ed25519"
+	hostKeyFilePrefix = "id_"
+)
+
+// hostKeyOptions contains the settings used to generate host keys.
+type hostKeyOptions struct {
+	// types contains the algorithms (ed25519, rsa, or ecdsa)
+	// that the server should have a host key for.
+	types     []string
+	rsaBits   int
+	ecdsaBits int
+}
+
+// ensureHostKeys attempts to add any host ssh keys to the server. If no key is
+// found for one of the configured types, a new keypair of that type is generated
+// and saved. By default, an ed25519 keypair is only generated if there are no
+// host keys at all.
+func ensureHostKeys(sshdir string, srv *ssh.Server, opts hostKeyOptions) error {
 	err := addHostKeys(sshdir, srv)
 	if err != nil {
 		return err
 	}
 
-	if len(srv.HostSigners) == 0 {
-		log.Warn("No valid host keys found. Generating new ed25519 keys...")
-		err = generateAndSaveKeys(sshdir, srv)
+	if len(opts.types) == 0 {
+		if len(srv.HostSigners) > 0 {
+			return nil
+		}
+		opts.types = []string{defaultKeyType}
+	}
+
+	for _, keyType := range opts.types {
+		if hasHostKey(srv, keyType) {
+			continue
+		}
+
+		log.Warn("No valid host key found. Generating a new one...", slog.String("type", keyType))
+		err = generateAndSaveKey(sshdir, srv, keyType, opts)
 		if err != nil {
 			return err
 		}
@@ -55,14 +91,61 @@ func ensureHostKeys(sshdir string, srv *ssh.Server) error {
 	return nil
 }
 
-// generateAndSaveKeys generates a new ed25519 keypair and saves it
-// in the ssh directory.
-func generateAndSaveKeys(sshdir string, srv *ssh.Server) error {
+// hasHostKey checks whether the server has a host key of the given type.
+func hasHostKey(srv *ssh.Server, keyType string) bool {
+	for _, signer := range srv.HostSigners {
+		switch pubType := signer.PublicKey().Type(); keyType {
+		case "ed25519":
+			if pubType == gossh.KeyAlgoED25519 {
+				return true
+			}
+		case "rsa":
+			if pubType == gossh.KeyAlgoRSA {
+				return true
+			}
+		case "ecdsa":
+			if strings.HasPrefix(pubType, "ecdsa-") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// generateKey generates a new private key of the given type.
+func generateKey(keyType string, opts hostKeyOptions) (crypto.Signer, error) {
+	switch keyType {
+	case "ed25519":
+		_, privkey, err := ed25519.GenerateKey(rand.Reader)
+		return privkey, err
+	case "rsa":
+		return rsa.GenerateKey(rand.Reader, cmp.Or(opts.rsaBits, defaultRSABits))
+	case "ecdsa":
+		var curve elliptic.Curve
+		switch cmp.Or(opts.ecdsaBits, defaultECDSABits) {
+		case 256:
+			curve = elliptic.P256()
+		case 384:
+			curve = elliptic.P384()
+		case 521:
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("invalid ecdsa key size: %d", opts.ecdsaBits)
+		}
+		return ecdsa.GenerateKey(curve, rand.Reader)
+	default:
+		return nil, fmt.Errorf("unknown host key type: %q", keyType)
+	}
+}
+
+// generateAndSaveKey generates a new keypair of the given type
+// and saves it in the ssh directory.
+func generateAndSaveKey(sshdir string, srv *ssh.Server, keyType string, opts hostKeyOptions) error {
 	if err := os.MkdirAll(sshdir, 0o755); err != nil {
 		return err
 	}
 
-	_, privkey, err := ed25519.GenerateKey(rand.Reader)
+	privkey, err := generateKey(keyType, opts)
 	if err != nil {
 		return err
 	}
@@ -90,12 +173,13 @@ func generateAndSaveKeys(sshdir string, srv *ssh.Server) error {
 	privdata := pem.EncodeToMemory(privpem)
 	pubdata := gossh.MarshalAuthorizedKey(sshkey.PublicKey())
 
-	err = os.WriteFile(filepath.Join(sshdir, "id_ed25519"), privdata, 0o600)
+	path := filepath.Join(sshdir, hostKeyFilePrefix+keyType)
+	err = os.WriteFile(path, privdata, 0o600)
 	if err != nil {
 		return err
 	}
 
-	return os.WriteFile(filepath.Join(sshdir, "id_ed25519.pub"), pubdata, 0o644)
+	return os.WriteFile(path+".pub", pubdata, 0o644)
 }
 
 // addHostKeys recursively walks the ssh directory looking for valid keypairs
@@ -110,7 +194,7 @@ func addHostKeys(sshdir string, srv *ssh.Server) error {
 			return err
 		}
 
-		if d.IsDir() || filepath.Ext(path) == ".pub" || !strings.HasPrefix(d.Name(), "id_") {
+		if d.IsDir() || filepath.Ext(path) == ".pub" || !strings.HasPrefix(d.Name(), hostKeyFilePrefix) {
 			return nil
 		}
 
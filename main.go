@@ -22,9 +22,13 @@
 package main
 
 import (
+	"cmp"
+	"errors"
 	"flag"
 	"fmt"
 	"log/slog"
+	"net"
+	"net/http"
 	"os"
 	"path/filepath"
 	"time"
@@ -32,10 +36,18 @@ import (
 	"github.com/alexedwards/argon2id"
 	"github.com/gliderlabs/ssh"
 	"go.elara.ws/loggers"
+	"go.elara.ws/seashell/internal/approval"
+	"go.elara.ws/seashell/internal/authhook"
 	"go.elara.ws/seashell/internal/backends"
 	"go.elara.ws/seashell/internal/config"
 	"go.elara.ws/seashell/internal/fail2ban"
+	"go.elara.ws/seashell/internal/grants"
+	"go.elara.ws/seashell/internal/krbauth"
+	"go.elara.ws/seashell/internal/ldapauth"
+	"go.elara.ws/seashell/internal/metrics"
 	"go.elara.ws/seashell/internal/router"
+	"go.elara.ws/seashell/internal/userstore"
+	"go.elara.ws/seashell/internal/vault"
 	"golang.org/x/term"
 )
 
@@ -45,6 +57,9 @@ var (
 )
 
 func main() {
+	// Packages that log using slog directly should use the same format
+	slog.SetDefault(log)
+
 	genHash := flag.Bool("gen-hash", false, "Generate an argon2id hash")
 	configPath := flag.String("config", "/etc/seashell.hcl", "The seashell config file to use")
 	flag.Parse()
@@ -76,8 +91,135 @@ func main() {
 		handler.Level = slog.LevelDebug
 	}
 
+	if cfg.Vault != nil {
+		vault.SetDefault(vault.New(cfg.Vault.Address, cfg.Vault.Token, cfg.Vault.Namespace))
+	}
+
+	policy, err := newAccessPolicy(cfg.Auth)
+	if err != nil {
+		log.Error("Error parsing access policy", slog.Any("error", err))
+		os.Exit(1)
+	}
+
+	if cfg.Settings.ListenAddr == "" {
+		cfg.Settings.ListenAddr = ":2222"
+	}
+
+	var f2b *fail2ban.Fail2Ban
+	if cfg.Auth.Fail2Ban != nil {
+		f2b, err = fail2ban.New(*cfg.Auth.Fail2Ban)
+		if err != nil {
+			log.Error("Error setting up fail2ban", slog.Any("error", err))
+			os.Exit(1)
+		}
+
+		hooks, err := banHooks(*cfg.Auth.Fail2Ban)
+		if err != nil {
+			log.Error("Error setting up fail2ban hooks", slog.Any("error", err))
+			os.Exit(1)
+		}
+		f2b.SetHooks(hooks)
+	}
+
+	var ap authProviders
+	if cfg.Auth.LDAP != nil {
+		ap.ldap, err = ldapauth.New(*cfg.Auth.LDAP)
+		if err != nil {
+			log.Error("Error configuring LDAP authentication", slog.Any("error", err))
+			os.Exit(1)
+		}
+	}
+
+	if cfg.Auth.Database != nil {
+		ap.store, err = userstore.Open(*cfg.Auth.Database)
+		if err != nil {
+			log.Error("Error opening user database", slog.Any("error", err))
+			os.Exit(1)
+		}
+		defer ap.store.Close()
+	}
+
+	vaultCacheTTL := 5 * time.Minute
+	if cfg.Auth.VaultCacheTTL != "" {
+		vaultCacheTTL, err = time.ParseDuration(cfg.Auth.VaultCacheTTL)
+		if err != nil {
+			log.Error("Error parsing vault_cache_ttl", slog.Any("error", err))
+			os.Exit(1)
+		}
+	}
+	ap.vaultCreds = newVaultCredCache(vaultCacheTTL)
+
+	if cfg.Auth.Webhook != nil {
+		ap.webhook, err = authhook.New(*cfg.Auth.Webhook)
+		if err != nil {
+			log.Error("Error configuring authentication webhook", slog.Any("error", err))
+			os.Exit(1)
+		}
+	}
+
+	if cfg.Auth.SelfService != nil {
+		ap.keyFiles = &keyFiles{dir: cfg.Auth.SelfService.KeysDir}
+		if cfg.Auth.SelfService.PasswordsDir != "" {
+			ap.passwordFiles = &passwordFiles{dir: cfg.Auth.SelfService.PasswordsDir}
+		}
+	}
+
+	if cfg.Auth.GSSAPI != nil {
+		ap.kerberos, err = krbauth.New(*cfg.Auth.GSSAPI)
+		if err != nil {
+			log.Error("Error configuring GSSAPI authentication", slog.Any("error", err))
+			os.Exit(1)
+		}
+	}
+
+	var gs *grants.Store
+	var approvals *approval.Queue
+	if cfg.Auth.Admin != nil {
+		approvals = approval.NewQueue()
+		gs, err = grants.Open(cfg.Auth.Admin.GrantsFile)
+		if err != nil {
+			log.Error("Error loading access grants", slog.Any("error", err))
+			os.Exit(1)
+		}
+	}
+
 	r := router.New()
+	r.Use(policy.middleware())
+	r.Use(router.MaxSessions(cfg.Settings.MaxSessions))
 	r.Use(router.Logging(log))
+	r.Use(router.Metrics())
+
+	// Built-in routes are registered first, so routes from the
+	// config can't shadow them.
+	if admin := cfg.Auth.Admin; admin != nil {
+		if len(admin.Users) == 0 && len(admin.Groups) == 0 {
+			log.Error("The admin route requires at least one user or group")
+			os.Exit(1)
+		}
+
+		handler := router.AllowUsers(admin.Users, admin.Groups, nil)(adminHandler(cfg, gs, approvals, f2b))
+		err = r.Handle("admin", cmp.Or(admin.Match, "^admin$"), nil, handler)
+		if err != nil {
+			log.Error("Error adding admin route", slog.Any("error", err))
+			os.Exit(1)
+		}
+	}
+
+	if cfg.Auth.SelfService != nil {
+		match := cmp.Or(cfg.Auth.SelfService.Match, "^keys$")
+		err = r.Handle("keys", match, nil, selfServiceHandler(cfg, ap))
+		if err != nil {
+			log.Error("Error adding self-service route", slog.Any("error", err))
+			os.Exit(1)
+		}
+
+		match = cmp.Or(cfg.Auth.SelfService.PasswdMatch, "^passwd$")
+		err = r.Handle("passwd", match, nil, passwdHandler(f2b, cfg, ap))
+		if err != nil {
+			log.Error("Error adding self-service route", slog.Any("error", err))
+			os.Exit(1)
+		}
+	}
 
 	for _, route := range cfg.Routes {
 		backend := backends.Get(route.Backend)
@@ -85,28 +227,95 @@ func main() {
 			log.Warn("Invalid backend", slog.String("id", route.Backend))
 			continue
 		}
-		r.Handle(route.Name, route.Match, backend(route))
-	}
 
-	if cfg.Settings.ListenAddr == "" {
-		cfg.Settings.ListenAddr = ":2222"
-	}
+		reauth, err := reauthMiddleware(route.RequireReauth, f2b, ap)
+		if err != nil {
+			log.Warn("Invalid route settings", slog.String("route", route.Name), slog.Any("error", err))
+			continue
+		}
 
-	var f2b *fail2ban.Fail2Ban
-	if cfg.Auth.Fail2Ban != nil {
-		limit, err := time.ParseDuration(cfg.Auth.Fail2Ban.Limit)
+		approve, err := approvalMiddleware(route.Name, route.Approval, approvals)
 		if err != nil {
-			log.Error("Error parsing fail2ban limit", slog.Any("error", err))
+			log.Warn("Invalid approval settings", slog.String("route", route.Name), slog.Any("error", err))
+			continue
+		}
+
+		// Chaos settings are cleared when they're ignored, since
+		// backends use them to inject failures when dialing.
+		var chaos router.Middleware
+		if route.Chaos != nil && !cfg.Settings.Debug {
+			log.Warn("Ignoring chaos settings because debug mode is disabled", slog.String("route", route.Name))
+			route.Chaos = nil
+		} else if route.Chaos != nil {
+			chaos, err = router.Chaos(*route.Chaos)
+			if err != nil {
+				log.Warn("Invalid chaos settings", slog.String("route", route.Name), slog.Any("error", err))
+				continue
+			}
+			log.Warn("Chaos testing enabled for route", slog.String("route", route.Name))
+		}
+
+		handler := router.MaxSessions(route.MaxSessions)(backend(route))
+		handler = approve(handler)
+		handler = reauth(handler)
+		handler = router.AllowUsers(route.Users, route.Groups, gs)(handler)
+		if chaos != nil {
+			handler = chaos(handler)
+		}
+
+		if err := r.Handle(route.Name, route.Match, route.Labels, handler); err != nil {
+			log.Error("Error adding route", slog.String("route", route.Name), slog.Any("error", err))
+			os.Exit(1)
 		}
-		f2b = fail2ban.New(limit, cfg.Auth.Fail2Ban.Attempts)
+	}
+
+	cf, err := newCIDRFilter(cfg.Settings.AllowCIDRs, cfg.Settings.DenyCIDRs)
+	if err != nil {
+		log.Error("Error parsing CIDR filter", slog.Any("error", err))
+		os.Exit(1)
 	}
 
 	srv := &ssh.Server{
 		Addr:                     cfg.Settings.ListenAddr,
 		Handler:                  r.Handler,
-		PublicKeyHandler:         pubkeyHandler(f2b, cfg),
-		PasswordHandler:          passwordHandler(f2b, cfg),
+		SubsystemHandlers:        map[string]ssh.SubsystemHandler{"sftp": r.Handler},
 		ConnectionFailedCallback: failedConnHandler(f2b),
+		ConnCallback:             connFilter(cf),
+		Version:                  cfg.Settings.Version,
+		Banner:                   cfg.Settings.Banner,
+	}
+
+	revoked, err := newRevocationList(cfg.Auth.RevokedKeys)
+	if err != nil {
+		log.Error("Error loading revoked keys", slog.Any("error", err))
+		os.Exit(1)
+	}
+
+	pubkeyAuth := withAccessPolicy(policy, pubkeyHandler(f2b, cfg, ap, revoked))
+	passwordAuth := withAccessPolicy(policy, passwordHandler(f2b, cfg, ap))
+	algos, err := algorithmConfig(cfg.Settings)
+	if err != nil {
+		log.Error("Error parsing algorithm settings", slog.Any("error", err))
+		os.Exit(1)
+	}
+
+	handlers := authHandlers{
+		guest:    withAccessPolicy(policy, guestHandler(f2b, cfg, ap)),
+		pubkey:   pubkeyAuth,
+		password: passwordAuth,
+	}
+	if ap.kerberos != nil {
+		handlers.gssapi = withAccessPolicy(policy, gssapiHandler(f2b, cfg, ap))
+	}
+	srv.ServerConfigCallback = serverConfig(f2b, cfg, ap, algos, handlers)
+	if len(cfg.Auth.Chain) > 0 {
+		if err := validateChain(cfg.Auth.Chain); err != nil {
+			log.Error("Error parsing authentication chain", slog.Any("error", err))
+			os.Exit(1)
+		}
+	} else {
+		srv.PublicKeyHandler = pubkeyAuth
+		srv.PasswordHandler = passwordAuth
 	}
 
 	if cfg.Settings.SSHDir == "" {
@@ -118,15 +327,64 @@ func main() {
 		cfg.Settings.SSHDir = filepath.Join(homedir, ".ssh")
 	}
 
-	err = ensureHostKeys(cfg.Settings.SSHDir, srv)
+	err = ensureHostKeys(cfg.Settings.SSHDir, srv, hostKeyOptions{
+		types:     cfg.Settings.HostKeyTypes,
+		rsaBits:   cfg.Settings.HostKeyRSABits,
+		ecdsaBits: cfg.Settings.HostKeyECDSABits,
+	})
 	if err != nil {
 		log.Error("Error adding host keys", slog.Any("error", err))
 		os.Exit(1)
 	}
 
+	err = restrictHostKeyAlgorithms(srv, cfg.Settings.HostKeyAlgorithms)
+	if err != nil {
+		log.Error("Error configuring host key algorithms", slog.Any("error", err))
+		os.Exit(1)
+	}
+
+	ln, err := listen(listenFDEnv, srv.Addr)
+	if err != nil {
+		log.Error("Error starting listener", slog.Any("error", err))
+		os.Exit(1)
+	}
+	lns := map[string]net.Listener{listenFDEnv: ln}
+
+	metricsSrv := &http.Server{Handler: metrics.Handler()}
+	if cfg.Settings.MetricsAddr != "" {
+		metricsLn, err := listen(metricsFDEnv, cfg.Settings.MetricsAddr)
+		if err != nil {
+			log.Error("Error starting metrics server", slog.Any("error", err))
+		} else {
+			lns[metricsFDEnv] = metricsLn
+			go func() {
+				log.Info("Starting metrics server", slog.String("addr", cfg.Settings.MetricsAddr))
+				err := metricsSrv.Serve(metricsLn)
+				if err != nil && !errors.Is(err, http.ErrServerClosed) {
+					log.Error("Error while running metrics server", slog.Any("error", err))
+				}
+			}()
+		}
+	}
+
+	// Once a new process has taken over, it serves metrics and saves the
+	// state, so this one must stop doing that while its sessions drain.
+	handover := func() {
+		metricsSrv.Close()
+		f2b.Detach()
+		gs.Detach()
+	}
+
+	done := make(chan struct{})
+	go handleUpgrades(srv, lns, handover, done)
+	notifyReady()
+
 	log.Info("Starting seashell server", slog.String("addr", srv.Addr))
 
-	if err := srv.ListenAndServe(); err != nil {
+	if err := srv.Serve(ln); errors.Is(err, ssh.ErrServerClosed) {
+		<-done
+		log.Info("All sessions drained, exiting")
+	} else if err != nil {
 		log.Error("Error while running server", slog.Any("error", err))
 	}
 }
@@ -0,0 +1,194 @@
+/*
+ * Seashell - SSH server with virtual hosts and username-based routing
+ *
+ * Copyright (C) 2024 Elara6331 <elara@elara.ws>
+ *
+ * This file is part of Seashell.
+ *
+ * Seashell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * Seashell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with Seashell.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	"go.elara.ws/seashell/internal/config"
+	"go.elara.ws/seashell/internal/fail2ban"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// errPermissionDenied is returned by failed authentication steps. The
+// failed connection handler relies on the "permission denied" message.
+var errPermissionDenied = errors.New("permission denied")
+
+// Authentication methods that can be used in a chain
+const (
+	methodPublicKey = "publickey"
+	methodPassword  = "password"
+	methodTOTP      = "totp"
+)
+
+// validateChain checks that every step in an authentication chain is valid.
+func validateChain(chain []string) error {
+	for _, method := range chain {
+		switch method {
+		case methodPublicKey, methodPassword, methodTOTP:
+		default:
+			return fmt.Errorf("unknown authentication method in chain: %q", method)
+		}
+	}
+	return nil
+}
+
+// chainStep returns the authentication callbacks for step i of the chain.
+// Each successful step except the last one reports partial success to the
+// client, along with the callbacks for the next step. Password and TOTP
+// steps are also offered over keyboard-interactive authentication, which
+// is the only way clients can enter TOTP codes.
+func chainStep(ctx ssh.Context, chain []string, i int, f2b *fail2ban.Fail2Ban, cfg config.Config, ap authProviders, pubkey ssh.PublicKeyHandler, password ssh.PasswordHandler) gossh.ServerAuthCallbacks {
+	next := func() (*gossh.Permissions, error) {
+		if i == len(chain)-1 {
+			return ctx.Permissions().Permissions, nil
+		}
+		return nil, &gossh.PartialSuccessError{
+			Next: chainStep(ctx, chain, i+1, f2b, cfg, ap, pubkey, password),
+		}
+	}
+
+	var callbacks gossh.ServerAuthCallbacks
+	switch chain[i] {
+	case methodPublicKey:
+		callbacks.PublicKeyCallback = func(conn gossh.ConnMetadata, key gossh.PublicKey) (*gossh.Permissions, error) {
+			setConnMetadata(ctx, conn)
+			if !pubkey(ctx, key) {
+				return nil, errPermissionDenied
+			}
+			ctx.SetValue(ssh.ContextKeyPublicKey, key)
+			return next()
+		}
+	case methodPassword:
+		callbacks.PasswordCallback = func(conn gossh.ConnMetadata, pwd []byte) (*gossh.Permissions, error) {
+			setConnMetadata(ctx, conn)
+			if !password(ctx, string(pwd)) {
+				return nil, errPermissionDenied
+			}
+			return next()
+		}
+		callbacks.KeyboardInteractiveCallback = func(conn gossh.ConnMetadata, challenge gossh.KeyboardInteractiveChallenge) (*gossh.Permissions, error) {
+			setConnMetadata(ctx, conn)
+			answers, err := challenge("", "", []string{"Password: "}, []bool{false})
+			if err != nil {
+				return nil, err
+			}
+			if len(answers) != 1 || !password(ctx, answers[0]) {
+				return nil, errPermissionDenied
+			}
+			return next()
+		}
+	case methodTOTP:
+		callbacks.KeyboardInteractiveCallback = func(conn gossh.ConnMetadata, challenge gossh.KeyboardInteractiveChallenge) (*gossh.Permissions, error) {
+			setConnMetadata(ctx, conn)
+			user, ok := getUser(ctx, cfg, ap)
+			if !ok || user.TOTPSecret == "" {
+				return nil, errPermissionDenied
+			}
+
+			answers, err := challenge("", "", []string{"Verification code: "}, []bool{false})
+			if err != nil {
+				return nil, err
+			}
+			if len(answers) != 1 || !checkTOTP(user.Name, user.TOTPSecret, answers[0], time.Now()) {
+				log.Warn("Invalid TOTP code", slog.String("user", user.Name))
+				addFailedUserLogin(f2b, conn.RemoteAddr(), user.Name)
+				return nil, errPermissionDenied
+			}
+			return next()
+		}
+	}
+	return callbacks
+}
+
+// setConnMetadata stores the connection metadata in the context, like the
+// server does before calling its own authentication handlers.
+func setConnMetadata(ctx ssh.Context, conn gossh.ConnMetadata) {
+	if ctx.Value(ssh.ContextKeySessionID) != nil {
+		return
+	}
+	ctx.SetValue(ssh.ContextKeySessionID, fmt.Sprintf("%x", conn.SessionID()))
+	ctx.SetValue(ssh.ContextKeyClientVersion, string(conn.ClientVersion()))
+	ctx.SetValue(ssh.ContextKeyServerVersion, string(conn.ServerVersion()))
+	ctx.SetValue(ssh.ContextKeyUser, conn.User())
+	ctx.SetValue(ssh.ContextKeyLocalAddr, conn.LocalAddr())
+	ctx.SetValue(ssh.ContextKeyRemoteAddr, conn.RemoteAddr())
+}
+
+// totpSteps records the last step a TOTP code was accepted for, for each user.
+var totpSteps = struct {
+	sync.Mutex
+	last map[string]uint64
+}{last: map[string]uint64{}}
+
+// checkTOTP checks a user's time-based one-time password, as described in
+// RFC 6238, using 30 second steps and 6 digit codes. Codes from the previous
+// and next steps are also accepted to allow for clock skew. To prevent
+// replays, a code is rejected unless its step is later than the last one
+// accepted for the user.
+func checkTOTP(username, secret, code string, t time.Time) bool {
+	secret = strings.ToUpper(strings.ReplaceAll(secret, " ", ""))
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.TrimRight(secret, "="))
+	if err != nil {
+		return false
+	}
+
+	counter := uint64(t.Unix() / 30)
+	for _, c := range []uint64{counter - 1, counter, counter + 1} {
+		expected := hotp(key, c)
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) != 1 {
+			continue
+		}
+
+		totpSteps.Lock()
+		defer totpSteps.Unlock()
+		if last, ok := totpSteps.last[username]; ok && c <= last {
+			log.Warn("Rejected reused TOTP code", slog.String("user", username))
+			return false
+		}
+		totpSteps.last[username] = c
+		return true
+	}
+	return false
+}
+
+// hotp generates a 6 digit HMAC-based one-time password, as described in RFC 4226.
+func hotp(key []byte, counter uint64) string {
+	mac := hmac.New(sha1.New, key)
+	binary.Write(mac, binary.BigEndian, counter)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%06d", value%1_000_000)
+}
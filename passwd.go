@@ -0,0 +1,173 @@
+/*
+ * Seashell - SSH server with virtual hosts and username-based routing
+ *
+ * Copyright (C) 2024 Elara6331 <elara@elara.ws>
+ *
+ * This file is part of Seashell.
+ *
+ * Seashell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * Seashell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with Seashell.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/alexedwards/argon2id"
+	"github.com/gliderlabs/ssh"
+	"go.elara.ws/seashell/internal/config"
+	"go.elara.ws/seashell/internal/fail2ban"
+	"go.elara.ws/seashell/internal/router"
+	"go.elara.ws/seashell/internal/sshctx"
+	"go.elara.ws/seashell/internal/userstore"
+)
+
+// passwordFiles stores the password hashes that users from the config set
+// themselves, in a file named after each user. They replace the hashes
+// from the config.
+type passwordFiles struct {
+	dir string
+	mu  sync.Mutex
+}
+
+// read returns the password hash saved for the given
+// user, or an empty string if there isn't one.
+func (pf *passwordFiles) read(username string) (string, error) {
+	if pf == nil {
+		return "", nil
+	}
+
+	pf.mu.Lock()
+	defer pf.mu.Unlock()
+
+	data, err := os.ReadFile(filepath.Join(pf.dir, filepath.Base(username)))
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", nil
+	}
+	return strings.TrimSpace(string(data)), err
+}
+
+// write saves a new password hash for the given user.
+func (pf *passwordFiles) write(username, hash string) error {
+	pf.mu.Lock()
+	defer pf.mu.Unlock()
+
+	if err := os.MkdirAll(pf.dir, 0o700); err != nil {
+		return err
+	}
+
+	path := filepath.Join(pf.dir, filepath.Base(username))
+	if err := os.WriteFile(path+".tmp", []byte(hash+"\n"), 0o600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// passwdHandler returns the handler for the built-in route where users can
+// change their own password. The new password is hashed with argon2id and
+// saved to the user database or the password files, depending on where
+// the user comes from.
+func passwdHandler(f2b *fail2ban.Fail2Ban, cfg config.Config, ap authProviders) router.Handler {
+	return func(sess ssh.Session, arg string) error {
+		user, _ := sshctx.GetUser(sess.Context())
+		if user.Guest {
+			return router.ErrUnauthorized
+		}
+
+		if _, _, ok := sess.Pty(); !ok {
+			return errors.New("changing your password requires a pty (try adding the -t flag)")
+		}
+
+		ps, ok, err := userPasswordStore(sess.Context(), cfg, ap, user.Name)
+		if err != nil {
+			return err
+		} else if !ok {
+			return errors.New("your password can't be changed here")
+		}
+
+		// Users without a password, like ones that only use public
+		// keys, don't have a current password to enter.
+		if user.Password != "" {
+			fmt.Fprint(sess.Stderr(), "Current password: ")
+			current, err := readSecret(sess)
+			if err != nil {
+				return err
+			}
+
+			if ok, err := checkPassword(current, user.Password); err != nil || !ok {
+				log.Warn("Failed password change attempt", slog.String("user", user.Name), slog.Any("addr", sess.RemoteAddr()))
+				addFailedLogin(f2b, sess.RemoteAddr())
+				return errors.New("incorrect password")
+			}
+		}
+
+		fmt.Fprint(sess.Stderr(), "New password: ")
+		newPassword, err := readSecret(sess)
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprint(sess.Stderr(), "Retype new password: ")
+		retyped, err := readSecret(sess)
+		if err != nil {
+			return err
+		}
+
+		if newPassword == "" {
+			return errors.New("the new password can't be empty")
+		} else if newPassword != retyped {
+			return errors.New("the passwords don't match")
+		}
+
+		hash, err := argon2id.CreateHash(newPassword, argon2id.DefaultParams)
+		if err != nil {
+			return err
+		}
+
+		if ps != nil {
+			err = ps.SetPassword(sess.Context(), user.Name, hash)
+		} else {
+			err = ap.passwordFiles.write(user.Name, hash)
+		}
+		if err != nil {
+			return err
+		}
+
+		log.Info("User changed password", slog.String("user", user.Name))
+		fmt.Fprint(sess.Stderr(), "Password changed\r\n")
+		return nil
+	}
+}
+
+// userPasswordStore returns the user store if the user comes from it and it
+// can save passwords. If the user comes from the config, ps is nil and ok is
+// true if password files are configured. Otherwise, ok is false.
+func userPasswordStore(ctx ssh.Context, cfg config.Config, ap authProviders, username string) (ps userstore.PasswordStore, ok bool, err error) {
+	ks, ok, err := userKeyStore(ctx, cfg, ap, username)
+	if err != nil || !ok {
+		return nil, false, err
+	} else if ks == nil {
+		return nil, ap.passwordFiles != nil, nil
+	}
+
+	ps, ok = ap.store.(userstore.PasswordStore)
+	return ps, ok, nil
+}
@@ -0,0 +1,197 @@
+/*
+ * Seashell - SSH server with virtual hosts and username-based routing
+ *
+ * Copyright (C) 2024 Elara6331 <elara@elara.ws>
+ *
+ * This file is part of Seashell.
+ *
+ * Seashell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * Seashell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with Seashell.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"crypto/sha512"
+	"crypto/subtle"
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/alexedwards/argon2id"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// errUnknownHash is returned when a password hash isn't in a supported format.
+var errUnknownHash = errors.New("unknown password hash format")
+
+// checkPassword checks whether password matches hash. The hash format
+// is detected using its prefix. Supported formats are argon2id, bcrypt
+// (e.x. from htpasswd), and sha512-crypt (e.x. from /etc/shadow).
+func checkPassword(password, hash string) (bool, error) {
+	switch {
+	case hash == "":
+		// Users without a password can't use password authentication
+		return false, nil
+	case strings.HasPrefix(hash, "$argon2id$"):
+		return argon2id.ComparePasswordAndHash(password, hash)
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"), strings.HasPrefix(hash, "$2y$"):
+		err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return false, nil
+		}
+		return err == nil, err
+	case strings.HasPrefix(hash, "$6$"):
+		computed, err := sha512Crypt(password, hash)
+		if err != nil {
+			return false, err
+		}
+		return subtle.ConstantTimeCompare([]byte(computed), []byte(hash)) == 1, nil
+	default:
+		return false, errUnknownHash
+	}
+}
+
+const (
+	sha512CryptDefaultRounds = 5000
+	sha512CryptMinRounds     = 1000
+	sha512CryptMaxRounds     = 999999999
+	sha512CryptMaxSalt       = 16
+)
+
+// sha512Crypt hashes password using the salt and rounds from the given
+// sha512-crypt hash, and returns the result in the same format, as
+// described in https://www.akkadia.org/drepper/SHA-crypt.txt.
+func sha512Crypt(password, hash string) (string, error) {
+	params := strings.TrimPrefix(hash, "$6$")
+
+	rounds := sha512CryptDefaultRounds
+	customRounds := false
+	if rest, ok := strings.CutPrefix(params, "rounds="); ok {
+		roundsStr, after, ok := strings.Cut(rest, "$")
+		if !ok {
+			return "", errors.New("invalid sha512-crypt hash")
+		}
+
+		n, err := strconv.Atoi(roundsStr)
+		if err != nil {
+			return "", err
+		}
+		rounds = min(max(n, sha512CryptMinRounds), sha512CryptMaxRounds)
+		customRounds = true
+		params = after
+	}
+
+	salt, _, _ := strings.Cut(params, "$")
+	if len(salt) > sha512CryptMaxSalt {
+		salt = salt[:sha512CryptMaxSalt]
+	}
+
+	pwd, slt := []byte(password), []byte(salt)
+
+	h := sha512.New()
+	h.Write(pwd)
+	h.Write(slt)
+	h.Write(pwd)
+	b := h.Sum(nil)
+
+	h.Reset()
+	h.Write(pwd)
+	h.Write(slt)
+	h.Write(repeatBytes(b, len(pwd)))
+	for n := len(pwd); n > 0; n >>= 1 {
+		if n&1 != 0 {
+			h.Write(b)
+		} else {
+			h.Write(pwd)
+		}
+	}
+	a := h.Sum(nil)
+
+	h.Reset()
+	for range len(pwd) {
+		h.Write(pwd)
+	}
+	p := repeatBytes(h.Sum(nil), len(pwd))
+
+	h.Reset()
+	for range 16 + int(a[0]) {
+		h.Write(slt)
+	}
+	s := repeatBytes(h.Sum(nil), len(slt))
+
+	c := a
+	for i := range rounds {
+		h.Reset()
+		if i%2 != 0 {
+			h.Write(p)
+		} else {
+			h.Write(c)
+		}
+		if i%3 != 0 {
+			h.Write(s)
+		}
+		if i%7 != 0 {
+			h.Write(p)
+		}
+		if i%2 != 0 {
+			h.Write(c)
+		} else {
+			h.Write(p)
+		}
+		c = h.Sum(nil)
+	}
+
+	out := strings.Builder{}
+	out.WriteString("$6$")
+	if customRounds {
+		out.WriteString("rounds=" + strconv.Itoa(rounds) + "$")
+	}
+	out.WriteString(salt)
+	out.WriteByte('$')
+	for _, idx := range sha512CryptOrder {
+		cryptBase64(&out, uint(c[idx[0]])<<16|uint(c[idx[1]])<<8|uint(c[idx[2]]), 4)
+	}
+	cryptBase64(&out, uint(c[63]), 2)
+	return out.String(), nil
+}
+
+// sha512CryptOrder is the order in which the bytes of
+// a sha512-crypt hash are encoded, three at a time.
+var sha512CryptOrder = [][3]int{
+	{0, 21, 42}, {22, 43, 1}, {44, 2, 23}, {3, 24, 45}, {25, 46, 4},
+	{47, 5, 26}, {6, 27, 48}, {28, 49, 7}, {50, 8, 29}, {9, 30, 51},
+	{31, 52, 10}, {53, 11, 32}, {12, 33, 54}, {34, 55, 13}, {56, 14, 35},
+	{15, 36, 57}, {37, 58, 16}, {59, 17, 38}, {18, 39, 60}, {40, 61, 19},
+	{62, 20, 41},
+}
+
+// cryptAlphabet is the base64 alphabet used by crypt(3).
+const cryptAlphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// cryptBase64 writes the n least significant 6-bit groups of v to sb.
+func cryptBase64(sb *strings.Builder, v uint, n int) {
+	for range n {
+		sb.WriteByte(cryptAlphabet[v&0x3f])
+		v >>= 6
+	}
+}
+
+// repeatBytes repeats b until it's n bytes long.
+func repeatBytes(b []byte, n int) []byte {
+	out := make([]byte, 0, n)
+	for len(out) < n {
+		out = append(out, b[:min(len(b), n-len(out))]...)
+	}
+	return out
+}
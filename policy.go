@@ -0,0 +1,254 @@
+/*
+ * Seashell - SSH server with virtual hosts and username-based routing
+ *
+ * Copyright (C) 2024 Elara6331 <elara@elara.ws>
+ *
+ * This file is part of Seashell.
+ *
+ * Seashell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * Seashell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with Seashell.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	"go.elara.ws/seashell/internal/config"
+	"go.elara.ws/seashell/internal/router"
+	"go.elara.ws/seashell/internal/sshctx"
+)
+
+var (
+	// errOutsideSchedule is returned when a user tries to connect
+	// outside of the times they're allowed to.
+	errOutsideSchedule = errors.New("access is not allowed at this time")
+	// errAccountExpired is returned when a user's account has expired.
+	errAccountExpired = errors.New("account expired")
+)
+
+// accessPolicy contains the rules that decide whether an authenticated
+// user may connect, which are checked both at login and when a session
+// starts.
+type accessPolicy struct {
+	// groups adds the groups from group blocks to users when they log in
+	groups    config.Membership
+	schedules []schedule
+}
+
+// schedule is a parsed [config.Schedule].
+type schedule struct {
+	name       string
+	users      []string
+	groups     []string
+	days       []time.Weekday
+	start, end time.Duration
+	loc        *time.Location
+}
+
+// weekdays maps day names to weekdays
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// newAccessPolicy parses the access rules in the auth config.
+func newAccessPolicy(cfg config.Auth) (*accessPolicy, error) {
+	for _, user := range cfg.Users {
+		if _, err := parseExpiry(user.Expires); err != nil {
+			return nil, fmt.Errorf("user %q: %w", user.Name, err)
+		}
+	}
+
+	groups, err := config.NewMembership(cfg.Groups)
+	if err != nil {
+		return nil, err
+	}
+
+	ap := &accessPolicy{groups: groups}
+	for _, sc := range cfg.Schedules {
+		s := schedule{name: sc.Name, users: sc.Users, groups: sc.Groups, loc: time.Local}
+
+		for _, day := range sc.Days {
+			wd, ok := weekdays[strings.ToLower(day)[:min(3, len(day))]]
+			if !ok {
+				return nil, fmt.Errorf("schedule %q: invalid day %q", sc.Name, day)
+			}
+			s.days = append(s.days, wd)
+		}
+
+		var err error
+		s.start, err = parseTimeOfDay(sc.Start)
+		if err != nil {
+			return nil, fmt.Errorf("schedule %q: %w", sc.Name, err)
+		}
+		s.end, err = parseTimeOfDay(sc.End)
+		if err != nil {
+			return nil, fmt.Errorf("schedule %q: %w", sc.Name, err)
+		}
+
+		if sc.Timezone != "" {
+			s.loc, err = time.LoadLocation(sc.Timezone)
+			if err != nil {
+				return nil, fmt.Errorf("schedule %q: %w", sc.Name, err)
+			}
+		}
+
+		ap.schedules = append(ap.schedules, s)
+	}
+	return ap, nil
+}
+
+// parseTimeOfDay parses a time in the form HH:MM and returns
+// the time since midnight.
+func parseTimeOfDay(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// parseExpiry parses a user's expiry time, which is either an RFC 3339
+// timestamp or a date. Accounts with a date stay valid until the end of
+// that day in the local timezone. It returns the zero time if s is empty.
+func parseExpiry(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+
+	t, err := time.ParseInLocation(time.DateOnly, s, time.Local)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid expiry %q", s)
+	}
+	return t.AddDate(0, 0, 1), nil
+}
+
+// appliesTo checks whether the schedule applies to the given user.
+func (s schedule) appliesTo(user config.User) bool {
+	if slices.Contains(s.users, user.Name) {
+		return true
+	}
+	for _, group := range user.Groups {
+		if slices.Contains(s.groups, group) {
+			return true
+		}
+	}
+	return false
+}
+
+// active checks whether t is within the schedule. If the end time is
+// before the start time, the schedule continues past midnight.
+func (s schedule) active(t time.Time) bool {
+	t = t.In(s.loc)
+	if len(s.days) > 0 && !slices.Contains(s.days, t.Weekday()) {
+		return false
+	}
+
+	tod := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	if s.end < s.start {
+		return tod >= s.start || tod < s.end
+	}
+	return tod >= s.start && tod < s.end
+}
+
+// check returns an error if the user isn't allowed to connect at time t,
+// or if their account has expired. Users that have schedules must be
+// within at least one of them, and users without schedules can connect
+// at any time.
+func (ap *accessPolicy) check(user config.User, t time.Time) error {
+	expires, err := parseExpiry(user.Expires)
+	if err != nil {
+		return err
+	} else if !expires.IsZero() && !t.Before(expires) {
+		return errAccountExpired
+	}
+
+	hasSchedule := false
+	for _, s := range ap.schedules {
+		if !s.appliesTo(user) {
+			continue
+		}
+		if s.active(t) {
+			return nil
+		}
+		hasSchedule = true
+	}
+
+	if hasSchedule {
+		return errOutsideSchedule
+	}
+	return nil
+}
+
+// withAccessPolicy wraps an authentication handler so that logins from
+// users that the access policy doesn't allow are rejected. It also adds
+// the groups the user is a member of through group blocks to the user.
+func withAccessPolicy[T any](ap *accessPolicy, h func(ssh.Context, T) bool) func(ssh.Context, T) bool {
+	return func(ctx ssh.Context, cred T) bool {
+		if !h(ctx, cred) {
+			return false
+		}
+
+		user, _ := sshctx.GetUser(ctx)
+		user = ap.groups.Expand(user)
+		sshctx.SetUser(ctx, user)
+
+		if err := ap.check(user, time.Now()); errors.Is(err, errAccountExpired) {
+			log.Warn(
+				"Account expired",
+				slog.String("user", user.Name),
+				slog.String("addr", ctx.RemoteAddr().String()),
+				slog.String("expires", user.Expires),
+			)
+			return false
+		} else if err != nil {
+			log.Warn(
+				"Login denied by access policy",
+				slog.String("user", user.Name),
+				slog.String("addr", ctx.RemoteAddr().String()),
+				slog.Any("reason", err),
+			)
+			return false
+		}
+		return true
+	}
+}
+
+// middleware returns a middleware that checks the access policy when a
+// session starts, since sessions can be opened long after the login.
+func (ap *accessPolicy) middleware() router.Middleware {
+	return func(next router.Handler) router.Handler {
+		return func(sess ssh.Session, arg string) error {
+			user, _ := sshctx.GetUser(sess.Context())
+			if err := ap.check(user, time.Now()); err != nil {
+				return err
+			}
+			return next(sess, arg)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+/*
+ * Seashell - SSH server with virtual hosts and username-based routing
+ *
+ * Copyright (C) 2024 Elara6331 <elara@elara.ws>
+ *
+ * This file is part of Seashell.
+ *
+ * Seashell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * Seashell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with Seashell.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	"go.elara.ws/seashell/internal/fail2ban"
+	"go.elara.ws/seashell/internal/router"
+	"go.elara.ws/seashell/internal/sshctx"
+)
+
+// reauthAttempts is the number of times a user can try to re-authenticate
+// before the session is rejected.
+const reauthAttempts = 3
+
+// reauthMiddleware returns a middleware that asks users to enter their password
+// or a TOTP code again when a session starts, even if they logged in with a
+// public key. Each failed attempt is reported to fail2ban. If method is empty,
+// sessions aren't changed.
+func reauthMiddleware(method string, f2b *fail2ban.Fail2Ban, ap authProviders) (router.Middleware, error) {
+	switch method {
+	case "":
+		return func(next router.Handler) router.Handler { return next }, nil
+	case methodPassword, methodTOTP:
+	default:
+		return nil, fmt.Errorf("invalid re-authentication method: %q", method)
+	}
+
+	return func(next router.Handler) router.Handler {
+		return func(sess ssh.Session, arg string) error {
+			if _, _, ok := sess.Pty(); !ok {
+				return errors.New("this route requires re-authentication, but this session has no pty (try adding the -t flag)")
+			}
+
+			user, _ := sshctx.GetUser(sess.Context())
+			prompt := "Password: "
+			if method == methodTOTP {
+				prompt = "Verification code: "
+			}
+
+			for range reauthAttempts {
+				fmt.Fprint(sess.Stderr(), prompt)
+				answer, err := readSecret(sess)
+				if err != nil {
+					return err
+				}
+
+				var ok bool
+				if method == methodTOTP {
+					ok = user.TOTPSecret != "" && checkTOTP(user.Name, user.TOTPSecret, answer, time.Now())
+				} else {
+					ok = reauthPassword(ap, user.Name, user.Password, answer)
+				}
+				if ok {
+					return next(sess, arg)
+				}
+
+				log.Warn("Failed re-authentication attempt", slog.String("user", user.Name), slog.Any("addr", sess.RemoteAddr()))
+				addFailedLogin(f2b, sess.RemoteAddr())
+				if method == methodTOTP {
+					addFailedUserLogin(f2b, sess.RemoteAddr(), user.Name)
+				}
+				fmt.Fprint(sess.Stderr(), "Permission denied, please try again.\r\n")
+			}
+
+			return router.ErrUnauthorized
+		}
+	}, nil
+}
+
+// reauthPassword checks a password entered during re-authentication. Users
+// without a password hash, like ones from LDAP, are checked against the
+// LDAP directory if there is one.
+func reauthPassword(ap authProviders, username, hash, password string) bool {
+	if hash == "" && ap.ldap != nil {
+		_, err := ap.ldap.Authenticate(username, password)
+		return err == nil
+	}
+	ok, err := checkPassword(password, hash)
+	return err == nil && ok
+}
+
+// readSecret reads a line from the session without echoing it. It reads one
+// byte at a time, so none of the input meant for the backend is consumed.
+func readSecret(sess ssh.Session) (string, error) {
+	var out []byte
+	buf := make([]byte, 1)
+	for {
+		if _, err := sess.Read(buf); err != nil {
+			return "", err
+		}
+
+		switch buf[0] {
+		case '\r', '\n':
+			fmt.Fprint(sess.Stderr(), "\r\n")
+			return string(out), nil
+		case '\x7F', '\x08':
+			if len(out) != 0 {
+				out = out[:len(out)-1]
+			}
+		case '\x03', '\x04':
+			fmt.Fprint(sess.Stderr(), "\r\n")
+			return "", errors.New("input canceled")
+		default:
+			out = append(out, buf[0])
+		}
+	}
+}
@@ -0,0 +1,156 @@
+/*
+ * Seashell - SSH server with virtual hosts and username-based routing
+ *
+ * Copyright (C) 2024 Elara6331 <elara@elara.ws>
+ *
+ * This file is part of Seashell.
+ *
+ * Seashell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * Seashell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with Seashell.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	"go.elara.ws/seashell/internal/krl"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// revocationList checks public keys against revoked key files, which can be
+// OpenSSH KRLs or lists of keys in the authorized_keys format. The files are
+// reloaded whenever they change, so keys can be revoked without a restart.
+type revocationList struct {
+	mu    sync.Mutex
+	files []*revokedKeysFile
+}
+
+// revokedKeysFile is a single revoked keys file.
+type revokedKeysFile struct {
+	path    string
+	modTime time.Time
+	size    int64
+	krl     *krl.KRL
+	keys    []ssh.PublicKey
+}
+
+// newRevocationList loads the given revoked keys files. It returns
+// nil if there aren't any.
+func newRevocationList(paths []string) (*revocationList, error) {
+	if len(paths) == 0 {
+		return nil, nil
+	}
+
+	rl := &revocationList{}
+	for _, path := range paths {
+		f := &revokedKeysFile{path: path}
+		if err := f.load(); err != nil {
+			return nil, err
+		}
+		rl.files = append(rl.files, f)
+	}
+	return rl, nil
+}
+
+// isRevoked checks whether key has been revoked. If a file that has
+// changed can't be reloaded, the error is logged and the previous
+// version is used.
+func (rl *revocationList) isRevoked(key ssh.PublicKey) bool {
+	if rl == nil {
+		return false
+	}
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	for _, f := range rl.files {
+		if err := f.reloadIfChanged(); err != nil {
+			log.Warn("Error reloading revoked keys", slog.String("path", f.path), slog.Any("error", err))
+		}
+
+		if f.krl != nil && f.krl.IsRevoked(key) {
+			return true
+		}
+		for _, revoked := range f.keys {
+			if pubkeyMatches(key, revoked) || isRevokedCA(key, revoked) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isRevokedCA checks whether key is a certificate signed by a revoked CA.
+func isRevokedCA(key, revoked ssh.PublicKey) bool {
+	cert, ok := key.(*gossh.Certificate)
+	return ok && ssh.KeysEqual(cert.SignatureKey, revoked)
+}
+
+// reloadIfChanged reloads the file if its size or modification
+// time has changed since it was last loaded.
+func (f *revokedKeysFile) reloadIfChanged() error {
+	fi, err := os.Stat(f.path)
+	if err != nil {
+		return err
+	}
+	if fi.ModTime().Equal(f.modTime) && fi.Size() == f.size {
+		return nil
+	}
+	return f.load()
+}
+
+// load reads and parses the file.
+func (f *revokedKeysFile) load() error {
+	fi, err := os.Stat(f.path)
+	if err != nil {
+		return err
+	}
+
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		return err
+	}
+
+	if bytes.HasPrefix(data, []byte(krl.Magic)) {
+		list, err := krl.Parse(data)
+		if err != nil {
+			return err
+		}
+		f.krl, f.keys = list, nil
+	} else {
+		var keys []ssh.PublicKey
+		for i, line := range bytes.Split(data, []byte{'\n'}) {
+			line = bytes.TrimSpace(line)
+			if len(line) == 0 || line[0] == '#' {
+				continue
+			}
+
+			key, _, _, _, err := ssh.ParseAuthorizedKey(line)
+			if err != nil {
+				return fmt.Errorf("invalid revoked key on line %d: %w", i+1, err)
+			}
+			keys = append(keys, key)
+		}
+		f.krl, f.keys = nil, keys
+	}
+
+	f.modTime, f.size = fi.ModTime(), fi.Size()
+	return nil
+}
@@ -37,7 +37,7 @@ route "cluster" {
 route "docker" {
     backend = "docker"
     match = "docker\\.(.+)"
-    settings = {
+    docker {
         command = ["/bin/bash"]
     }
 }
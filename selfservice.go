@@ -0,0 +1,298 @@
+/*
+ * Seashell - SSH server with virtual hosts and username-based routing
+ *
+ * Copyright (C) 2024 Elara6331 <elara@elara.ws>
+ *
+ * This file is part of Seashell.
+ *
+ * Seashell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * Seashell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with Seashell.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/gliderlabs/ssh"
+	"go.elara.ws/seashell/internal/config"
+	"go.elara.ws/seashell/internal/router"
+	"go.elara.ws/seashell/internal/sshctx"
+	"go.elara.ws/seashell/internal/userstore"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// maxKeysInput is the maximum amount of data read
+// from a session when adding keys.
+const maxKeysInput = 64 * 1024
+
+// keyFiles stores the public keys that users from the config add themselves,
+// in an authorized_keys file named after each user.
+type keyFiles struct {
+	dir string
+	mu  sync.Mutex
+}
+
+// read returns the keys saved for the given user.
+func (kf *keyFiles) read(username string) ([]string, error) {
+	if kf == nil {
+		return nil, nil
+	}
+
+	kf.mu.Lock()
+	defer kf.mu.Unlock()
+	return kf.readLocked(username)
+}
+
+// readLocked is like read, but kf.mu must be held by the caller.
+func (kf *keyFiles) readLocked(username string) ([]string, error) {
+	data, err := os.ReadFile(kf.path(username))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var keys []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#") {
+			keys = append(keys, line)
+		}
+	}
+	return keys, nil
+}
+
+// update replaces the keys saved for the given user with the result of fn.
+func (kf *keyFiles) update(username string, fn func([]string) []string) error {
+	kf.mu.Lock()
+	defer kf.mu.Unlock()
+
+	keys, err := kf.readLocked(username)
+	if err != nil {
+		return err
+	}
+	keys = fn(keys)
+
+	if err := os.MkdirAll(kf.dir, 0o755); err != nil {
+		return err
+	}
+
+	// Write to a temporary file first, so a failed write
+	// doesn't leave the user with a truncated key file.
+	tmp := kf.path(username) + ".tmp"
+	data := strings.Join(keys, "\n") + "\n"
+	if err := os.WriteFile(tmp, []byte(data), 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, kf.path(username))
+}
+
+// path returns the path of the given user's key file.
+func (kf *keyFiles) path(username string) string {
+	return filepath.Join(kf.dir, filepath.Base(username))
+}
+
+// selfServiceHandler returns the handler for the built-in route where users can
+// list, add, and remove their own public keys. Keys from the config can't be
+// removed, since they're managed by an admin.
+func selfServiceHandler(cfg config.Config, ap authProviders) router.Handler {
+	return func(sess ssh.Session, arg string) error {
+		user, _ := sshctx.GetUser(sess.Context())
+		if user.Guest {
+			return router.ErrUnauthorized
+		}
+
+		ks, ok, err := userKeyStore(sess.Context(), cfg, ap, user.Name)
+		if err != nil {
+			return err
+		} else if !ok {
+			return errors.New("your keys can't be managed here, since your account comes from an external directory")
+		}
+
+		args := sess.Command()
+		if len(args) == 0 {
+			args = []string{"list"}
+		}
+
+		switch args[0] {
+		case "list":
+			return listKeys(sess, user)
+		case "add":
+			return addKeys(sess, ap, ks, user, args[1:])
+		case "remove":
+			if len(args) != 2 {
+				return errors.New("usage: remove <fingerprint>")
+			}
+			return removeKey(sess, ap, ks, user, args[1])
+		default:
+			fmt.Fprint(sess, "Commands:\r\n")
+			fmt.Fprint(sess, "  list                  List your public keys\r\n")
+			fmt.Fprint(sess, "  add [key]             Add public keys, given as an argument or on stdin\r\n")
+			fmt.Fprint(sess, "  remove <fingerprint>  Remove a public key\r\n")
+			return router.ExitStatus(2)
+		}
+	}
+}
+
+// listKeys writes the fingerprints of the user's public keys to the session.
+func listKeys(sess ssh.Session, user config.User) error {
+	tw := tabwriter.NewWriter(sess, 0, 0, 2, ' ', 0)
+	fmt.Fprint(tw, "FINGERPRINT\tTYPE\tCOMMENT\r\n")
+	for _, pubkeyStr := range user.Pubkeys {
+		pubkey, comment, _, _, err := gossh.ParseAuthorizedKey([]byte(pubkeyStr))
+		if err != nil {
+			continue
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\r\n", gossh.FingerprintSHA256(pubkey), pubkey.Type(), comment)
+	}
+	return tw.Flush()
+}
+
+// addKeys adds the public keys given as arguments or on stdin to the user.
+// If ks is nil, they're saved to the user's key file.
+func addKeys(sess ssh.Session, ap authProviders, ks userstore.KeyStore, user config.User, args []string) error {
+	var data []byte
+	if len(args) > 0 {
+		data = []byte(strings.Join(args, " "))
+	} else {
+		var err error
+		data, err = io.ReadAll(io.LimitReader(sess, maxKeysInput))
+		if err != nil {
+			return err
+		}
+	}
+
+	var keys []string
+	for _, line := range bytes.Split(data, []byte{'\n'}) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+
+		pubkey, _, _, _, err := gossh.ParseAuthorizedKey(line)
+		if err != nil {
+			return fmt.Errorf("invalid public key: %w", err)
+		}
+		if slices.ContainsFunc(user.Pubkeys, func(s string) bool { return sameKey(s, pubkey) }) {
+			fmt.Fprintf(sess, "Already added: %s\r\n", gossh.FingerprintSHA256(pubkey))
+			continue
+		}
+		keys = append(keys, string(line))
+	}
+
+	for _, key := range keys {
+		var err error
+		if ks != nil {
+			err = ks.AddPubkey(sess.Context(), user.Name, key)
+		} else {
+			err = ap.keyFiles.update(user.Name, func(keys []string) []string {
+				return append(keys, key)
+			})
+		}
+		if err != nil {
+			return err
+		}
+
+		pubkey, _, _, _, _ := gossh.ParseAuthorizedKey([]byte(key))
+		log.Info("User added public key", slog.String("user", user.Name), slog.String("fingerprint", gossh.FingerprintSHA256(pubkey)))
+		fmt.Fprintf(sess, "Added: %s\r\n", gossh.FingerprintSHA256(pubkey))
+	}
+	return nil
+}
+
+// removeKey removes the public key with the given fingerprint from the user.
+// If ks is nil, it's removed from the user's key file.
+func removeKey(sess ssh.Session, ap authProviders, ks userstore.KeyStore, user config.User, fingerprint string) error {
+	var saved []string
+	if ks != nil {
+		saved = user.Pubkeys
+	} else {
+		var err error
+		saved, err = ap.keyFiles.read(user.Name)
+		if err != nil {
+			return err
+		}
+	}
+
+	idx := slices.IndexFunc(saved, func(s string) bool { return keyFingerprint(s) == fingerprint })
+	if idx == -1 {
+		if slices.ContainsFunc(user.Pubkeys, func(s string) bool { return keyFingerprint(s) == fingerprint }) {
+			return errors.New("this key is managed by an admin and can't be removed")
+		}
+		return fmt.Errorf("no key found with fingerprint %s", fingerprint)
+	}
+
+	var err error
+	if ks != nil {
+		err = ks.RemovePubkey(sess.Context(), user.Name, saved[idx])
+	} else {
+		err = ap.keyFiles.update(user.Name, func(keys []string) []string {
+			return slices.DeleteFunc(keys, func(s string) bool { return keyFingerprint(s) == fingerprint })
+		})
+	}
+	if err != nil {
+		return err
+	}
+
+	log.Info("User removed public key", slog.String("user", user.Name), slog.String("fingerprint", fingerprint))
+	fmt.Fprintf(sess, "Removed: %s\r\n", fingerprint)
+	return nil
+}
+
+// userKeyStore returns the user store if the user comes from it and it
+// can save public keys. If the user comes from the config, ks is nil.
+// Users in the config take priority over users in the store, like in
+// getUser. If the user doesn't come from either of them, ok is false.
+func userKeyStore(ctx ssh.Context, cfg config.Config, ap authProviders, username string) (ks userstore.KeyStore, ok bool, err error) {
+	if slices.ContainsFunc(cfg.Auth.Users, func(u config.User) bool { return u.Name == username }) {
+		return nil, true, nil
+	}
+
+	ks, isKeyStore := ap.store.(userstore.KeyStore)
+	if !isKeyStore {
+		return nil, false, nil
+	}
+
+	_, ok, err = ap.store.GetUser(ctx, username)
+	if err != nil || !ok {
+		return nil, false, err
+	}
+	return ks, true, nil
+}
+
+// keyFingerprint returns the SHA256 fingerprint of a key in the
+// authorized_keys format, or an empty string if it's invalid.
+func keyFingerprint(pubkeyStr string) string {
+	pubkey, _, _, _, err := gossh.ParseAuthorizedKey([]byte(pubkeyStr))
+	if err != nil {
+		return ""
+	}
+	return gossh.FingerprintSHA256(pubkey)
+}
+
+// sameKey checks whether the key in the authorized_keys format is key.
+func sameKey(pubkeyStr string, key gossh.PublicKey) bool {
+	return keyFingerprint(pubkeyStr) == gossh.FingerprintSHA256(key)
+}
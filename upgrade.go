@@ -0,0 +1,240 @@
+/*
+ * Seashell - SSH server with virtual hosts and username-based routing
+ *
+ * Copyright (C) 2024 Elara6331 <elara@elara.ws>
+ *
+ * This file is part of Seashell.
+ *
+ * Seashell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * Seashell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with Seashell.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+)
+
+const (
+	// listenFDEnv is the environment variable used to pass the listener's file
+	// descriptor to a new seashell process during an upgrade.
+	listenFDEnv = "SEASHELL_LISTEN_FD"
+	// metricsFDEnv is the environment variable used to pass the metrics
+	// server's listener to a new seashell process during an upgrade.
+	metricsFDEnv = "SEASHELL_METRICS_FD"
+	// readyFDEnv is the environment variable used to pass the file descriptor
+	// of the pipe a new seashell process uses to tell the old one it's ready.
+	readyFDEnv = "SEASHELL_READY_FD"
+)
+
+// upgradeTimeout is how long the old process waits for the new one to
+// become ready before giving up on the upgrade.
+const upgradeTimeout = 30 * time.Second
+
+// listen returns the listener that should be used for addr. If this process
+// was started by another seashell process during an upgrade, the listener
+// inherited from that process using the given environment variable is
+// reused.
+func listen(env, addr string) (net.Listener, error) {
+	fdStr, ok := os.LookupEnv(env)
+	if !ok {
+		return net.Listen("tcp", addr)
+	}
+	os.Unsetenv(env)
+
+	fd, err := strconv.Atoi(fdStr)
+	if err != nil {
+		return nil, err
+	}
+
+	fl := os.NewFile(uintptr(fd), "listener")
+	defer fl.Close()
+
+	log.Info("Inherited listener from previous seashell process", slog.String("addr", addr), slog.Int("fd", fd))
+	return net.FileListener(fl)
+}
+
+// notifyReady tells whoever started this process that it has loaded its
+// config and is listening. If it was started by another seashell process
+// during an upgrade, the old process is told over the inherited pipe. The
+// service manager is told using sd_notify, including the new main PID,
+// so that systemd follows the new process once the old one exits.
+func notifyReady() {
+	if fdStr, ok := os.LookupEnv(readyFDEnv); ok {
+		os.Unsetenv(readyFDEnv)
+
+		fd, err := strconv.Atoi(fdStr)
+		if err != nil {
+			log.Warn("Invalid ready file descriptor", slog.String("fd", fdStr))
+		} else {
+			fl := os.NewFile(uintptr(fd), "ready")
+			if _, err := fl.Write([]byte{1}); err != nil {
+				log.Warn("Error notifying previous seashell process", slog.Any("error", err))
+			}
+			fl.Close()
+		}
+	}
+
+	err := sdNotify(fmt.Sprintf("MAINPID=%d\nREADY=1", os.Getpid()))
+	if err != nil {
+		log.Warn("Error notifying service manager", slog.Any("error", err))
+	}
+}
+
+// sdNotify sends a state change to systemd using the socket in
+// NOTIFY_SOCKET. It does nothing if the variable isn't set.
+func sdNotify(state string) error {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return nil
+	}
+	// Abstract socket addresses start with a null byte,
+	// which systemd writes as an @ sign.
+	if addr[0] == '@' {
+		addr = "\x00" + addr[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// handleUpgrades waits for SIGUSR2, then starts a new seashell process that
+// takes over the listeners, which are keyed by the environment variable used
+// to pass each one. Once the new process is ready, handover is called, and
+// the current process stops accepting connections and waits for its existing
+// sessions to finish, after which done is closed. If the new process fails
+// to start or doesn't become ready in time, the current one keeps serving.
+func handleUpgrades(srv *ssh.Server, lns map[string]net.Listener, handover func(), done chan<- struct{}) {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGUSR2)
+
+	for range sigCh {
+		log.Info("Received SIGUSR2, starting new seashell process")
+
+		if err := startUpgrade(lns); err != nil {
+			log.Error("Error starting new seashell process, continuing to serve", slog.Any("error", err))
+			continue
+		}
+
+		log.Info("New process is ready, draining existing sessions")
+		signal.Stop(sigCh)
+		handover()
+
+		err := srv.Shutdown(context.Background())
+		if err != nil && !errors.Is(err, net.ErrClosed) {
+			log.Error("Error while draining sessions", slog.Any("error", err))
+		}
+
+		close(done)
+		return
+	}
+}
+
+// startUpgrade starts a new instance of the seashell executable, passing it
+// the file descriptors of the given listeners, and waits until it's ready.
+// If the new process exits or doesn't become ready in time, it's stopped
+// and an error is returned.
+func startUpgrade(lns map[string]net.Listener) error {
+	// Variables inherited from the process that started this one
+	// are removed, since their file descriptors may be reused.
+	env := slices.DeleteFunc(os.Environ(), func(kv string) bool {
+		name, _, _ := strings.Cut(kv, "=")
+		return name == listenFDEnv || name == metricsFDEnv || name == readyFDEnv
+	})
+
+	var files []*os.File
+	for name, ln := range lns {
+		tcpLn, ok := ln.(*net.TCPListener)
+		if !ok {
+			return errors.New("listener doesn't support file descriptor handover")
+		}
+
+		fl, err := tcpLn.File()
+		if err != nil {
+			return err
+		}
+		defer fl.Close()
+
+		// ExtraFiles entry i becomes file descriptor 3+i in the new process
+		env = append(env, name+"="+strconv.Itoa(3+len(files)))
+		files = append(files, fl)
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer readyR.Close()
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = append(files, readyW)
+	cmd.Env = append(env, readyFDEnv+"="+strconv.Itoa(3+len(files)))
+	err = cmd.Start()
+	// The write end has to be closed here, so that reading from the pipe
+	// fails once the new process exits without signaling that it's ready.
+	readyW.Close()
+	if err != nil {
+		return err
+	}
+
+	readyCh := make(chan error, 1)
+	go func() {
+		_, err := readyR.Read(make([]byte, 1))
+		if errors.Is(err, io.EOF) {
+			err = errors.New("new process exited before it was ready")
+		}
+		readyCh <- err
+	}()
+
+	select {
+	case err = <-readyCh:
+	case <-time.After(upgradeTimeout):
+		err = fmt.Errorf("new process didn't become ready within %s", upgradeTimeout)
+	}
+
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return err
+	}
+	return nil
+}
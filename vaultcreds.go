@@ -0,0 +1,128 @@
+/*
+ * Seashell - SSH server with virtual hosts and username-based routing
+ *
+ * Copyright (C) 2024 Elara6331 <elara@elara.ws>
+ *
+ * This file is part of Seashell.
+ *
+ * Seashell is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * Seashell is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with Seashell.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"go.elara.ws/seashell/internal/config"
+	"go.elara.ws/seashell/internal/vault"
+)
+
+// vaultCredCache caches the secrets containing user credentials that are
+// read from Vault, so that Vault doesn't have to be reached on every login.
+type vaultCredCache struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[string]vaultCredEntry
+}
+
+// vaultCredEntry is a cached Vault secret.
+type vaultCredEntry struct {
+	data    map[string]any
+	expires time.Time
+}
+
+// newVaultCredCache creates a cache that keeps secrets for the given duration.
+func newVaultCredCache(ttl time.Duration) *vaultCredCache {
+	return &vaultCredCache{ttl: ttl, entries: map[string]vaultCredEntry{}}
+}
+
+// read returns the secret at path, using the cached copy if it hasn't expired.
+func (vc *vaultCredCache) read(ctx context.Context, path string) (map[string]any, error) {
+	vc.mu.Lock()
+	entry, ok := vc.entries[path]
+	vc.mu.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.data, nil
+	}
+
+	data, err := vault.Default().Read(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+
+	vc.mu.Lock()
+	vc.entries[path] = vaultCredEntry{data: data, expires: time.Now().Add(vc.ttl)}
+	vc.mu.Unlock()
+	return data, nil
+}
+
+// readField reads a field from a secret. The reference must be in the form
+// path#field. The field may contain a string or a list of strings. Strings
+// are split into lines, so that several keys can be stored in one field.
+func (vc *vaultCredCache) readField(ctx context.Context, ref string) ([]string, error) {
+	path, field, ok := strings.Cut(ref, "#")
+	if !ok {
+		return nil, fmt.Errorf("vault: secret reference %q is missing a #field suffix", ref)
+	}
+
+	data, err := vc.read(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch val := data[field].(type) {
+	case string:
+		return strings.FieldsFunc(val, func(r rune) bool { return r == '\n' }), nil
+	case []any:
+		out := make([]string, 0, len(val))
+		for _, item := range val {
+			if str, ok := item.(string); ok {
+				out = append(out, str)
+			}
+		}
+		return out, nil
+	default:
+		return nil, fmt.Errorf("vault: secret %q has no field %q", path, field)
+	}
+}
+
+// resolve adds the credentials stored in Vault to the user. The
+// password is only read from Vault if the user doesn't have one in the
+// config, and keys from Vault are added to the ones in the config.
+func (vc *vaultCredCache) resolve(ctx context.Context, user config.User) (config.User, error) {
+	if user.VaultPassword != "" && user.Password == "" {
+		vals, err := vc.readField(ctx, user.VaultPassword)
+		if err != nil {
+			return user, err
+		}
+		if len(vals) > 0 {
+			user.Password = vals[0]
+		}
+	}
+
+	if user.VaultPubkeys != "" {
+		keys, err := vc.readField(ctx, user.VaultPubkeys)
+		if err != nil {
+			return user, err
+		}
+		user.Pubkeys = append(append([]string(nil), user.Pubkeys...), keys...)
+	}
+
+	return user, nil
+}